@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"sync/atomic"
 
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -28,6 +29,7 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 )
 
@@ -74,6 +76,21 @@ type Cache interface {
 	ConfigFetcher
 }
 
+// ResponseTracker is optionally implemented by caches recording the xDS state
+// of the nodes. The servers report every response sent to a node, and whether
+// the node accepted (ACK) or rejected (NACK) it.
+// ResponseTracker implementation must be thread-safe.
+type ResponseTracker interface {
+	// OnResponseSent is called once a response of the given type URL, version
+	// and nonce has been sent to a node.
+	OnResponseSent(node *core.Node, typeURL, version, nonce string)
+
+	// OnResponseAck is called when a node acknowledges the response with the
+	// given nonce. The error detail is nil if the response was accepted, and
+	// holds the reason of the rejection otherwise.
+	OnResponseAck(node *core.Node, typeURL, version, nonce string, errorDetail *rpcstatus.Status)
+}
+
 // Response is a wrapper around Envoy's DiscoveryResponse.
 type Response interface {
 	// Get the Constructed DiscoveryResponse
@@ -133,6 +150,9 @@ type RawResponse struct {
 
 	// marshaledResponse holds an atomic reference to the serialized discovery response.
 	marshaledResponse atomic.Value
+
+	// marshaler shares the marshaled resources with other responses of the same cache.
+	marshaler *marshalCache
 }
 
 // RawDeltaResponse is a pre-serialized xDS response that utilizes the delta discovery request/response objects.
@@ -149,6 +169,12 @@ type RawDeltaResponse struct {
 	// RemovedResources is a list of resource aliases which should be dropped by the consuming client.
 	RemovedResources []string
 
+	// Aliases lists the aliases resources were requested by on demand, indexed by resource name.
+	Aliases map[string][]string
+
+	// NotFound lists the aliases requested on demand which do not resolve to any resource.
+	NotFound []string
+
 	// NextVersionMap consists of updated version mappings after this response is applied
 	NextVersionMap map[string]string
 
@@ -158,6 +184,9 @@ type RawDeltaResponse struct {
 
 	// Marshaled Resources to be included in the response.
 	marshaledResponse atomic.Value
+
+	// marshaler shares the marshaled resources with other responses of the same cache.
+	marshaler *marshalCache
 }
 
 var _ Response = &RawResponse{}
@@ -201,11 +230,7 @@ func (r *RawResponse) GetDiscoveryResponse() (*discovery.DiscoveryResponse, erro
 		marshaledResources := make([]*anypb.Any, len(r.Resources))
 
 		for i, resource := range r.Resources {
-			maybeTtldResource, resourceType, err := r.maybeCreateTTLResource(resource)
-			if err != nil {
-				return nil, err
-			}
-			marshaledResource, err := MarshalResource(maybeTtldResource)
+			marshaledResource, resourceType, err := r.marshalResource(resource)
 			if err != nil {
 				return nil, err
 			}
@@ -234,15 +259,15 @@ func (r *RawDeltaResponse) GetDeltaDiscoveryResponse() (*discovery.DeltaDiscover
 	marshaledResponse := r.marshaledResponse.Load()
 
 	if marshaledResponse == nil {
-		marshaledResources := make([]*discovery.Resource, len(r.Resources))
+		marshaledResources := make([]*discovery.Resource, len(r.Resources), len(r.Resources)+len(r.NotFound))
 
 		for i, resource := range r.Resources {
 			name := GetResourceName(resource)
-			marshaledResource, err := MarshalResource(resource)
+			marshaledResource, err := r.marshaler.marshal(r.DeltaRequest.TypeUrl, resource)
 			if err != nil {
 				return nil, err
 			}
-			version := HashResource(marshaledResource)
+			version := marshaledResource.version()
 			if version == "" {
 				return nil, errors.New("failed to create a resource hash")
 			}
@@ -250,11 +275,16 @@ func (r *RawDeltaResponse) GetDeltaDiscoveryResponse() (*discovery.DeltaDiscover
 				Name: name,
 				Resource: &anypb.Any{
 					TypeUrl: r.DeltaRequest.TypeUrl,
-					Value:   marshaledResource,
+					Value:   marshaledResource.value,
 				},
 				Version: version,
+				Aliases: r.Aliases[name],
 			}
 		}
+		// Missing resources are replied as their alias, without a resource.
+		for _, alias := range r.NotFound {
+			marshaledResources = append(marshaledResources, &discovery.Resource{Name: alias, Aliases: []string{alias}})
+		}
 
 		marshaledResponse = &discovery.DeltaDiscoveryResponse{
 			Resources:         marshaledResources,
@@ -303,26 +333,39 @@ func (r *RawDeltaResponse) GetContext() context.Context {
 
 var deltaResourceTypeURL = "type.googleapis.com/" + string(proto.MessageName(&discovery.Resource{}))
 
-func (r *RawResponse) maybeCreateTTLResource(resource types.ResourceWithTTL) (types.Resource, string, error) {
-	if resource.TTL != nil {
-		wrappedResource := &discovery.Resource{
-			Name: GetResourceName(resource.Resource),
-			Ttl:  durationpb.New(*resource.TTL),
+// marshalResource returns the marshaled resource and its type URL. Resources
+// with a TTL are wrapped in a Resource carrying the TTL, which only holds the
+// actual resource if the response is not a heartbeat.
+func (r *RawResponse) marshalResource(resource types.ResourceWithTTL) (types.MarshaledResource, string, error) {
+	if resource.TTL == nil {
+		marshaledResource, err := r.marshaler.marshal(r.Request.TypeUrl, resource.Resource)
+		if err != nil {
+			return nil, "", err
 		}
+		return marshaledResource.value, r.Request.TypeUrl, nil
+	}
 
-		if !r.Heartbeat {
-			any, err := anypb.New(resource.Resource)
-			if err != nil {
-				return nil, "", err
-			}
-			any.TypeUrl = r.Request.TypeUrl
-			wrappedResource.Resource = any
-		}
+	wrappedResource := &discovery.Resource{
+		Name: GetResourceName(resource.Resource),
+		Ttl:  durationpb.New(*resource.TTL),
+	}
 
-		return wrappedResource, deltaResourceTypeURL, nil
+	if !r.Heartbeat {
+		marshaledResource, err := r.marshaler.marshal(r.Request.TypeUrl, resource.Resource)
+		if err != nil {
+			return nil, "", err
+		}
+		wrappedResource.Resource = &anypb.Any{
+			TypeUrl: r.Request.TypeUrl,
+			Value:   marshaledResource.value,
+		}
 	}
 
-	return resource.Resource, r.Request.TypeUrl, nil
+	marshaledResource, err := MarshalResource(wrappedResource)
+	if err != nil {
+		return nil, "", err
+	}
+	return marshaledResource, deltaResourceTypeURL, nil
 }
 
 // GetDiscoveryResponse returns the final passthrough Discovery Response.
@@ -0,0 +1,100 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// orphanCheckedTypes are the types only ever requested by name, following a
+// reference from another resource. A resource of these types that nothing
+// references is never sent to Envoy.
+var orphanCheckedTypes = []resource.Type{
+	resource.EndpointType,
+	resource.RouteType,
+	resource.VirtualHostType,
+	resource.SecretType,
+	resource.ExtensionConfigType,
+}
+
+// ConsistencyReport lists the reference problems found in a snapshot.
+type ConsistencyReport struct {
+	// Dangling references point to a resource missing from the snapshot.
+	Dangling []ResourceReference
+	// Orphaned resources are requested by name but referenced by no other resource.
+	Orphaned []ResourceKey
+}
+
+// CheckConsistency walks every reference between the resources of a snapshot,
+// as described in GetSnapshotReferences, and reports all dangling references
+// and orphaned resources. Unlike Snapshot.Consistent, it does not stop at the
+// first problem and also covers clusters, virtual hosts, secrets and extension
+// configs.
+func CheckConsistency(snapshot ResourceSnapshot) *ConsistencyReport {
+	report := &ConsistencyReport{}
+	if snapshot == nil {
+		return report
+	}
+
+	referenced := map[ResourceKey]struct{}{}
+	for _, ref := range GetSnapshotReferences(snapshot) {
+		referenced[ref.To] = struct{}{}
+		if _, ok := snapshot.GetResources(ref.To.TypeURL)[ref.To.Name]; !ok {
+			report.Dangling = append(report.Dangling, ref)
+		}
+	}
+
+	for _, typeURL := range orphanCheckedTypes {
+		for name := range snapshot.GetResources(typeURL) {
+			key := ResourceKey{TypeURL: typeURL, Name: name}
+			if _, ok := referenced[key]; !ok {
+				report.Orphaned = append(report.Orphaned, key)
+			}
+		}
+	}
+	sortKeys(report.Orphaned)
+
+	return report
+}
+
+// Consistent returns true if the report has no problem.
+func (r *ConsistencyReport) Consistent() bool {
+	return len(r.Dangling) == 0 && len(r.Orphaned) == 0
+}
+
+// Err returns an error describing every problem of the report, or nil if the
+// snapshot is consistent.
+func (r *ConsistencyReport) Err() error {
+	if r.Consistent() {
+		return nil
+	}
+	return errors.New(r.String())
+}
+
+// String lists the problems of the report, one per line.
+func (r *ConsistencyReport) String() string {
+	var b strings.Builder
+	for _, ref := range r.Dangling {
+		fmt.Fprintf(&b, "dangling reference %s\n", ref)
+	}
+	for _, key := range r.Orphaned {
+		fmt.Fprintf(&b, "orphaned resource %s\n", key)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
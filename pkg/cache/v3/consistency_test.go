@@ -0,0 +1,137 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/test/resource/v3"
+)
+
+func TestCheckConsistencyGeneratedSnapshot(t *testing.T) {
+	ts := resource.TestSnapshot{
+		Xds:                    resource.Ads,
+		Version:                "1",
+		UpstreamPort:           8080,
+		BasePort:               9000,
+		NumClusters:            2,
+		NumHTTPListeners:       1,
+		NumScopedHTTPListeners: 1,
+		NumVHDSHTTPListeners:   1,
+		NumTCPListeners:        1,
+		TLS:                    true,
+	}
+	report := cache.CheckConsistency(ts.Generate())
+	assert.True(t, report.Consistent(), report.String())
+	assert.NoError(t, report.Err())
+}
+
+func TestCheckConsistencyReportsAllProblems(t *testing.T) {
+	vhdsRoute := resource.MakeVHDSRouteConfig(resource.Ads, "vhds")
+	listener := resource.MakeRouteHTTPListener(resource.Ads, listenerName, 80, routeName)
+
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {testCluster},
+		rsrc.EndpointType: {testEndpoint, resource.MakeEndpoint("unused", 8080)},
+		rsrc.RouteType: {
+			resource.MakeRouteConfig(routeName, "missing-cluster"),
+			vhdsRoute,
+		},
+		rsrc.VirtualHostType: {
+			resource.MakeVirtualHost("vhds/host", clusterName),
+			resource.MakeVirtualHost("other/host", clusterName),
+		},
+		rsrc.ListenerType: {listener, resource.MakeTCPListener("tcp", 81, "missing-tcp-cluster")},
+		rsrc.SecretType:   {testSecret[0]},
+	})
+	require.NoError(t, err)
+
+	report := cache.CheckConsistency(snapshot)
+	assert.False(t, report.Consistent())
+	assert.Equal(t, []cache.ResourceReference{
+		{
+			From: cache.ResourceKey{TypeURL: rsrc.ListenerType, Name: "tcp"},
+			To:   cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: "missing-tcp-cluster"},
+		},
+		{
+			From: cache.ResourceKey{TypeURL: rsrc.RouteType, Name: routeName},
+			To:   cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: "missing-cluster"},
+		},
+	}, report.Dangling)
+	assert.Equal(t, []cache.ResourceKey{
+		{TypeURL: rsrc.EndpointType, Name: "unused"},
+		{TypeURL: rsrc.RouteType, Name: "vhds"},
+		{TypeURL: rsrc.VirtualHostType, Name: "other/host"},
+		{TypeURL: rsrc.SecretType, Name: tlsName},
+	}, report.Orphaned)
+
+	require.Error(t, report.Err())
+	assert.Contains(t, report.Err().Error(), "dangling reference "+rsrc.RouteType+"/"+routeName+" -> "+rsrc.ClusterType+"/missing-cluster")
+	assert.Contains(t, report.Err().Error(), "orphaned resource "+rsrc.SecretType+"/"+tlsName)
+}
+
+func TestGetSnapshotReferences(t *testing.T) {
+	ts := resource.TestSnapshot{
+		Xds:          resource.Ads,
+		Version:      "1",
+		UpstreamPort: 8080,
+		BasePort:     9000,
+		NumClusters:  1,
+		// The listener chains carry TLS transport sockets referencing secrets.
+		NumHTTPListeners: 1,
+		TLS:              true,
+	}
+	refs := cache.GetSnapshotReferences(ts.Generate())
+
+	listener := cache.ResourceKey{TypeURL: rsrc.ListenerType, Name: "listener-0"}
+	assert.Contains(t, refs, cache.ResourceReference{From: listener, To: cache.ResourceKey{TypeURL: rsrc.SecretType, Name: "tlssecret"}})
+	assert.Contains(t, refs, cache.ResourceReference{From: listener, To: cache.ResourceKey{TypeURL: rsrc.SecretType, Name: "rootsecret"}})
+	assert.Contains(t, refs, cache.ResourceReference{From: listener, To: cache.ResourceKey{TypeURL: rsrc.RouteType, Name: "route-1-9000"}})
+
+	cluster := cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: "cluster-1-0"}
+	assert.Contains(t, refs, cache.ResourceReference{From: cluster, To: cache.ResourceKey{TypeURL: rsrc.EndpointType, Name: "cluster-1-0"}})
+	assert.Contains(t, refs, cache.ResourceReference{
+		From: cache.ResourceKey{TypeURL: rsrc.RouteType, Name: "route-1-9000"},
+		To:   cluster,
+	})
+}
+
+func TestCheckConsistencyMirrorPolicyAndOrphanedExtension(t *testing.T) {
+	// Mirrored clusters are references too, and no filter discovers the extension config.
+	rc := resource.MakeRouteConfig(routeName, clusterName)
+	rc.VirtualHosts[0].Routes[0].GetRoute().RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{{Cluster: "mirror"}}
+
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:         {testCluster},
+		rsrc.EndpointType:        {testEndpoint},
+		rsrc.RouteType:           {rc},
+		rsrc.ExtensionConfigType: {testExtensionConfig},
+	})
+	require.NoError(t, err)
+
+	report := cache.CheckConsistency(snapshot)
+	assert.Equal(t, []cache.ResourceReference{{
+		From: cache.ResourceKey{TypeURL: rsrc.RouteType, Name: routeName},
+		To:   cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: "mirror"},
+	}}, report.Dangling)
+	assert.Contains(t, report.Orphaned, cache.ResourceKey{TypeURL: rsrc.ExtensionConfigType, Name: extensionConfigName})
+}
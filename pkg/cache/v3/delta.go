@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
@@ -26,13 +27,25 @@ type resourceContainer struct {
 	resourceMap   map[string]types.Resource
 	versionMap    map[string]string
 	systemVersion string
+	marshaler     *marshalCache
+
+	// aliases index the resources by the aliases they are requested by on demand.
+	aliases map[string]string
+
+	// onDemand replies explicitly to the subscriptions of missing resources.
+	onDemand bool
 }
 
+// notFoundVersion marks in the version map the resources replied as not found.
+const notFoundVersion = "not-found"
+
 func createDeltaResponse(ctx context.Context, req *DeltaRequest, state stream.StreamState, resources resourceContainer) *RawDeltaResponse {
 	// variables to build our response with
 	var nextVersionMap map[string]string
 	var filtered []types.Resource
 	var toRemove []string
+	var aliases map[string][]string
+	var notFound []string
 
 	// If we are handling a wildcard request, we want to respond with all resources
 	switch {
@@ -54,8 +67,8 @@ func createDeltaResponse(ctx context.Context, req *DeltaRequest, state stream.St
 
 		// Compute resources for removal
 		// The resource version can be set to "" here to trigger a removal even if never returned before
-		for name := range state.GetResourceVersions() {
-			if _, ok := resources.resourceMap[name]; !ok {
+		for name, version := range state.GetResourceVersions() {
+			if _, ok := resources.resourceMap[name]; !ok && version != notFoundVersion {
 				toRemove = append(toRemove, name)
 			}
 		}
@@ -64,6 +77,14 @@ func createDeltaResponse(ctx context.Context, req *DeltaRequest, state stream.St
 		// state.GetResourceVersions() may include resources no longer subscribed
 		// In the current code this gets silently cleaned when updating the version map
 		for name := range state.GetSubscribedResourceNames() {
+			// Glob collections are expanded to their resources.
+			if glob, ok := isGlob(name); ok {
+				filtered, toRemove = collectionDelta(glob, state, resources, nextVersionMap, filtered, toRemove)
+				continue
+			}
+			if _, seen := nextVersionMap[name]; seen {
+				continue
+			}
 			prevVersion, found := state.GetResourceVersions()[name]
 			if r, ok := resources.resourceMap[name]; ok {
 				nextVersion := resources.versionMap[name]
@@ -71,9 +92,41 @@ func createDeltaResponse(ctx context.Context, req *DeltaRequest, state stream.St
 					filtered = append(filtered, r)
 				}
 				nextVersionMap[name] = nextVersion
-			} else if found {
+			} else if target, ok := resources.aliases[name]; ok && resources.resourceMap[target] != nil {
+				// The resource is sent under its name, listing the alias it was requested by.
+				nextVersion := resources.versionMap[target]
+				if prevVersion != nextVersion {
+					if aliases == nil {
+						aliases = make(map[string][]string)
+					}
+					aliases[target] = append(aliases[target], name)
+				}
+				nextVersionMap[name] = nextVersion
+			} else if found && prevVersion != notFoundVersion {
 				toRemove = append(toRemove, name)
+				if resources.onDemand {
+					nextVersionMap[name] = notFoundVersion
+				}
+			} else if resources.onDemand {
+				// Missing resources are replied once: VHDS expects the alias
+				// without a resource, other types a removal.
+				if !found {
+					if req.GetTypeUrl() == resource.VirtualHostType {
+						notFound = append(notFound, name)
+					} else {
+						toRemove = append(toRemove, name)
+					}
+				}
+				nextVersionMap[name] = notFoundVersion
+			}
+		}
+
+		// Resources requested by aliases are sent once, unless sent under their name already.
+		for target := range aliases {
+			if _, ok := nextVersionMap[target]; ok && state.GetResourceVersions()[target] != nextVersionMap[target] {
+				continue
 			}
+			filtered = append(filtered, resources.resourceMap[target])
 		}
 	}
 
@@ -81,8 +134,44 @@ func createDeltaResponse(ctx context.Context, req *DeltaRequest, state stream.St
 		DeltaRequest:      req,
 		Resources:         filtered,
 		RemovedResources:  toRemove,
+		Aliases:           aliases,
+		NotFound:          notFound,
 		NextVersionMap:    nextVersionMap,
 		SystemVersionInfo: resources.systemVersion,
 		Ctx:               ctx,
+		marshaler:         resources.marshaler,
+	}
+}
+
+// collectionDelta adds the changed and removed resources of a glob collection to a delta response.
+func collectionDelta(glob *resource.XdstpName, state stream.StreamState, resources resourceContainer, nextVersionMap map[string]string,
+	filtered []types.Resource, toRemove []string) ([]types.Resource, []string) {
+	for name, r := range resources.resourceMap {
+		if _, seen := nextVersionMap[name]; seen || !inCollection(name, glob) {
+			continue
+		}
+		nextVersion := resources.versionMap[name]
+		if state.GetResourceVersions()[name] != nextVersion {
+			filtered = append(filtered, r)
+		}
+		nextVersionMap[name] = nextVersion
+	}
+	for name := range state.GetResourceVersions() {
+		if _, ok := resources.resourceMap[name]; ok {
+			continue
+		}
+		if _, subscribed := state.GetSubscribedResourceNames()[name]; !subscribed && inCollection(name, glob) {
+			toRemove = append(toRemove, name)
+		}
+	}
+	return filtered, toRemove
+}
+
+// inCollection returns whether a resource name belongs to a glob collection.
+func inCollection(name string, glob *resource.XdstpName) bool {
+	if !resource.IsXdstpName(name) {
+		return false
 	}
+	parsed, err := resource.ParseXdstpName(name)
+	return err == nil && parsed.InCollection(glob)
 }
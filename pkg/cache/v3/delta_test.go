@@ -9,9 +9,11 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/testing/protocmp"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
@@ -295,3 +297,46 @@ func TestSnapshotCacheDeltaWatchCancel(t *testing.T) {
 		t.Errorf("should not return a status for unknown key: got %#v", s)
 	}
 }
+
+func TestSnapshotCacheDeltaOnDemand(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithOnDemandTypes(rsrc.VirtualHostType, rsrc.ClusterType))
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.VirtualHostType: {&route.VirtualHost{Name: "local_route/vhost", Domains: []string{"foo.com", "bar.com"}}},
+		rsrc.ClusterType:     {testCluster},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+
+	// VHDS requests virtual hosts by domain, and expects missing ones to be replied without a resource.
+	state := stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{"local_route/foo.com": {}, "local_route/missing.com": {}})
+	watch := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.VirtualHostType}, state, watch)
+	require.Len(t, watch, 1)
+	resp := <-watch
+	out, err := resp.GetDeltaDiscoveryResponse()
+	require.NoError(t, err)
+	require.Len(t, out.Resources, 2)
+	assert.Equal(t, "local_route/vhost", out.Resources[0].Name)
+	assert.Equal(t, []string{"local_route/foo.com"}, out.Resources[0].Aliases)
+	assert.NotNil(t, out.Resources[0].Resource)
+	assert.Equal(t, "local_route/missing.com", out.Resources[1].Name)
+	assert.Equal(t, []string{"local_route/missing.com"}, out.Resources[1].Aliases)
+	assert.Nil(t, out.Resources[1].Resource)
+
+	// Resources are only replied as missing once.
+	state.SetResourceVersions(resp.GetNextVersionMap())
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.VirtualHostType}, state, watch)
+	assert.Empty(t, watch)
+
+	// On-demand CDS expects missing clusters to be removed.
+	state = stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{clusterName: {}, "missing": {}})
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, watch)
+	require.Len(t, watch, 1)
+	out, err = (<-watch).GetDeltaDiscoveryResponse()
+	require.NoError(t, err)
+	require.Len(t, out.Resources, 1)
+	assert.Equal(t, clusterName, out.Resources[0].Name)
+	assert.Equal(t, []string{"missing"}, out.RemovedResources)
+}
@@ -0,0 +1,318 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// SnapshotDiff describes what changed between two snapshots.
+type SnapshotDiff struct {
+	// Types holds the changes indexed by type URL.
+	// Only types whose version or resources changed are present.
+	Types map[resource.Type]*TypeDiff
+}
+
+// TypeDiff describes what changed between two snapshots for a single type URL.
+type TypeDiff struct {
+	// OldVersion and NewVersion are the versions of the type in each snapshot.
+	OldVersion string
+	NewVersion string
+
+	// Added and Removed are the sorted names of the resources only present in
+	// the new, respectively old, snapshot.
+	Added   []string
+	Removed []string
+
+	// Modified holds the resources present in both snapshots with a different
+	// content, sorted by name.
+	Modified []ResourceDiff
+}
+
+// ResourceDiff describes the field level changes of a modified resource.
+type ResourceDiff struct {
+	Name   string
+	Fields []FieldDiff
+}
+
+// FieldDiff describes a single changed field of a resource.
+// Old and New hold a text rendering of the values, and are empty when the field is unset.
+type FieldDiff struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// Diff computes the changes between two snapshots for every known response type.
+// A nil snapshot is handled as an empty snapshot.
+func Diff(old, updated ResourceSnapshot) *SnapshotDiff {
+	out := &SnapshotDiff{Types: make(map[resource.Type]*TypeDiff)}
+
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			continue
+		}
+
+		var oldResources, newResources map[string]types.Resource
+		td := &TypeDiff{}
+		if old != nil {
+			td.OldVersion = old.GetVersion(typeURL)
+			oldResources = old.GetResources(typeURL)
+		}
+		if updated != nil {
+			td.NewVersion = updated.GetVersion(typeURL)
+			newResources = updated.GetResources(typeURL)
+		}
+
+		for name, n := range newResources {
+			o, ok := oldResources[name]
+			switch {
+			case !ok:
+				td.Added = append(td.Added, name)
+			case !proto.Equal(o, n):
+				td.Modified = append(td.Modified, ResourceDiff{
+					Name:   name,
+					Fields: diffMessages("", o.ProtoReflect(), n.ProtoReflect()),
+				})
+			}
+		}
+		for name := range oldResources {
+			if _, ok := newResources[name]; !ok {
+				td.Removed = append(td.Removed, name)
+			}
+		}
+
+		if td.OldVersion == td.NewVersion && !td.Changed() {
+			continue
+		}
+		sort.Strings(td.Added)
+		sort.Strings(td.Removed)
+		sort.Slice(td.Modified, func(i, j int) bool { return td.Modified[i].Name < td.Modified[j].Name })
+		out.Types[typeURL] = td
+	}
+
+	return out
+}
+
+// Changed returns whether any resource was added, removed or modified.
+func (d *TypeDiff) Changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Modified) > 0
+}
+
+// Empty returns whether the snapshots have identical versions and resources.
+func (d *SnapshotDiff) Empty() bool {
+	return len(d.Types) == 0
+}
+
+// String renders the diff in a human-readable form, ordered by type URL and resource name.
+func (d *SnapshotDiff) String() string {
+	typeURLs := make([]string, 0, len(d.Types))
+	for typeURL := range d.Types {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+
+	var b strings.Builder
+	for _, typeURL := range typeURLs {
+		td := d.Types[typeURL]
+		fmt.Fprintf(&b, "%s (version %q -> %q)\n", typeURL, td.OldVersion, td.NewVersion)
+		for _, name := range td.Added {
+			fmt.Fprintf(&b, "  + %s\n", name)
+		}
+		for _, name := range td.Removed {
+			fmt.Fprintf(&b, "  - %s\n", name)
+		}
+		for _, rd := range td.Modified {
+			fmt.Fprintf(&b, "  ~ %s\n", rd.Name)
+			for _, fd := range rd.Fields {
+				fmt.Fprintf(&b, "      %s: %s -> %s\n", fd.Path, renderValue(fd.Old), renderValue(fd.New))
+			}
+		}
+	}
+	return b.String()
+}
+
+func renderValue(v string) string {
+	if v == "" {
+		return "<unset>"
+	}
+	return v
+}
+
+var anyFullName = (&anypb.Any{}).ProtoReflect().Descriptor().FullName()
+
+// diffMessages returns the field level differences between two messages of the same type.
+func diffMessages(path string, a, b protoreflect.Message) []FieldDiff {
+	// Compare the content of Any fields rather than their serialized bytes when the types are known.
+	if a.Descriptor().FullName() == anyFullName {
+		aa, aErr := anypb.UnmarshalNew(a.Interface().(*anypb.Any), proto.UnmarshalOptions{})
+		ba, bErr := anypb.UnmarshalNew(b.Interface().(*anypb.Any), proto.UnmarshalOptions{})
+		if aErr == nil && bErr == nil && aa.ProtoReflect().Descriptor() == ba.ProtoReflect().Descriptor() {
+			return diffMessages(path, aa.ProtoReflect(), ba.ProtoReflect())
+		}
+	}
+
+	var out []FieldDiff
+	fields := a.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		fieldPath := fd.TextName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		hasA, hasB := a.Has(fd), b.Has(fd)
+		switch {
+		case !hasA && !hasB:
+			continue
+		case !hasA || !hasB:
+			out = append(out, FieldDiff{
+				Path: fieldPath,
+				Old:  formatField(fd, a, hasA),
+				New:  formatField(fd, b, hasB),
+			})
+		case fd.IsList():
+			out = append(out, diffLists(fieldPath, fd, a.Get(fd).List(), b.Get(fd).List())...)
+		case fd.IsMap():
+			out = append(out, diffMaps(fieldPath, fd, a.Get(fd).Map(), b.Get(fd).Map())...)
+		default:
+			out = append(out, diffValues(fieldPath, fd, a.Get(fd), b.Get(fd))...)
+		}
+	}
+	return out
+}
+
+func diffLists(path string, fd protoreflect.FieldDescriptor, a, b protoreflect.List) []FieldDiff {
+	var out []FieldDiff
+	for i := 0; i < a.Len() || i < b.Len(); i++ {
+		elemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= a.Len():
+			out = append(out, FieldDiff{Path: elemPath, New: formatValue(fd, b.Get(i))})
+		case i >= b.Len():
+			out = append(out, FieldDiff{Path: elemPath, Old: formatValue(fd, a.Get(i))})
+		default:
+			out = append(out, diffValues(elemPath, fd, a.Get(i), b.Get(i))...)
+		}
+	}
+	return out
+}
+
+func diffMaps(path string, fd protoreflect.FieldDescriptor, a, b protoreflect.Map) []FieldDiff {
+	keys := map[string]protoreflect.MapKey{}
+	collect := func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys[k.String()] = k
+		return true
+	}
+	a.Range(collect)
+	b.Range(collect)
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var out []FieldDiff
+	for _, k := range sorted {
+		key := keys[k]
+		entryPath := fmt.Sprintf("%s[%q]", path, k)
+		hasA, hasB := a.Has(key), b.Has(key)
+		switch {
+		case !hasA:
+			out = append(out, FieldDiff{Path: entryPath, New: formatValue(fd.MapValue(), b.Get(key))})
+		case !hasB:
+			out = append(out, FieldDiff{Path: entryPath, Old: formatValue(fd.MapValue(), a.Get(key))})
+		default:
+			out = append(out, diffValues(entryPath, fd.MapValue(), a.Get(key), b.Get(key))...)
+		}
+	}
+	return out
+}
+
+// diffValues compares two singular values of the field, recursing into messages.
+func diffValues(path string, fd protoreflect.FieldDescriptor, a, b protoreflect.Value) []FieldDiff {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if proto.Equal(a.Message().Interface(), b.Message().Interface()) {
+			return nil
+		}
+		return diffMessages(path, a.Message(), b.Message())
+	case protoreflect.BytesKind:
+		if bytes.Equal(a.Bytes(), b.Bytes()) {
+			return nil
+		}
+	default:
+		if a.Interface() == b.Interface() {
+			return nil
+		}
+	}
+	return []FieldDiff{{Path: path, Old: formatValue(fd, a), New: formatValue(fd, b)}}
+}
+
+func formatField(fd protoreflect.FieldDescriptor, m protoreflect.Message, has bool) string {
+	if !has {
+		return ""
+	}
+	v := m.Get(fd)
+	switch {
+	case fd.IsList():
+		elems := make([]string, v.List().Len())
+		for i := range elems {
+			elems[i] = formatValue(fd, v.List().Get(i))
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case fd.IsMap():
+		var entries []string
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			entries = append(entries, fmt.Sprintf("%q: %s", k.String(), formatValue(fd.MapValue(), mv)))
+			return true
+		})
+		sort.Strings(entries)
+		return "{" + strings.Join(entries, ", ") + "}"
+	default:
+		return formatValue(fd, v)
+	}
+}
+
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "{" + prototext.MarshalOptions{}.Format(v.Message().Interface()) + "}"
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return fmt.Sprint(v.Enum())
+	case protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%q", v.Bytes())
+	default:
+		return v.String()
+	}
+}
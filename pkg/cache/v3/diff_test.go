@@ -0,0 +1,108 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/test/resource/v3"
+)
+
+func TestDiffIdenticalSnapshots(t *testing.T) {
+	d := cache.Diff(fixture.snapshot(), fixture.snapshot())
+	assert.True(t, d.Empty())
+	assert.Empty(t, d.String())
+}
+
+func TestDiffFromNilSnapshot(t *testing.T) {
+	d := cache.Diff(nil, fixture.snapshot())
+
+	clusters := d.Types[rsrc.ClusterType]
+	require.NotNil(t, clusters)
+	assert.Equal(t, "", clusters.OldVersion)
+	assert.Equal(t, fixture.version, clusters.NewVersion)
+	assert.Equal(t, []string{clusterName}, clusters.Added)
+
+	// Types absent from both snapshots are not reported.
+	assert.NotContains(t, d.Types, rsrc.RateLimitConfigType)
+}
+
+func TestDiffResources(t *testing.T) {
+	modifiedCluster := resource.MakeCluster(resource.Ads, clusterName)
+	modifiedCluster.ConnectTimeout = durationpb.New(10 * time.Second)
+
+	old, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {testCluster, resource.MakeCluster(resource.Ads, "removed")},
+		rsrc.EndpointType: {testEndpoint},
+		rsrc.RuntimeType:  {testRuntime},
+	})
+	require.NoError(t, err)
+	updated, err := cache.NewSnapshot("2", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {modifiedCluster, resource.MakeCluster(resource.Ads, "added")},
+		rsrc.EndpointType: {resource.MakeEndpoint(clusterName, 9090)},
+	})
+	require.NoError(t, err)
+
+	d := cache.Diff(old, updated)
+
+	clusters := d.Types[rsrc.ClusterType]
+	require.NotNil(t, clusters)
+	assert.Equal(t, "1", clusters.OldVersion)
+	assert.Equal(t, "2", clusters.NewVersion)
+	assert.Equal(t, []string{"added"}, clusters.Added)
+	assert.Equal(t, []string{"removed"}, clusters.Removed)
+	require.Len(t, clusters.Modified, 1)
+	assert.Equal(t, clusterName, clusters.Modified[0].Name)
+	assert.Equal(t, []cache.FieldDiff{{Path: "connect_timeout.seconds", Old: "5", New: "10"}}, clusters.Modified[0].Fields)
+
+	endpoints := d.Types[rsrc.EndpointType]
+	require.NotNil(t, endpoints)
+	require.Len(t, endpoints.Modified, 1)
+	require.Len(t, endpoints.Modified[0].Fields, 1)
+	assert.Equal(t, "endpoints[0].lb_endpoints[0].endpoint.address.socket_address.port_value", endpoints.Modified[0].Fields[0].Path)
+	assert.Equal(t, "8080", endpoints.Modified[0].Fields[0].Old)
+	assert.Equal(t, "9090", endpoints.Modified[0].Fields[0].New)
+
+	runtimes := d.Types[rsrc.RuntimeType]
+	require.NotNil(t, runtimes)
+	assert.Equal(t, "", runtimes.NewVersion)
+	assert.Equal(t, []string{runtimeName}, runtimes.Removed)
+
+	out := d.String()
+	assert.Contains(t, out, rsrc.ClusterType+` (version "1" -> "2")`)
+	assert.Contains(t, out, "  + added\n")
+	assert.Contains(t, out, "  - removed\n")
+	assert.Contains(t, out, "  ~ "+clusterName+"\n")
+	assert.Contains(t, out, "      connect_timeout.seconds: 5 -> 10\n")
+}
+
+func TestDiffVersionOnly(t *testing.T) {
+	old, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+	updated, err := cache.NewSnapshot("2", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+
+	d := cache.Diff(old, updated)
+	require.Contains(t, d.Types, rsrc.ClusterType)
+	assert.False(t, d.Types[rsrc.ClusterType].Changed())
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// IdleEvictionPolicy configures the eviction of the nodes of a snapshot cache
+// which have had no open watches for a while, e.g. after they disconnected.
+type IdleEvictionPolicy struct {
+	// IdleTimeout is how long a node must have had no open watches to be evicted.
+	IdleTimeout time.Duration
+
+	// CheckInterval is how often the nodes are checked. It defaults to IdleTimeout.
+	CheckInterval time.Duration
+
+	// EvictSnapshots also clears the snapshots of evicted nodes, including
+	// from the snapshot store. Otherwise, only their status is removed.
+	EvictSnapshots bool
+
+	// OnEvict is optionally called with the ID of every evicted node.
+	OnEvict func(node string)
+}
+
+type idleEviction struct {
+	ctx    context.Context
+	policy IdleEvictionPolicy
+}
+
+// WithIdleEviction evicts the status, and optionally the snapshot, of nodes
+// which have had no open watches for the policy idle timeout. Nodes are
+// checked until the context is canceled.
+func WithIdleEviction(ctx context.Context, policy IdleEvictionPolicy) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.eviction = &idleEviction{ctx: ctx, policy: policy}
+	}
+}
+
+func (cache *snapshotCache) runIdleEviction(ctx context.Context, policy IdleEvictionPolicy) {
+	interval := policy.CheckInterval
+	if interval <= 0 {
+		interval = policy.IdleTimeout
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			cache.evictIdleNodes(now, policy)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evictIdleNodes removes the nodes idle for longer than the policy timeout.
+func (cache *snapshotCache) evictIdleNodes(now time.Time, policy IdleEvictionPolicy) {
+	var evicted []string
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.writeMu.Lock()
+		shard.mu.Lock()
+		var deleted []string
+		for node, info := range shard.status {
+			since, idle := info.idleSince()
+			if !idle || now.Sub(since) < policy.IdleTimeout {
+				continue
+			}
+
+			cache.log.Infof("evicting node %q idle since %v", node, since)
+			delete(shard.status, node)
+			shard.forgetTransformed(node)
+			if policy.EvictSnapshots {
+				delete(shard.snapshots, node)
+				delete(shard.lastGood, node)
+				delete(shard.history, node)
+				deleted = append(deleted, node)
+			}
+			evicted = append(evicted, node)
+		}
+		shard.mu.Unlock()
+
+		// Stored snapshots are deleted without blocking the watches of the shard.
+		if cache.store != nil {
+			for _, node := range deleted {
+				if err := cache.store.Delete(node); err != nil {
+					cache.log.Errorf("failed to delete snapshot for node %q from store: %v", node, err)
+				}
+			}
+		}
+		shard.writeMu.Unlock()
+	}
+
+	if policy.EvictSnapshots {
+		for _, node := range evicted {
+			cache.ordering.forgetSequence(node)
+		}
+	}
+
+	// The callback is invoked without holding locks, so that it may use the cache.
+	if policy.OnEvict != nil {
+		for _, node := range evicted {
+			policy.OnEvict(node)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+type evictions struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (e *evictions) onEvict(node string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.nodes = append(e.nodes, node)
+}
+
+func (e *evictions) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.nodes...)
+}
+
+func TestSnapshotCacheIdleEviction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evicted := &evictions{}
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithIdleEviction(ctx, cache.IdleEvictionPolicy{
+		IdleTimeout:   50 * time.Millisecond,
+		CheckInterval: 10 * time.Millisecond,
+		OnEvict:       evicted.onEvict,
+	}))
+
+	for _, node := range []string{"active", "idle"} {
+		require.NoError(t, c.SetSnapshot(context.Background(), node, fixture.snapshot()))
+	}
+	watch := func(node string) func() {
+		return c.CreateWatch(&discovery.DiscoveryRequest{
+			Node:        &core.Node{Id: node},
+			TypeUrl:     rsrc.ClusterType,
+			VersionInfo: fixture.version,
+		}, stream.NewStreamState(false, map[string]string{}), make(chan cache.Response, 1))
+	}
+	watch("active")
+	cancelIdle := watch("idle")
+
+	// The node is evicted once its last watch has been closed for the timeout.
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, evicted.get())
+	cancelIdle()
+	assert.Eventually(t, func() bool { return len(evicted.get()) == 1 }, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []string{"idle"}, evicted.get())
+	assert.Nil(t, c.GetStatusInfo("idle"))
+	assert.NotNil(t, c.GetStatusInfo("active"))
+
+	// Snapshots are kept unless configured otherwise.
+	_, err := c.GetSnapshot("idle")
+	assert.NoError(t, err)
+}
+
+func TestSnapshotCacheIdleEvictionSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evicted := &evictions{}
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithIdleEviction(ctx, cache.IdleEvictionPolicy{
+		IdleTimeout:    10 * time.Millisecond,
+		EvictSnapshots: true,
+		OnEvict:        evicted.onEvict,
+	}))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, fixture.snapshot()))
+
+	// The watch is responded right away, leaving the node without open watches.
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType}, stream.NewStreamState(false, map[string]string{}), value)
+	require.Len(t, value, 1)
+
+	assert.Eventually(t, func() bool { return len(evicted.get()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Nil(t, c.GetStatusInfo(key))
+	_, err := c.GetSnapshot(key)
+	assert.Error(t, err)
+}
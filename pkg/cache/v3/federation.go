@@ -0,0 +1,188 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// nameMatcher matches resource names against the names requested by a client.
+// xdstp:// names are compared in their canonical form, and glob collections
+// match all their resources.
+type nameMatcher struct {
+	names map[string]bool
+	globs []*resource.XdstpName
+
+	// xdstp is set if any requested name is an xdstp:// name.
+	xdstp bool
+}
+
+func newNameMatcher(names []string) *nameMatcher {
+	m := &nameMatcher{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		m.names[name] = true
+		if !resource.IsXdstpName(name) {
+			continue
+		}
+		m.xdstp = true
+		parsed, err := resource.ParseXdstpName(name)
+		if err != nil {
+			continue
+		}
+		if parsed.IsGlob() {
+			m.globs = append(m.globs, parsed)
+		} else {
+			m.names[parsed.String()] = true
+		}
+	}
+	return m
+}
+
+// matches returns whether a resource was requested.
+func (m *nameMatcher) matches(name string) bool {
+	if m.names[name] {
+		return true
+	}
+	if !m.xdstp || !resource.IsXdstpName(name) {
+		return false
+	}
+	parsed, err := resource.ParseXdstpName(name)
+	if err != nil {
+		return false
+	}
+	if m.names[parsed.String()] {
+		return true
+	}
+	for _, glob := range m.globs {
+		if parsed.InCollection(glob) {
+			return true
+		}
+	}
+	return false
+}
+
+// superset checks that all resources were requested.
+func (m *nameMatcher) superset(resources map[string]types.ResourceWithTTL) error {
+	for name := range resources {
+		if !m.matches(name) {
+			return fmt.Errorf("%q not listed", name)
+		}
+	}
+	return nil
+}
+
+// isGlob returns whether a requested name is an xdstp:// glob collection.
+func isGlob(name string) (*resource.XdstpName, bool) {
+	if !resource.IsXdstpName(name) {
+		return nil, false
+	}
+	parsed, err := resource.ParseXdstpName(name)
+	if err != nil || !parsed.IsGlob() {
+		return nil, false
+	}
+	return parsed, true
+}
+
+// contains returns whether a name is in a list.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FederatedCache routes requests for xdstp:// resources to the cache of their
+// authority, so that a single server serves federated xDS for several
+// authorities. Requests for other names, and wildcard requests, are served by
+// the default cache.
+//
+// A request naming resources of several authorities, or of an authority with
+// no cache, is responded with nil as in MuxCache, terminating the stream.
+type FederatedCache struct {
+	// Authorities are the caches of each authority.
+	Authorities map[string]Cache
+
+	// Default serves the requests not naming xdstp:// resources. It may be nil.
+	Default Cache
+}
+
+var _ Cache = &FederatedCache{}
+
+// route returns the cache serving the named resources.
+func (f *FederatedCache) route(names []string) (Cache, error) {
+	authority, federated := "", false
+	for _, name := range names {
+		if !resource.IsXdstpName(name) {
+			continue
+		}
+		parsed, err := resource.ParseXdstpName(name)
+		if err != nil {
+			return nil, err
+		}
+		if federated && parsed.Authority != authority {
+			return nil, fmt.Errorf("request names resources of authorities %q and %q", authority, parsed.Authority)
+		}
+		authority, federated = parsed.Authority, true
+	}
+
+	if !federated {
+		if f.Default == nil {
+			return nil, fmt.Errorf("no default cache")
+		}
+		return f.Default, nil
+	}
+	cache, ok := f.Authorities[authority]
+	if !ok {
+		return nil, fmt.Errorf("no cache for authority %q", authority)
+	}
+	return cache, nil
+}
+
+func (f *FederatedCache) CreateWatch(request *Request, state stream.StreamState, value chan Response) func() {
+	cache, err := f.route(request.ResourceNames)
+	if err != nil {
+		value <- nil
+		return nil
+	}
+	return cache.CreateWatch(request, state, value)
+}
+
+func (f *FederatedCache) CreateDeltaWatch(request *DeltaRequest, state stream.StreamState, value chan DeltaResponse) func() {
+	names := append([]string(nil), request.ResourceNamesSubscribe...)
+	for name := range state.GetSubscribedResourceNames() {
+		names = append(names, name)
+	}
+	cache, err := f.route(names)
+	if err != nil {
+		value <- nil
+		return nil
+	}
+	return cache.CreateDeltaWatch(request, state, value)
+}
+
+func (f *FederatedCache) Fetch(ctx context.Context, request *Request) (Response, error) {
+	cache, err := f.route(request.ResourceNames)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Fetch(ctx, request)
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+const (
+	xdstpCollection = "xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/*"
+	xdstpA          = "xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/a"
+	xdstpB          = "xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/b?zone=1"
+	xdstpOther      = "xdstp://example.com/envoy.config.cluster.v3.Cluster/bar/c"
+)
+
+func xdstpClusters() []types.Resource {
+	return []types.Resource{
+		&cluster.Cluster{Name: xdstpA},
+		&cluster.Cluster{Name: xdstpB},
+		&cluster.Cluster{Name: xdstpOther},
+	}
+}
+
+// responseNames returns the sorted names of the resources of a response.
+func responseNames(t *testing.T, resp cache.Response) []string {
+	require.NotNil(t, resp)
+	var names []string
+	for _, r := range resp.(*cache.RawResponse).Resources {
+		names = append(names, cache.GetResourceName(r.Resource))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSnapshotCacheXdstpNames(t *testing.T) {
+	c := cache.NewSnapshotCache(true, group{}, logger{t: t})
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: xdstpClusters()})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+
+	// Glob collections resolve to their resources.
+	resp, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{xdstpCollection}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{xdstpA}, responseNames(t, resp))
+
+	// Names are matched in their canonical form. In ADS mode, all resources
+	// must be requested for the watch to be responded.
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{
+		TypeUrl:       rsrc.ClusterType,
+		ResourceNames: []string{xdstpCollection, "xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/b?zone=%31", xdstpOther},
+	}, stream.NewStreamState(false, map[string]string{}), value)
+	require.Len(t, value, 1)
+	assert.Equal(t, []string{xdstpOther, xdstpA, xdstpB}, responseNames(t, <-value))
+}
+
+func TestSnapshotCacheDeltaGlobCollection(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: xdstpClusters()})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+
+	state := stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{xdstpCollection: {}})
+	value := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, value)
+	require.Len(t, value, 1)
+	resp := (<-value).(*cache.RawDeltaResponse)
+	assert.Equal(t, []string{xdstpA}, cache.GetResourceNames(resp.Resources))
+
+	// Resources leaving the collection are removed.
+	state.SetResourceVersions(resp.NextVersionMap)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, value)
+	assert.Empty(t, value)
+	snapshot, err = cache.NewSnapshot("2", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {&cluster.Cluster{Name: xdstpOther}}})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+	require.Len(t, value, 1)
+	resp = (<-value).(*cache.RawDeltaResponse)
+	assert.Empty(t, resp.Resources)
+	assert.Equal(t, []string{xdstpA}, resp.RemovedResources)
+}
+
+func TestSnapshotCacheDeltaXdstpNames(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: xdstpClusters()})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+
+	// Subscriptions are stored in their canonical form.
+	state := stream.NewStreamState(false, nil)
+	assert.Equal(t, xdstpB, state.AddSubscribedResourceName("xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/b?zone=%31"))
+	value := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, value)
+	require.Len(t, value, 1)
+	resp := (<-value).(*cache.RawDeltaResponse)
+	assert.Equal(t, []string{xdstpB}, cache.GetResourceNames(resp.Resources))
+
+	name, ok := state.RemoveSubscribedResourceName("xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/b?zone=%31")
+	assert.True(t, ok)
+	assert.Equal(t, xdstpB, name)
+	assert.Empty(t, state.GetSubscribedResourceNames())
+}
+
+func TestLinearCacheGlobCollection(t *testing.T) {
+	c := cache.NewLinearCache(rsrc.ClusterType)
+	require.NoError(t, c.UpdateResource(xdstpOther, &cluster.Cluster{Name: xdstpOther}))
+
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{xdstpCollection}, VersionInfo: "1"},
+		stream.NewStreamState(false, map[string]string{}), value)
+	assert.Empty(t, value)
+
+	// Resources joining the collection trigger its watches.
+	require.NoError(t, c.UpdateResource(xdstpA, &cluster.Cluster{Name: xdstpA}))
+	require.Len(t, value, 1)
+	assert.Equal(t, []string{xdstpA}, responseNames(t, <-value))
+
+	// An empty collection is responded empty, rather than as a wildcard.
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"xdstp://example.com/envoy.config.cluster.v3.Cluster/baz/*"}},
+		stream.NewStreamState(false, map[string]string{}), value)
+	require.Len(t, value, 1)
+	assert.Empty(t, responseNames(t, <-value))
+}
+
+func TestFederatedCache(t *testing.T) {
+	authority := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: xdstpClusters()})
+	require.NoError(t, err)
+	require.NoError(t, authority.SetSnapshot(context.Background(), key, snapshot))
+	fallback := cache.NewLinearCache(rsrc.ClusterType)
+	require.NoError(t, fallback.UpdateResource(clusterName, testCluster))
+
+	c := &cache.FederatedCache{
+		Authorities: map[string]cache.Cache{"example.com": authority},
+		Default:     fallback,
+	}
+
+	resp, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{xdstpA}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{xdstpA}, responseNames(t, resp))
+
+	// Requests not naming xdstp resources are served by the default cache.
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType}, stream.NewStreamState(true, map[string]string{}), value)
+	assert.Equal(t, []string{clusterName}, responseNames(t, <-value))
+
+	// Requests for unknown authorities, or spanning several authorities, are rejected.
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"xdstp://other.com/envoy.config.cluster.v3.Cluster/a"}},
+		stream.NewStreamState(false, map[string]string{}), value)
+	assert.Nil(t, <-value)
+	_, err = c.Fetch(context.Background(), &discovery.DiscoveryRequest{
+		TypeUrl:       rsrc.ClusterType,
+		ResourceNames: []string{xdstpA, "xdstp://other.com/envoy.config.cluster.v3.Cluster/a"},
+	})
+	assert.Error(t, err)
+}
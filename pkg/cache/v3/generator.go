@@ -0,0 +1,508 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// Generator computes the resources requested by a node on demand.
+type Generator interface {
+	// Generate returns the resources of a type URL served to a node requesting
+	// the given names, or all the resources of the type if no name is given.
+	// It also returns the keys identifying the inputs the resources are
+	// generated from, which are passed to GeneratorCache.Invalidate when the
+	// inputs change.
+	Generate(node *core.Node, typeURL string, names []string) (resources []types.Resource, keys []string, err error)
+}
+
+// GeneratorFunc is a function implementing Generator.
+type GeneratorFunc func(node *core.Node, typeURL string, names []string) ([]types.Resource, []string, error)
+
+// Generate invokes the function.
+func (f GeneratorFunc) Generate(node *core.Node, typeURL string, names []string) ([]types.Resource, []string, error) {
+	return f(node, typeURL, names)
+}
+
+// GeneratorCache is a config watcher generating the resources requested by
+// each node when its watches are created, rather than precomputing snapshots
+// for every node. It serves both SotW and delta streams, for any type URL.
+//
+// Generated resources are memoized by node hash, type URL and requested
+// names, so that the generator is called with the first node of a hash, and
+// shared by the nodes of that hash. They are kept until a key they depend on
+// is invalidated, at which point the open watches depending on them are
+// generated again, and responded if their resources changed, until the last
+// watch of the resources is cancelled, or until no watch has used them for the
+// idle timeout, which covers the resources responded immediately to nodes
+// which never open a watch. Fetch only reuses memoized resources, and does not
+// memoize those it generates.
+//
+// The generator is called without the cache locked, possibly concurrently.
+// Watches whose resources fail to be generated are responded nil, which
+// terminates their stream.
+type GeneratorCache struct {
+	// watchCount is an atomic counter incremented for each watch. It needs to
+	// be the first field in the struct to guarantee 64-bit alignment.
+	watchCount int64
+
+	generator   Generator
+	hash        NodeHash
+	log         log.Logger
+	idleTimeout time.Duration
+
+	// Generated resources indexed by memo key.
+	entries map[string]*generatedResources
+	// Memo keys of the generated resources, indexed by invalidation key.
+	dependents map[string]map[string]struct{}
+	// Open watches indexed by memo key and watch ID.
+	watches map[string]map[int64]*generatorWatch
+
+	// Keys invalidated while resources are being generated, and the number
+	// of generations in progress, so that resources generated from
+	// invalidated inputs are not memoized.
+	invalidated []string
+	generating  int
+
+	mu sync.Mutex
+}
+
+var _ Cache = &GeneratorCache{}
+
+// generatedResources are the memoized result of a generation.
+type generatedResources struct {
+	resources  map[string]types.ResourceWithTTL
+	plain      map[string]types.Resource
+	versionMap map[string]string
+	version    string
+	keys       []string
+	marshaled  *marshalCache
+
+	// idle evicts the resources while no watch uses them.
+	idle *time.Timer
+}
+
+// generatorWatch is an open SotW or delta watch of a GeneratorCache.
+type generatorWatch struct {
+	node    *core.Node
+	typeURL string
+	names   []string
+
+	sotw  ResponseWatch
+	delta DeltaResponseWatch
+}
+
+// defaultGeneratorIdleTimeout is the time memoized resources are kept while
+// no watch uses them, which leaves nodes the time to acknowledge a response.
+const defaultGeneratorIdleTimeout = time.Minute
+
+// GeneratorCacheOption modifies the behavior of a generator cache.
+type GeneratorCacheOption func(*GeneratorCache)
+
+// WithGeneratorIdleTimeout sets the time memoized resources are kept while no
+// watch uses them. It defaults to a minute.
+func WithGeneratorIdleTimeout(timeout time.Duration) GeneratorCacheOption {
+	return func(cache *GeneratorCache) {
+		cache.idleTimeout = timeout
+	}
+}
+
+// NewGeneratorCache creates a cache generating resources with the generator.
+func NewGeneratorCache(generator Generator, hash NodeHash, logger log.Logger, opts ...GeneratorCacheOption) *GeneratorCache {
+	if logger == nil {
+		logger = log.NewDefaultLogger()
+	}
+	cache := &GeneratorCache{
+		generator:   generator,
+		hash:        hash,
+		log:         logger,
+		idleTimeout: defaultGeneratorIdleTimeout,
+		entries:     make(map[string]*generatedResources),
+		dependents:  make(map[string]map[string]struct{}),
+		watches:     make(map[string]map[int64]*generatorWatch),
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	return cache
+}
+
+// memoKey identifies the resources generated for a request.
+func (cache *GeneratorCache) memoKey(node *core.Node, typeURL string, names []string) string {
+	return cache.hash.ID(node) + "\n" + typeURL + "\n" + strings.Join(names, "\n")
+}
+
+// requestedNames returns a sorted copy of the requested names.
+func requestedNames(names []string) []string {
+	out := append([]string(nil), names...)
+	sort.Strings(out)
+	return out
+}
+
+// generate returns the memoized resources of a request, generating and
+// memoizing them if needed. It must be called with the cache mutex held, which
+// is released while the generator runs.
+func (cache *GeneratorCache) generate(key string, node *core.Node, typeURL string, names []string) (*generatedResources, error) {
+	for {
+		if entry, ok := cache.entries[key]; ok {
+			cache.release(key)
+			return entry, nil
+		}
+
+		start := len(cache.invalidated)
+		cache.generating++
+		cache.mu.Unlock()
+		entry, err := cache.build(node, typeURL, names)
+		cache.mu.Lock()
+		cache.generating--
+		stale := err == nil && invalidatedAny(entry.keys, cache.invalidated[start:])
+		if cache.generating == 0 {
+			cache.invalidated = nil
+		}
+
+		switch {
+		case err != nil:
+			return nil, err
+		case stale:
+			// The inputs changed while generating, so the resources are generated again.
+			continue
+		}
+		if existing, ok := cache.entries[key]; ok {
+			// The resources were generated concurrently for another watch.
+			cache.release(key)
+			return existing, nil
+		}
+		cache.entries[key] = entry
+		for _, dependency := range entry.keys {
+			set, ok := cache.dependents[dependency]
+			if !ok {
+				set = make(map[string]struct{})
+				cache.dependents[dependency] = set
+			}
+			set[key] = struct{}{}
+		}
+		cache.release(key)
+		return entry, nil
+	}
+}
+
+// invalidatedAny returns whether any of the keys is invalidated.
+func invalidatedAny(keys, invalidated []string) bool {
+	for _, key := range keys {
+		if contains(invalidated, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// build generates the resources of a request.
+func (cache *GeneratorCache) build(node *core.Node, typeURL string, names []string) (*generatedResources, error) {
+	resources, keys, err := cache.generator.Generate(node, typeURL, names)
+	if err != nil {
+		return nil, err
+	}
+	entry := &generatedResources{
+		resources:  make(map[string]types.ResourceWithTTL, len(resources)),
+		plain:      make(map[string]types.Resource, len(resources)),
+		versionMap: make(map[string]string, len(resources)),
+		keys:       keys,
+		marshaled:  newMarshalCache(),
+	}
+	for _, res := range resources {
+		name := GetResourceName(res)
+		marshaled, err := entry.marshaled.marshal(typeURL, res)
+		if err != nil {
+			return nil, err
+		}
+		entry.resources[name] = types.ResourceWithTTL{Resource: res}
+		entry.plain[name] = res
+		entry.versionMap[name] = marshaled.version()
+	}
+
+	// The version covers the requested names and the generated resources.
+	generated := make([]string, 0, len(entry.versionMap))
+	for name, version := range entry.versionMap {
+		generated = append(generated, name+"="+version)
+	}
+	sort.Strings(generated)
+	entry.version = HashResource([]byte(strings.Join(names, ",") + "\n" + strings.Join(generated, "\n")))
+	return entry, nil
+}
+
+// forget drops memoized resources. It must be called with the cache mutex held.
+func (cache *GeneratorCache) forget(key string) {
+	entry, ok := cache.entries[key]
+	if !ok {
+		return
+	}
+	delete(cache.entries, key)
+	if entry.idle != nil {
+		entry.idle.Stop()
+	}
+	for _, dependency := range entry.keys {
+		delete(cache.dependents[dependency], key)
+		if len(cache.dependents[dependency]) == 0 {
+			delete(cache.dependents, dependency)
+		}
+	}
+}
+
+// release schedules the eviction of memoized resources unless a watch uses
+// them, restarting the idle timeout if it was already scheduled. It must be
+// called with the cache mutex held.
+func (cache *GeneratorCache) release(key string) {
+	entry, ok := cache.entries[key]
+	if !ok || len(cache.watches[key]) > 0 {
+		return
+	}
+	if entry.idle != nil {
+		entry.idle.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(cache.idleTimeout, func() {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		// The resources may have been used or replaced meanwhile.
+		if cache.entries[key] == entry && entry.idle == timer {
+			cache.forget(key)
+		}
+	})
+	entry.idle = timer
+}
+
+// Invalidate drops the resources generated from any of the keys, and
+// generates the resources of the open watches depending on them again.
+func (cache *GeneratorCache) Invalidate(keys ...string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.generating > 0 {
+		cache.invalidated = append(cache.invalidated, keys...)
+	}
+	stale := make(map[string]struct{})
+	for _, dependency := range keys {
+		for key := range cache.dependents[dependency] {
+			stale[key] = struct{}{}
+		}
+	}
+	for key := range stale {
+		cache.forget(key)
+	}
+
+	// The watches are listed first, as the cache is unlocked while generating.
+	type staleWatch struct {
+		key   string
+		id    int64
+		watch *generatorWatch
+	}
+	var watches []staleWatch
+	for key := range stale {
+		for id, watch := range cache.watches[key] {
+			watches = append(watches, staleWatch{key: key, id: id, watch: watch})
+		}
+	}
+
+	for _, w := range watches {
+		entry, err := cache.generate(w.key, w.watch.node, w.watch.typeURL, w.watch.names)
+		if cache.watches[w.key][w.id] != w.watch {
+			// The watch was closed while generating.
+			continue
+		}
+		if err != nil {
+			cache.log.Errorf("failed to generate %s%v for node %q: %v", w.watch.typeURL, w.watch.names, w.watch.node.GetId(), err)
+			cache.fail(w.watch)
+			cache.deleteWatch(w.key, w.id)
+			continue
+		}
+		if w.watch.delta.Response != nil {
+			if cache.respondDelta(w.watch.delta.Request, w.watch.delta.Response, w.watch.delta.StreamState, entry) != nil {
+				cache.deleteWatch(w.key, w.id)
+			}
+		} else if w.watch.sotw.Request.VersionInfo != entry.version {
+			cache.respond(w.watch.sotw.Request, w.watch.sotw.Response, entry)
+			cache.deleteWatch(w.key, w.id)
+		}
+	}
+}
+
+// fail responds nil to a watch, terminating its stream.
+func (cache *GeneratorCache) fail(watch *generatorWatch) {
+	if watch.delta.Response != nil {
+		watch.delta.Response <- nil
+	} else {
+		watch.sotw.Response <- nil
+	}
+}
+
+func (cache *GeneratorCache) respond(request *Request, value chan Response, entry *generatedResources) {
+	cache.log.Debugf("respond %s%v version %q with version %q", request.TypeUrl, request.ResourceNames, request.VersionInfo, entry.version)
+	value <- createResponse(context.Background(), request, entry.marshaled, entry.resources, entry.version, false)
+}
+
+func (cache *GeneratorCache) respondDelta(request *DeltaRequest, value chan DeltaResponse, state stream.StreamState, entry *generatedResources) *RawDeltaResponse {
+	resp := createDeltaResponse(context.Background(), request, state, resourceContainer{
+		resourceMap:   entry.plain,
+		versionMap:    entry.versionMap,
+		systemVersion: entry.version,
+		marshaler:     entry.marshaled,
+	})
+
+	// Only send a response if there were changes
+	// We want to respond immediately for the first wildcard request in a stream, even if the response is empty
+	// otherwise, envoy won't complete initialization
+	if len(resp.Resources) > 0 || len(resp.RemovedResources) > 0 || (state.IsWildcard() && state.IsFirst()) {
+		cache.log.Debugf("node: %s, sending delta response for typeURL %s with resources: %v removed resources: %v with wildcard: %t",
+			request.GetNode().GetId(), request.TypeUrl, GetResourceNames(resp.Resources), resp.RemovedResources, state.IsWildcard())
+		value <- resp
+		return resp
+	}
+	return nil
+}
+
+// openWatch registers an open watch. It must be called with the cache mutex
+// held. The memoized resources are dropped once their last open watch is
+// cancelled.
+func (cache *GeneratorCache) openWatch(key string, watch *generatorWatch) func() {
+	id := atomic.AddInt64(&cache.watchCount, 1)
+	set, ok := cache.watches[key]
+	if !ok {
+		set = make(map[int64]*generatorWatch)
+		cache.watches[key] = set
+	}
+	set[id] = watch
+	if entry, ok := cache.entries[key]; ok && entry.idle != nil {
+		entry.idle.Stop()
+		entry.idle = nil
+	}
+	return func() {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if _, ok := cache.watches[key][id]; !ok {
+			// The watch was already responded.
+			return
+		}
+		cache.deleteWatch(key, id)
+		if _, ok := cache.watches[key]; !ok {
+			cache.forget(key)
+		}
+	}
+}
+
+// deleteWatch drops a watch. It must be called with the cache mutex held.
+func (cache *GeneratorCache) deleteWatch(key string, id int64) {
+	delete(cache.watches[key], id)
+	if len(cache.watches[key]) == 0 {
+		delete(cache.watches, key)
+		cache.release(key)
+	}
+}
+
+// CreateWatch generates the requested resources, and responds if they differ
+// from the version of the request.
+func (cache *GeneratorCache) CreateWatch(request *Request, _ stream.StreamState, value chan Response) func() {
+	names := requestedNames(request.ResourceNames)
+	key := cache.memoKey(request.Node, request.TypeUrl, names)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, err := cache.generate(key, request.Node, request.TypeUrl, names)
+	if err != nil {
+		cache.log.Errorf("failed to generate %s%v for node %q: %v", request.TypeUrl, names, request.GetNode().GetId(), err)
+		value <- nil
+		return nil
+	}
+	if request.VersionInfo != entry.version {
+		cache.respond(request, value, entry)
+		return nil
+	}
+	return cache.openWatch(key, &generatorWatch{
+		node:    request.Node,
+		typeURL: request.TypeUrl,
+		names:   names,
+		sotw:    ResponseWatch{Request: request, Response: value},
+	})
+}
+
+// CreateDeltaWatch generates the subscribed resources, and responds with those
+// which differ from the versions of the stream.
+func (cache *GeneratorCache) CreateDeltaWatch(request *DeltaRequest, state stream.StreamState, value chan DeltaResponse) func() {
+	var names []string
+	if !state.IsWildcard() {
+		names = sortedNames(state.GetSubscribedResourceNames())
+	}
+	key := cache.memoKey(request.Node, request.TypeUrl, names)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, err := cache.generate(key, request.Node, request.TypeUrl, names)
+	if err != nil {
+		cache.log.Errorf("failed to generate %s%v for node %q: %v", request.TypeUrl, names, request.GetNode().GetId(), err)
+		value <- nil
+		return nil
+	}
+	if cache.respondDelta(request, value, state, entry) != nil {
+		return nil
+	}
+	return cache.openWatch(key, &generatorWatch{
+		node:    request.Node,
+		typeURL: request.TypeUrl,
+		names:   names,
+		delta:   DeltaResponseWatch{Request: request, Response: value, StreamState: state},
+	})
+}
+
+// Fetch generates the requested resources, unless they are memoized.
+func (cache *GeneratorCache) Fetch(ctx context.Context, request *Request) (Response, error) {
+	names := requestedNames(request.ResourceNames)
+	key := cache.memoKey(request.Node, request.TypeUrl, names)
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	cache.mu.Unlock()
+	if !ok {
+		var err error
+		if entry, err = cache.build(request.Node, request.TypeUrl, names); err != nil {
+			return nil, err
+		}
+	}
+	if request.VersionInfo == entry.version {
+		return nil, &types.SkipFetchError{}
+	}
+	return createResponse(ctx, request, entry.marshaled, entry.resources, entry.version, false), nil
+}
+
+// NumWatches returns the number of open SotW and delta watches.
+func (cache *GeneratorCache) NumWatches() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	n := 0
+	for _, set := range cache.watches {
+		n += len(set)
+	}
+	return n
+}
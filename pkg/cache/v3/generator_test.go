@@ -0,0 +1,216 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// clusterGenerator generates the requested clusters, or clusters a and b if
+// none is requested, tagged with the generation of their key.
+type clusterGenerator struct {
+	calls       int
+	generations map[string]int
+}
+
+func (g *clusterGenerator) Generate(node *core.Node, typeURL string, names []string) ([]types.Resource, []string, error) {
+	g.calls++
+	if len(names) == 0 {
+		names = []string{"a", "b"}
+	}
+	var resources []types.Resource
+	var keys []string
+	for _, name := range names {
+		if name == "invalid" {
+			return nil, nil, errors.New("invalid cluster")
+		}
+		resources = append(resources, &cluster.Cluster{Name: name, AltStatName: strconv.Itoa(g.generations[name])})
+		keys = append(keys, name)
+	}
+	return resources, keys, nil
+}
+
+func TestGeneratorCacheCreateWatch(t *testing.T) {
+	generator := &clusterGenerator{generations: map[string]int{}}
+	c := cache.NewGeneratorCache(generator, cache.LocalityHash{}, logger{t: t})
+
+	// Nodes of the same hash share the generated resources.
+	var version string
+	for _, id := range []string{"node1", "node2"} {
+		out := make(chan cache.Response, 1)
+		request := &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"a"}, Node: &core.Node{Id: id}}
+		assert.Nil(t, c.CreateWatch(request, stream.NewStreamState(false, nil), out))
+		resp := <-out
+		assert.Equal(t, []string{"a"}, responseNames(t, resp))
+		version, _ = resp.GetVersion()
+	}
+	assert.Equal(t, 1, generator.calls)
+
+	// Up-to-date watches are left open until their keys are invalidated.
+	out := make(chan cache.Response, 1)
+	request := &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"a"}, VersionInfo: version}
+	require.NotNil(t, c.CreateWatch(request, stream.NewStreamState(false, nil), out))
+	c.Invalidate("b")
+	c.Invalidate("a")
+	assert.Empty(t, out)
+	assert.Equal(t, 1, c.NumWatches())
+	assert.Equal(t, 2, generator.calls)
+
+	generator.generations["a"]++
+	c.Invalidate("a")
+	resp := <-out
+	assert.Equal(t, "1", resp.(*cache.RawResponse).Resources[0].Resource.(*cluster.Cluster).AltStatName)
+	assert.Equal(t, 0, c.NumWatches())
+
+	// Failing to generate the resources terminates the stream.
+	out = make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"invalid"}}, stream.NewStreamState(false, nil), out)
+	assert.Nil(t, <-out)
+
+	_, err := c.Fetch(context.Background(), request)
+	require.NoError(t, err)
+}
+
+func TestGeneratorCacheCreateDeltaWatch(t *testing.T) {
+	generator := &clusterGenerator{generations: map[string]int{}}
+	c := cache.NewGeneratorCache(generator, group{}, logger{t: t})
+
+	state := stream.NewStreamState(true, nil)
+	out := make(chan cache.DeltaResponse, 1)
+	assert.Nil(t, c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, out))
+	resp := (<-out).(*cache.RawDeltaResponse)
+	assert.ElementsMatch(t, []string{"a", "b"}, cache.GetResourceNames(resp.Resources))
+	state.SetResourceVersions(resp.NextVersionMap)
+
+	out = make(chan cache.DeltaResponse, 1)
+	require.NotNil(t, c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, out))
+	assert.Empty(t, out)
+
+	// Only the resources which changed are sent.
+	generator.generations["b"]++
+	c.Invalidate("b")
+	resp = (<-out).(*cache.RawDeltaResponse)
+	assert.Equal(t, []string{"b"}, cache.GetResourceNames(resp.Resources))
+	assert.Equal(t, 2, generator.calls)
+}
+
+func TestGeneratorCacheDeltaWildcardEmpty(t *testing.T) {
+	c := cache.NewGeneratorCache(cache.GeneratorFunc(func(*core.Node, string, []string) ([]types.Resource, []string, error) {
+		return nil, nil, nil
+	}), group{}, logger{t: t})
+
+	// The first wildcard response is sent even without resources.
+	state := stream.NewStreamState(true, nil)
+	out := make(chan cache.DeltaResponse, 1)
+	assert.Nil(t, c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, out))
+	resp := (<-out).(*cache.RawDeltaResponse)
+	assert.Empty(t, resp.Resources)
+	state.SetResourceVersions(resp.NextVersionMap)
+
+	out = make(chan cache.DeltaResponse, 1)
+	require.NotNil(t, c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, out))
+	assert.Empty(t, out)
+}
+
+func TestGeneratorCacheEviction(t *testing.T) {
+	generator := &clusterGenerator{generations: map[string]int{}}
+	c := cache.NewGeneratorCache(generator, group{}, logger{t: t})
+
+	request := &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"a"}}
+	out := make(chan cache.Response, 1)
+	assert.Nil(t, c.CreateWatch(request, stream.NewStreamState(false, nil), out))
+	request.VersionInfo, _ = (<-out).GetVersion()
+
+	// Resources are kept for the watch of the acknowledged version.
+	cancel := c.CreateWatch(request, stream.NewStreamState(false, nil), out)
+	require.NotNil(t, cancel)
+	assert.Equal(t, 1, generator.calls)
+
+	// They are dropped once their last watch is cancelled.
+	cancel()
+	cancel = c.CreateWatch(request, stream.NewStreamState(false, nil), out)
+	require.NotNil(t, cancel)
+	assert.Equal(t, 2, generator.calls)
+	cancel()
+
+	// Fetched resources are not memoized.
+	for i := 0; i < 2; i++ {
+		_, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"b"}})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 4, generator.calls)
+}
+
+func TestGeneratorCacheIdleEviction(t *testing.T) {
+	generator := &clusterGenerator{generations: map[string]int{}}
+	c := cache.NewGeneratorCache(generator, group{}, logger{t: t}, cache.WithGeneratorIdleTimeout(10*time.Millisecond))
+	fetch := func(name string) {
+		_, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{name}})
+		require.NoError(t, err)
+	}
+
+	// Resources responded immediately are kept while waiting for a watch.
+	out := make(chan cache.Response, 2)
+	request := &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"a"}}
+	assert.Nil(t, c.CreateWatch(request, stream.NewStreamState(false, nil), out))
+	request.VersionInfo, _ = (<-out).GetVersion()
+	fetch("a")
+	assert.Equal(t, 1, generator.calls)
+
+	// Resources used by an open watch are not evicted.
+	require.NotNil(t, c.CreateWatch(request, stream.NewStreamState(false, nil), out))
+	time.Sleep(50 * time.Millisecond)
+	fetch("a")
+	assert.Equal(t, 1, generator.calls)
+
+	// Resources no watch uses are evicted once idle.
+	assert.Nil(t, c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"b"}}, stream.NewStreamState(false, nil), out))
+	<-out
+	assert.Equal(t, 2, generator.calls)
+	assert.Eventually(t, func() bool {
+		calls := generator.calls
+		fetch("b")
+		return generator.calls > calls
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGeneratorCacheGenerateUnlocked(t *testing.T) {
+	var c *cache.GeneratorCache
+	c = cache.NewGeneratorCache(cache.GeneratorFunc(func(*core.Node, string, []string) ([]types.Resource, []string, error) {
+		// The generator may call the cache.
+		c.NumWatches()
+		return []types.Resource{&cluster.Cluster{Name: "a"}}, []string{"a"}, nil
+	}), group{}, logger{t: t})
+
+	out := make(chan cache.Response, 1)
+	assert.Nil(t, c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType}, stream.NewStreamState(false, nil), out))
+	assert.Equal(t, []string{"a"}, responseNames(t, <-out))
+	c.Invalidate("a")
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// DependencyGraph is the graph of references between the resources of a
+// snapshot. An edge goes from a resource to each resource it references, as
+// described in GetSnapshotReferences.
+type DependencyGraph struct {
+	// Resources present in the snapshot.
+	resources map[ResourceKey]struct{}
+	// Resources referenced but missing from the snapshot.
+	missing map[ResourceKey]struct{}
+
+	outgoing map[ResourceKey][]ResourceKey
+	incoming map[ResourceKey][]ResourceKey
+	edges    []ResourceReference
+}
+
+// NewDependencyGraph builds the dependency graph of a snapshot.
+func NewDependencyGraph(snapshot ResourceSnapshot) *DependencyGraph {
+	g := &DependencyGraph{
+		resources: make(map[ResourceKey]struct{}),
+		missing:   make(map[ResourceKey]struct{}),
+		outgoing:  make(map[ResourceKey][]ResourceKey),
+		incoming:  make(map[ResourceKey][]ResourceKey),
+	}
+	if snapshot == nil {
+		return g
+	}
+
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			continue
+		}
+		for name := range snapshot.GetResources(typeURL) {
+			g.resources[ResourceKey{TypeURL: typeURL, Name: name}] = struct{}{}
+		}
+	}
+
+	// References are sorted, so are the adjacency lists.
+	g.edges = GetSnapshotReferences(snapshot)
+	for _, ref := range g.edges {
+		g.outgoing[ref.From] = append(g.outgoing[ref.From], ref.To)
+		g.incoming[ref.To] = append(g.incoming[ref.To], ref.From)
+		if _, ok := g.resources[ref.To]; !ok {
+			g.missing[ref.To] = struct{}{}
+		}
+	}
+
+	return g
+}
+
+// Resources returns the resources of the snapshot, sorted.
+func (g *DependencyGraph) Resources() []ResourceKey {
+	return sortedKeys(g.resources)
+}
+
+// Missing returns the resources referenced but missing from the snapshot, sorted.
+func (g *DependencyGraph) Missing() []ResourceKey {
+	return sortedKeys(g.missing)
+}
+
+// Edges returns every edge of the graph, sorted.
+func (g *DependencyGraph) Edges() []ResourceReference {
+	return append([]ResourceReference{}, g.edges...)
+}
+
+// Outgoing returns the resources directly referenced by a resource.
+func (g *DependencyGraph) Outgoing(key ResourceKey) []ResourceKey {
+	return append([]ResourceKey{}, g.outgoing[key]...)
+}
+
+// Incoming returns the resources directly referencing a resource.
+func (g *DependencyGraph) Incoming(key ResourceKey) []ResourceKey {
+	return append([]ResourceKey{}, g.incoming[key]...)
+}
+
+// Dependents returns every resource referencing a resource, directly or
+// transitively, sorted. These are the resources affected if it is removed,
+// e.g. the routes and listeners sending traffic to a cluster.
+func (g *DependencyGraph) Dependents(key ResourceKey) []ResourceKey {
+	seen := map[ResourceKey]struct{}{key: {}}
+	queue := []ResourceKey{key}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, from := range g.incoming[next] {
+			if _, ok := seen[from]; !ok {
+				seen[from] = struct{}{}
+				queue = append(queue, from)
+			}
+		}
+	}
+	delete(seen, key)
+	return sortedKeys(seen)
+}
+
+type graphNodeJSON struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+type graphEdgeJSON struct {
+	From graphNodeJSON `json:"from"`
+	To   graphNodeJSON `json:"to"`
+}
+
+type graphJSON struct {
+	Resources []graphNodeJSON `json:"resources"`
+	Edges     []graphEdgeJSON `json:"edges"`
+}
+
+// MarshalJSON encodes the graph as a list of resources, including missing
+// ones, and a list of edges.
+func (g *DependencyGraph) MarshalJSON() ([]byte, error) {
+	out := graphJSON{
+		Resources: []graphNodeJSON{},
+		Edges:     []graphEdgeJSON{},
+	}
+	for _, key := range g.nodes() {
+		out.Resources = append(out.Resources, g.nodeJSON(key))
+	}
+	for _, ref := range g.edges {
+		out.Edges = append(out.Edges, graphEdgeJSON{From: g.nodeJSON(ref.From), To: g.nodeJSON(ref.To)})
+	}
+	return json.Marshal(out)
+}
+
+func (g *DependencyGraph) nodeJSON(key ResourceKey) graphNodeJSON {
+	_, missing := g.missing[key]
+	return graphNodeJSON{Type: key.TypeURL, Name: key.Name, Missing: missing}
+}
+
+// DOT renders the graph in the Graphviz DOT language. Resources are labeled
+// with their short type name and missing resources are drawn dashed.
+func (g *DependencyGraph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph resources {\n")
+	for _, key := range g.nodes() {
+		fmt.Fprintf(&b, "  %q [label=%q", key.String(), shortTypeName(key.TypeURL)+"\n"+key.Name)
+		if _, ok := g.missing[key]; ok {
+			b.WriteString(" style=dashed")
+		}
+		b.WriteString("];\n")
+	}
+	for _, ref := range g.edges {
+		fmt.Fprintf(&b, "  %q -> %q;\n", ref.From.String(), ref.To.String())
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nodes returns the present and missing resources, sorted.
+func (g *DependencyGraph) nodes() []ResourceKey {
+	out := append(sortedKeys(g.resources), sortedKeys(g.missing)...)
+	sortKeys(out)
+	return out
+}
+
+// shortTypeName returns the message name of a type URL, e.g. "Cluster".
+func shortTypeName(typeURL string) string {
+	return typeURL[strings.LastIndex(typeURL, ".")+1:]
+}
+
+func sortedKeys(set map[ResourceKey]struct{}) []ResourceKey {
+	out := make([]ResourceKey, 0, len(set))
+	for key := range set {
+		out = append(out, key)
+	}
+	sortKeys(out)
+	return out
+}
+
+func sortKeys(keys []ResourceKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return lessKey(keys[i], keys[j])
+	})
+}
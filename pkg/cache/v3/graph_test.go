@@ -0,0 +1,91 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/test/resource/v3"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:     {testCluster},
+		rsrc.EndpointType:    {testEndpoint},
+		rsrc.RouteType:       {testRoute, testEmbeddedRoute},
+		rsrc.ScopedRouteType: {testScopedRoute},
+		rsrc.ListenerType:    {testListener, resource.MakeTCPListener("tcp", 81, "missing")},
+	})
+	require.NoError(t, err)
+	g := cache.NewDependencyGraph(snapshot)
+
+	clusterKey := cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: clusterName}
+	endpointKey := cache.ResourceKey{TypeURL: rsrc.EndpointType, Name: clusterName}
+	listenerKey := cache.ResourceKey{TypeURL: rsrc.ListenerType, Name: listenerName}
+	routeKey := cache.ResourceKey{TypeURL: rsrc.RouteType, Name: routeName}
+	embeddedRouteKey := cache.ResourceKey{TypeURL: rsrc.RouteType, Name: embeddedRouteName}
+	scopedRouteKey := cache.ResourceKey{TypeURL: rsrc.ScopedRouteType, Name: scopedRouteName}
+	missingKey := cache.ResourceKey{TypeURL: rsrc.ClusterType, Name: "missing"}
+
+	assert.Equal(t, []cache.ResourceKey{endpointKey}, g.Outgoing(clusterKey))
+	assert.Equal(t, []cache.ResourceKey{clusterKey}, g.Incoming(endpointKey))
+	assert.Equal(t, []cache.ResourceKey{listenerKey, scopedRouteKey}, g.Incoming(routeKey))
+	assert.Equal(t, []cache.ResourceKey{embeddedRouteKey, routeKey}, g.Incoming(clusterKey))
+
+	// Removing the cluster breaks both routes and everything referencing them.
+	assert.Equal(t, []cache.ResourceKey{listenerKey, embeddedRouteKey, routeKey, scopedRouteKey}, g.Dependents(clusterKey))
+	assert.Empty(t, g.Dependents(listenerKey))
+
+	assert.Equal(t, []cache.ResourceKey{missingKey}, g.Missing())
+	assert.Len(t, g.Resources(), 7)
+	assert.Len(t, g.Edges(), 6)
+}
+
+func TestDependencyGraphExport(t *testing.T) {
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ListenerType: {resource.MakeTCPListener("tcp", 81, clusterName)},
+	})
+	require.NoError(t, err)
+	g := cache.NewDependencyGraph(snapshot)
+
+	out, err := json.Marshal(g)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"resources": [
+			{"type": "`+rsrc.ClusterType+`", "name": "`+clusterName+`", "missing": true},
+			{"type": "`+rsrc.ListenerType+`", "name": "tcp"}
+		],
+		"edges": [
+			{
+				"from": {"type": "`+rsrc.ListenerType+`", "name": "tcp"},
+				"to": {"type": "`+rsrc.ClusterType+`", "name": "`+clusterName+`", "missing": true}
+			}
+		]
+	}`, string(out))
+
+	assert.Equal(t, `digraph resources {
+  "`+rsrc.ClusterType+`/cluster0" [label="Cluster\ncluster0" style=dashed];
+  "`+rsrc.ListenerType+`/tcp" [label="Listener\ntcp"];
+  "`+rsrc.ListenerType+`/tcp" -> "`+rsrc.ClusterType+`/cluster0";
+}
+`, g.DOT())
+}
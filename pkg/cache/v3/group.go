@@ -0,0 +1,510 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// GroupSnapshotCache is a snapshot cache where nodes share the snapshot of
+// their group, derived from the node with a NodeHash. Each node may in
+// addition have an overlay snapshot holding node specific resources, which is
+// merged with the group snapshot at response time. Resources of the overlay
+// take precedence over group resources with the same name.
+//
+// Updating a group snapshot triggers the open watches of all nodes of the
+// group, while updating an overlay only triggers the watches of its node.
+type GroupSnapshotCache interface {
+	Cache
+
+	// SetGroupSnapshot sets the snapshot shared by all nodes of a group.
+	SetGroupSnapshot(ctx context.Context, group string, snapshot ResourceSnapshot) error
+
+	// GetGroupSnapshot gets the snapshot of a group.
+	GetGroupSnapshot(group string) (ResourceSnapshot, error)
+
+	// ClearGroupSnapshot removes the snapshot of a group, together with the
+	// status and snapshot information of all nodes of the group.
+	ClearGroupSnapshot(group string)
+
+	// SetNodeOverlay sets the node specific resources of a node.
+	SetNodeOverlay(ctx context.Context, node string, overlay ResourceSnapshot) error
+
+	// ClearNodeOverlay removes the node specific resources of a node.
+	ClearNodeOverlay(ctx context.Context, node string) error
+
+	// GetSnapshot gets the merged snapshot served to a node.
+	GetSnapshot(node string) (ResourceSnapshot, error)
+
+	// ClearSnapshot removes the overlay, status and snapshot information associated with a node.
+	ClearSnapshot(node string)
+
+	// GetStatusInfo retrieves status information for a node ID.
+	GetStatusInfo(string) StatusInfo
+
+	// GetStatusKeys retrieves node IDs for all statuses.
+	GetStatusKeys() []string
+}
+
+type groupSnapshotCache struct {
+	// nodes holds the merged snapshot of each node and all the watch machinery.
+	nodes *snapshotCache
+
+	// group is the hashing function deriving the group of a node
+	group NodeHash
+
+	// groups are the shared snapshots indexed by group
+	groups map[string]ResourceSnapshot
+
+	// overlays are the node specific snapshots indexed by node IDs
+	overlays map[string]ResourceSnapshot
+
+	// nodeGroups is the group of each node indexed by node IDs
+	nodeGroups map[string]string
+
+	// members are the node IDs of each group
+	members map[string]map[string]struct{}
+
+	// store optionally persists the group snapshots and overlays, from which
+	// the merged snapshots of the nodes are derived again
+	store SnapshotStore
+
+	// writeMu serializes the writes to the store, so that they are persisted
+	// in order without holding mu meanwhile
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+}
+
+// Keys of the group snapshots and overlays in the store.
+const (
+	groupStorePrefix   = "group:"
+	overlayStorePrefix = "overlay:"
+)
+
+var _ GroupSnapshotCache = &groupSnapshotCache{}
+var _ ResponseTracker = &groupSnapshotCache{}
+var _ Observable = &groupSnapshotCache{}
+
+// NewGroupSnapshotCache initializes a cache sharing snapshots across groups of nodes.
+//
+// The group hash derives the group of a node, while the node hash identifies
+// individual nodes for overlays and status information. The ADS flag and
+// options have the same meaning as for NewSnapshotCache.
+//
+// With WithSnapshotStore, the group snapshots and overlays are persisted
+// rather than the merged snapshots of the nodes.
+//
+// Logger is optional.
+func NewGroupSnapshotCache(ads bool, group NodeHash, hash NodeHash, logger log.Logger, opts ...SnapshotCacheOption) GroupSnapshotCache {
+	out := &groupSnapshotCache{
+		group:      group,
+		groups:     make(map[string]ResourceSnapshot),
+		overlays:   make(map[string]ResourceSnapshot),
+		nodeGroups: make(map[string]string),
+		members:    make(map[string]map[string]struct{}),
+	}
+
+	// The store is taken over before the node cache loads from it.
+	opts = append(opts, func(nodes *snapshotCache) {
+		out.store = nodes.store
+		nodes.store = nil
+	})
+	out.nodes = newSnapshotCache(ads, hash, logger, opts...)
+
+	if out.store != nil {
+		snapshots, err := out.store.Load()
+		if err != nil {
+			out.nodes.log.Errorf("failed to load snapshots from store: %v", err)
+		}
+		for key, snapshot := range snapshots {
+			switch {
+			case strings.HasPrefix(key, groupStorePrefix):
+				out.groups[strings.TrimPrefix(key, groupStorePrefix)] = snapshot
+			case strings.HasPrefix(key, overlayStorePrefix):
+				out.overlays[strings.TrimPrefix(key, overlayStorePrefix)] = snapshot
+			}
+		}
+	}
+	return out
+}
+
+// persist writes a group snapshot or overlay through to the store, if any.
+// The write lock must be held.
+func (cache *groupSnapshotCache) persist(key string, snapshot ResourceSnapshot) error {
+	if cache.store == nil {
+		return nil
+	}
+	if err := cache.store.Store(key, snapshot); err != nil {
+		return fmt.Errorf("failed to persist snapshot %q: %w", key, err)
+	}
+	return nil
+}
+
+// forget deletes group snapshots and overlays from the store, if any. The
+// write lock must be held.
+func (cache *groupSnapshotCache) forget(keys ...string) {
+	if cache.store == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := cache.store.Delete(key); err != nil {
+			cache.nodes.log.Errorf("failed to delete snapshot %q from store: %v", key, err)
+		}
+	}
+}
+
+// SetGroupSnapshot updates the group snapshot and the merged snapshots of all its nodes.
+func (cache *groupSnapshotCache) SetGroupSnapshot(ctx context.Context, group string, snapshot ResourceSnapshot) error {
+	if err := cache.validate(snapshot); err != nil {
+		return err
+	}
+
+	cache.writeMu.Lock()
+	defer cache.writeMu.Unlock()
+	if err := cache.persist(groupStorePrefix+group, snapshot); err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.groups[group] = snapshot
+
+	var failed []string
+	for node := range cache.members[group] {
+		if err := cache.nodes.setSnapshot(ctx, node, cache.view(node)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", node, err))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to set snapshot of group %q for nodes: %s", group, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// validate checks a group snapshot or overlay if validation is enabled. Merged
+// snapshots are made of validated parts and are set without validation.
+func (cache *groupSnapshotCache) validate(snapshot ResourceSnapshot) error {
+	if !cache.nodes.validate {
+		return nil
+	}
+	return ValidateSnapshot(snapshot)
+}
+
+// GetGroupSnapshot gets the snapshot of a group, and returns an error if not found.
+func (cache *groupSnapshotCache) GetGroupSnapshot(group string) (ResourceSnapshot, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	snapshot, ok := cache.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("no snapshot found for group %s", group)
+	}
+	return snapshot, nil
+}
+
+// ClearGroupSnapshot clears the group snapshot and all its nodes.
+func (cache *groupSnapshotCache) ClearGroupSnapshot(group string) {
+	cache.writeMu.Lock()
+	defer cache.writeMu.Unlock()
+
+	cache.mu.Lock()
+	keys := []string{groupStorePrefix + group}
+	for node := range cache.members[group] {
+		keys = append(keys, overlayStorePrefix+node)
+		cache.clearNode(node)
+	}
+	delete(cache.groups, group)
+	delete(cache.members, group)
+	cache.mu.Unlock()
+
+	cache.forget(keys...)
+}
+
+// SetNodeOverlay updates the overlay of a node. The merged snapshot is only
+// updated once the group of the node is known, i.e. once it opened a watch.
+func (cache *groupSnapshotCache) SetNodeOverlay(ctx context.Context, node string, overlay ResourceSnapshot) error {
+	if err := cache.validate(overlay); err != nil {
+		return err
+	}
+
+	cache.writeMu.Lock()
+	defer cache.writeMu.Unlock()
+	if err := cache.persist(overlayStorePrefix+node, overlay); err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.overlays[node] = overlay
+	if _, ok := cache.nodeGroups[node]; !ok {
+		return nil
+	}
+	return cache.nodes.setSnapshot(ctx, node, cache.view(node))
+}
+
+// ClearNodeOverlay removes the overlay of a node, which is then served its group snapshot only.
+func (cache *groupSnapshotCache) ClearNodeOverlay(ctx context.Context, node string) error {
+	cache.writeMu.Lock()
+	defer cache.writeMu.Unlock()
+
+	cache.mu.Lock()
+	if _, ok := cache.overlays[node]; !ok {
+		cache.mu.Unlock()
+		return nil
+	}
+	delete(cache.overlays, node)
+	var err error
+	if _, ok := cache.nodeGroups[node]; ok {
+		view := cache.view(node)
+		if view == nil {
+			// Keep serving an empty snapshot rather than leaving stale resources behind.
+			view = &Snapshot{}
+		}
+		err = cache.nodes.setSnapshot(ctx, node, view)
+	}
+	cache.mu.Unlock()
+
+	cache.forget(overlayStorePrefix + node)
+	return err
+}
+
+// GetSnapshot gets the merged snapshot of a node, and returns an error if not found.
+func (cache *groupSnapshotCache) GetSnapshot(node string) (ResourceSnapshot, error) {
+	return cache.nodes.GetSnapshot(node)
+}
+
+// ClearSnapshot clears the overlay, snapshot and info for a node.
+func (cache *groupSnapshotCache) ClearSnapshot(node string) {
+	cache.writeMu.Lock()
+	defer cache.writeMu.Unlock()
+
+	cache.mu.Lock()
+	cache.clearNode(node)
+	cache.mu.Unlock()
+
+	cache.forget(overlayStorePrefix + node)
+}
+
+// clearNode must be called with the cache mutex held.
+func (cache *groupSnapshotCache) clearNode(node string) {
+	if group, ok := cache.nodeGroups[node]; ok {
+		delete(cache.members[group], node)
+		delete(cache.nodeGroups, node)
+	}
+	delete(cache.overlays, node)
+	cache.nodes.ClearSnapshot(node)
+}
+
+// join records the group of a node, and sets its merged snapshot if the node
+// is new to the group. It must be called with the cache mutex held.
+func (cache *groupSnapshotCache) join(node *core.Node) {
+	nodeID := cache.nodes.hash.ID(node)
+	group := cache.group.ID(node)
+
+	if current, ok := cache.nodeGroups[nodeID]; ok {
+		if current == group {
+			return
+		}
+		delete(cache.members[current], nodeID)
+	}
+
+	cache.nodeGroups[nodeID] = group
+	members, ok := cache.members[group]
+	if !ok {
+		members = make(map[string]struct{})
+		cache.members[group] = members
+	}
+	members[nodeID] = struct{}{}
+
+	if view := cache.view(nodeID); view != nil {
+		if err := cache.nodes.setSnapshot(context.Background(), nodeID, view); err != nil {
+			cache.nodes.log.Errorf("failed to set snapshot of group %q for node %q: %v", group, nodeID, err)
+		}
+	}
+}
+
+// view returns the merged snapshot of a node, or nil if the node has neither a group snapshot nor an overlay.
+// It must be called with the cache mutex held.
+func (cache *groupSnapshotCache) view(node string) ResourceSnapshot {
+	group := cache.groups[cache.nodeGroups[node]]
+	overlay, hasOverlay := cache.overlays[node]
+	switch {
+	case !hasOverlay:
+		// Nodes without overlay share the group snapshot as-is.
+		return group
+	case group == nil:
+		return overlay
+	default:
+		return &layeredSnapshot{
+			base:      group,
+			overlay:   overlay,
+			marshaled: newMarshalCache(getMarshalCache(overlay), getMarshalCache(group)),
+		}
+	}
+}
+
+// AddObserver registers an observer of the watches, responses and merged snapshots of the nodes.
+func (cache *groupSnapshotCache) AddObserver(observer Observer) func() {
+	return cache.nodes.AddObserver(observer)
+}
+
+// CreateWatch returns a watch for an xDS request.
+func (cache *groupSnapshotCache) CreateWatch(request *Request, state stream.StreamState, value chan Response) func() {
+	cache.mu.Lock()
+	cache.join(request.Node)
+	cache.mu.Unlock()
+
+	return cache.nodes.CreateWatch(request, state, value)
+}
+
+// CreateDeltaWatch returns a watch for a delta xDS request.
+func (cache *groupSnapshotCache) CreateDeltaWatch(request *DeltaRequest, state stream.StreamState, value chan DeltaResponse) func() {
+	cache.mu.Lock()
+	cache.join(request.Node)
+	cache.mu.Unlock()
+
+	return cache.nodes.CreateDeltaWatch(request, state, value)
+}
+
+// Fetch implements the cache fetch function.
+func (cache *groupSnapshotCache) Fetch(ctx context.Context, request *Request) (Response, error) {
+	cache.mu.Lock()
+	cache.join(request.Node)
+	cache.mu.Unlock()
+
+	return cache.nodes.Fetch(ctx, request)
+}
+
+// GetStatusInfo retrieves the status info for the node.
+func (cache *groupSnapshotCache) GetStatusInfo(node string) StatusInfo {
+	return cache.nodes.GetStatusInfo(node)
+}
+
+// GetStatusKeys retrieves all node IDs in the status map.
+func (cache *groupSnapshotCache) GetStatusKeys() []string {
+	return cache.nodes.GetStatusKeys()
+}
+
+// OnResponseSent records the last response sent to a node.
+func (cache *groupSnapshotCache) OnResponseSent(node *core.Node, typeURL, version, nonce string) {
+	cache.nodes.OnResponseSent(node, typeURL, version, nonce)
+}
+
+// OnResponseAck records whether a node accepted a response.
+func (cache *groupSnapshotCache) OnResponseAck(node *core.Node, typeURL, version, nonce string, errorDetail *rpcstatus.Status) {
+	cache.nodes.OnResponseAck(node, typeURL, version, nonce, errorDetail)
+}
+
+// layeredSnapshot merges node specific resources on top of a shared snapshot.
+// Resources are merged on every call, so that the shared snapshot is never copied per node.
+type layeredSnapshot struct {
+	base    ResourceSnapshot
+	overlay ResourceSnapshot
+
+	// marshaled reuses the resources marshaled for the layers.
+	marshaled *marshalCache
+}
+
+var _ ResourceSnapshot = &layeredSnapshot{}
+
+// GetVersion combines the versions of both layers, so that a change to either
+// of them changes the version. Versions may contain any character, so the pair
+// is hashed unambiguously.
+func (s *layeredSnapshot) GetVersion(typeURL string) string {
+	base, overlay := s.base.GetVersion(typeURL), s.overlay.GetVersion(typeURL)
+	switch {
+	case overlay == "":
+		return base
+	case base == "":
+		return overlay
+	default:
+		return HashResource([]byte(strconv.Quote(base) + strconv.Quote(overlay)))
+	}
+}
+
+func (s *layeredSnapshot) GetResourcesAndTTL(typeURL string) map[string]types.ResourceWithTTL {
+	base, overlay := s.base.GetResourcesAndTTL(typeURL), s.overlay.GetResourcesAndTTL(typeURL)
+	if len(overlay) == 0 {
+		return base
+	}
+
+	out := make(map[string]types.ResourceWithTTL, len(base)+len(overlay))
+	for name, r := range base {
+		out[name] = r
+	}
+	for name, r := range overlay {
+		out[name] = r
+	}
+	return out
+}
+
+func (s *layeredSnapshot) GetResources(typeURL string) map[string]types.Resource {
+	base, overlay := s.base.GetResources(typeURL), s.overlay.GetResources(typeURL)
+	if len(overlay) == 0 {
+		return base
+	}
+
+	out := make(map[string]types.Resource, len(base)+len(overlay))
+	for name, r := range base {
+		out[name] = r
+	}
+	for name, r := range overlay {
+		out[name] = r
+	}
+	return out
+}
+
+func (s *layeredSnapshot) ConstructVersionMap() error {
+	if err := s.base.ConstructVersionMap(); err != nil {
+		return err
+	}
+	return s.overlay.ConstructVersionMap()
+}
+
+func (s *layeredSnapshot) getMarshalCache() *marshalCache {
+	return s.marshaled
+}
+
+func (s *layeredSnapshot) GetVersionMap(typeURL string) map[string]string {
+	base, overlay := s.base.GetVersionMap(typeURL), s.overlay.GetVersionMap(typeURL)
+	if len(overlay) == 0 {
+		return base
+	}
+
+	out := make(map[string]string, len(base)+len(overlay))
+	for name, v := range base {
+		out[name] = v
+	}
+	for name, v := range overlay {
+		out[name] = v
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/test/resource/v3"
+)
+
+// clusterHash groups nodes by their cluster field.
+type clusterHash struct{}
+
+func (clusterHash) ID(node *core.Node) string {
+	return node.GetCluster()
+}
+
+func openClusterWatch(c cache.Cache, node *core.Node, version string) chan cache.Response {
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{
+		TypeUrl:     rsrc.ClusterType,
+		Node:        node,
+		VersionInfo: version,
+	}, stream.NewStreamState(false, map[string]string{}), value)
+	return value
+}
+
+func receiveClusters(t *testing.T, value chan cache.Response) (string, []string) {
+	t.Helper()
+	require.Len(t, value, 1)
+	out := <-value
+	version, err := out.GetVersion()
+	require.NoError(t, err)
+	var names []string
+	for _, r := range out.(*cache.RawResponse).Resources {
+		names = append(names, cache.GetResourceName(r.Resource))
+	}
+	return version, names
+}
+
+func TestGroupSnapshotCache(t *testing.T) {
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t})
+	nodeA := &core.Node{Id: "a", Cluster: "group"}
+	nodeB := &core.Node{Id: "b", Cluster: "group"}
+	other := &core.Node{Id: "c", Cluster: "other"}
+
+	watchA := openClusterWatch(c, nodeA, "")
+	watchB := openClusterWatch(c, nodeB, "")
+	watchOther := openClusterWatch(c, other, "")
+	assert.Empty(t, watchA)
+
+	group, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+	require.NoError(t, c.SetGroupSnapshot(context.Background(), "group", group))
+
+	// The group snapshot fans out to all nodes of the group only.
+	version, names := receiveClusters(t, watchA)
+	assert.Equal(t, "1", version)
+	assert.Equal(t, []string{clusterName}, names)
+	version, _ = receiveClusters(t, watchB)
+	assert.Equal(t, "1", version)
+	assert.Empty(t, watchOther)
+
+	snap, err := c.GetGroupSnapshot("group")
+	require.NoError(t, err)
+	assert.Equal(t, group, snap)
+
+	// An overlay only triggers the watches of its node.
+	watchA = openClusterWatch(c, nodeA, "1")
+	watchB = openClusterWatch(c, nodeB, "1")
+	overlay, err := cache.NewSnapshot("o1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {resource.MakeCluster(resource.Ads, "node-a-only")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetNodeOverlay(context.Background(), "a", overlay))
+
+	layered, names := receiveClusters(t, watchA)
+	assert.NotContains(t, []string{"1", "o1"}, layered)
+	assert.ElementsMatch(t, []string{clusterName, "node-a-only"}, names)
+	assert.Empty(t, watchB)
+
+	merged, err := c.GetSnapshot("a")
+	require.NoError(t, err)
+	assert.Len(t, merged.GetResources(rsrc.ClusterType), 2)
+
+	// Removing the overlay reverts the node to the group snapshot.
+	watchA = openClusterWatch(c, nodeA, layered)
+	require.NoError(t, c.ClearNodeOverlay(context.Background(), "a"))
+	version, names = receiveClusters(t, watchA)
+	assert.Equal(t, "1", version)
+	assert.Equal(t, []string{clusterName}, names)
+
+	// Clearing the group clears its nodes.
+	c.ClearGroupSnapshot("group")
+	_, err = c.GetSnapshot("a")
+	assert.Error(t, err)
+	assert.Nil(t, c.GetStatusInfo("b"))
+	assert.NotNil(t, c.GetStatusInfo("c"))
+}
+
+func TestGroupSnapshotCacheOverlayBeforeWatch(t *testing.T) {
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t})
+
+	overlay, err := cache.NewSnapshot("o1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+	require.NoError(t, c.SetNodeOverlay(context.Background(), "a", overlay))
+
+	// The node is not known until it opens a watch.
+	_, err = c.GetSnapshot("a")
+	assert.Error(t, err)
+
+	version, names := receiveClusters(t, openClusterWatch(c, &core.Node{Id: "a", Cluster: "group"}, ""))
+	assert.Equal(t, "o1", version)
+	assert.Equal(t, []string{clusterName}, names)
+}
+
+func TestGroupSnapshotCacheLayeredVersion(t *testing.T) {
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t})
+	node := &core.Node{Id: "a", Cluster: "group"}
+	set := func(group, overlay string) {
+		groupSnapshot, err := cache.NewSnapshot(group, map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+		require.NoError(t, err)
+		require.NoError(t, c.SetGroupSnapshot(context.Background(), "group", groupSnapshot))
+		overlaySnapshot, err := cache.NewSnapshot(overlay, map[rsrc.Type][]types.Resource{
+			rsrc.ClusterType: {resource.MakeCluster(resource.Ads, "node-a-only")},
+		})
+		require.NoError(t, err)
+		require.NoError(t, c.SetNodeOverlay(context.Background(), "a", overlaySnapshot))
+	}
+
+	// Versions containing the separator of the layers do not collide.
+	set("a/b", "c")
+	version, _ := receiveClusters(t, openClusterWatch(c, node, ""))
+	watch := openClusterWatch(c, node, version)
+	set("a", "b/c")
+	next, _ := receiveClusters(t, watch)
+	assert.NotEqual(t, version, next)
+}
+
+func TestGroupSnapshotCacheStore(t *testing.T) {
+	store, err := cache.NewFileSnapshotStore(t.TempDir())
+	require.NoError(t, err)
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t}, cache.WithSnapshotStore(store))
+	node := &core.Node{Id: "a", Cluster: "group"}
+
+	group, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+	require.NoError(t, c.SetGroupSnapshot(context.Background(), "group", group))
+	overlay, err := cache.NewSnapshot("o1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {resource.MakeCluster(resource.Ads, "node-a-only")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetNodeOverlay(context.Background(), "a", overlay))
+	version, _ := receiveClusters(t, openClusterWatch(c, node, ""))
+
+	// Only the group snapshot and the overlay are persisted, not the merged snapshot.
+	stored, err := store.Load()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+
+	// The merged snapshot is derived again once the node reconnects.
+	restarted := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t}, cache.WithSnapshotStore(store))
+	assert.Empty(t, openClusterWatch(restarted, node, version))
+	_, names := receiveClusters(t, openClusterWatch(restarted, node, ""))
+	assert.ElementsMatch(t, []string{clusterName, "node-a-only"}, names)
+
+	restarted.ClearGroupSnapshot("group")
+	stored, err = store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+// blockingDeleteStore blocks deletions until deleted is closed.
+type blockingDeleteStore struct {
+	deleting chan struct{}
+	deleted  chan struct{}
+}
+
+func (blockingDeleteStore) Store(string, cache.ResourceSnapshot) error { return nil }
+func (s blockingDeleteStore) Delete(string) error {
+	s.deleting <- struct{}{}
+	<-s.deleted
+	return nil
+}
+func (blockingDeleteStore) Load() (map[string]cache.ResourceSnapshot, error) {
+	return nil, nil
+}
+
+func TestGroupSnapshotCacheClearOverlayDoesNotBlockWatches(t *testing.T) {
+	store := blockingDeleteStore{deleting: make(chan struct{}, 1), deleted: make(chan struct{})}
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t}, cache.WithSnapshotStore(store))
+	group, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}})
+	require.NoError(t, err)
+	require.NoError(t, c.SetGroupSnapshot(context.Background(), "group", group))
+	overlay, err := cache.NewSnapshot("o1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {resource.MakeCluster(resource.Ads, "node-a-only")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetNodeOverlay(context.Background(), "a", overlay))
+	receiveClusters(t, openClusterWatch(c, &core.Node{Id: "a", Cluster: "group"}, ""))
+
+	done := make(chan error, 1)
+	go func() { done <- c.ClearNodeOverlay(context.Background(), "a") }()
+	<-store.deleting
+
+	// Watches are opened and responded while the overlay is deleted from the store.
+	_, names := receiveClusters(t, openClusterWatch(c, &core.Node{Id: "b", Cluster: "group"}, ""))
+	assert.Equal(t, []string{clusterName}, names)
+	close(store.deleted)
+	require.NoError(t, <-done)
+}
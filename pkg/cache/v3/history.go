@@ -0,0 +1,161 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SnapshotMetadata describes why a snapshot was set, and by whom.
+type SnapshotMetadata struct {
+	Author string
+	Reason string
+}
+
+// SnapshotRecord is a snapshot set for a node, as retained in its history.
+type SnapshotRecord struct {
+	// ID identifies the record among the history of the node.
+	ID int64
+
+	Snapshot ResourceSnapshot
+	Time     time.Time
+	Metadata SnapshotMetadata
+}
+
+type snapshotMetadataKey struct{}
+
+// ContextWithSnapshotMetadata returns a context attaching metadata to the
+// snapshots set with it, as recorded in the snapshot history.
+func ContextWithSnapshotMetadata(ctx context.Context, metadata SnapshotMetadata) context.Context {
+	return context.WithValue(ctx, snapshotMetadataKey{}, metadata)
+}
+
+func snapshotMetadataFromContext(ctx context.Context) (SnapshotMetadata, bool) {
+	metadata, ok := ctx.Value(snapshotMetadataKey{}).(SnapshotMetadata)
+	return metadata, ok
+}
+
+// WithSnapshotHistory retains the last snapshots set for each node, up to the
+// given size, so that they can be listed and restored.
+func WithSnapshotHistory(size int) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.historySize = size
+	}
+}
+
+// SnapshotHistory is implemented by snapshot caches retaining the previous
+// snapshots of the nodes.
+type SnapshotHistory interface {
+	// GetSnapshotHistory lists the snapshots retained for a node with
+	// WithSnapshotHistory, oldest first.
+	GetSnapshotHistory(node string) []SnapshotRecord
+
+	// RestoreSnapshot sets a snapshot of the history of a node again, under
+	// fresh versions.
+	RestoreSnapshot(ctx context.Context, node string, id int64) error
+}
+
+// snapshotHistory is the bounded list of snapshots of a node, oldest first.
+type snapshotHistory struct {
+	records []SnapshotRecord
+	lastID  int64
+}
+
+// record appends a snapshot to the history of a node. The shard must be locked.
+func (cache *snapshotCache) record(shard *nodeShard, node string, snapshot ResourceSnapshot, metadata SnapshotMetadata) {
+	history, ok := shard.history[node]
+	if !ok {
+		history = &snapshotHistory{}
+		shard.history[node] = history
+	}
+
+	history.lastID++
+	history.records = append(history.records, SnapshotRecord{
+		ID:       history.lastID,
+		Snapshot: snapshot,
+		Time:     time.Now(),
+		Metadata: metadata,
+	})
+	if extra := len(history.records) - cache.historySize; extra > 0 {
+		history.records = append([]SnapshotRecord(nil), history.records[extra:]...)
+	}
+}
+
+// GetSnapshotHistory returns the snapshots retained for a node, oldest first.
+func (cache *snapshotCache) GetSnapshotHistory(node string) []SnapshotRecord {
+	shard := cache.shard(node)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	history, ok := shard.history[node]
+	if !ok {
+		return nil
+	}
+	return append([]SnapshotRecord(nil), history.records...)
+}
+
+// RestoreSnapshot sets the snapshot of a node back to a snapshot of its history.
+// The versions of the restored snapshot are made unique, so that clients which
+// applied a later snapshot accept it.
+func (cache *snapshotCache) RestoreSnapshot(ctx context.Context, node string, id int64) error {
+	shard := cache.shard(node)
+	shard.mu.RLock()
+	var restored ResourceSnapshot
+	var nextID int64
+	if history, ok := shard.history[node]; ok {
+		for _, record := range history.records {
+			if record.ID == id {
+				restored = record.Snapshot
+			}
+		}
+		nextID = history.lastID + 1
+	}
+	shard.mu.RUnlock()
+
+	if restored == nil {
+		return fmt.Errorf("no snapshot %d in the history of node %q", id, node)
+	}
+	if previous, ok := restored.(*restoredSnapshot); ok {
+		restored = previous.ResourceSnapshot
+	}
+
+	if _, ok := snapshotMetadataFromContext(ctx); !ok {
+		ctx = ContextWithSnapshotMetadata(ctx, SnapshotMetadata{Reason: fmt.Sprintf("restore of snapshot %d", id)})
+	}
+	return cache.setSnapshot(ctx, node, &restoredSnapshot{
+		ResourceSnapshot: restored,
+		suffix:           fmt.Sprintf("-restore-%d", nextID),
+	})
+}
+
+// restoredSnapshot serves a snapshot under fresh versions.
+type restoredSnapshot struct {
+	ResourceSnapshot
+	suffix string
+}
+
+func (s *restoredSnapshot) GetVersion(typeURL string) string {
+	version := s.ResourceSnapshot.GetVersion(typeURL)
+	if version == "" {
+		return ""
+	}
+	return version + s.suffix
+}
+
+func (s *restoredSnapshot) getMarshalCache() *marshalCache {
+	return getMarshalCache(s.ResourceSnapshot)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithSnapshotHistory(2))
+
+	for _, version := range []string{"1", "2", "3"} {
+		ctx := cache.ContextWithSnapshotMetadata(context.Background(), cache.SnapshotMetadata{Author: "alice", Reason: "release " + version})
+		require.NoError(t, c.SetSnapshot(ctx, key, clusterSnapshot(t, version)))
+	}
+
+	// Only the last snapshots are retained.
+	history := c.(cache.SnapshotHistory).GetSnapshotHistory(key)
+	require.Len(t, history, 2)
+	assert.Equal(t, int64(2), history[0].ID)
+	assert.Equal(t, "2", history[0].Snapshot.GetVersion(rsrc.ClusterType))
+	assert.Equal(t, cache.SnapshotMetadata{Author: "alice", Reason: "release 2"}, history[0].Metadata)
+	assert.False(t, history[0].Time.IsZero())
+	assert.Equal(t, int64(3), history[1].ID)
+
+	assert.Empty(t, c.(cache.SnapshotHistory).GetSnapshotHistory("other"))
+
+	// History is only retained on demand.
+	c = cache.NewSnapshotCache(false, group{}, logger{t: t})
+	require.NoError(t, c.SetSnapshot(context.Background(), key, clusterSnapshot(t, "1")))
+	assert.Empty(t, c.(cache.SnapshotHistory).GetSnapshotHistory(key))
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithSnapshotHistory(10))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, clusterSnapshot(t, "1")))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, clusterSnapshot(t, "2")))
+
+	watch := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, VersionInfo: "2"},
+		stream.NewStreamState(false, map[string]string{}), watch)
+
+	// The restored snapshot is pushed under a fresh version.
+	require.NoError(t, c.(cache.SnapshotHistory).RestoreSnapshot(context.Background(), key, 1))
+	require.Len(t, watch, 1)
+	version, err := (<-watch).GetVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "1-restore-3", version)
+
+	history := c.(cache.SnapshotHistory).GetSnapshotHistory(key)
+	require.Len(t, history, 3)
+	assert.Equal(t, "restore of snapshot 1", history[2].Metadata.Reason)
+
+	// Restoring a restore does not stack versions.
+	require.NoError(t, c.(cache.SnapshotHistory).RestoreSnapshot(context.Background(), key, 3))
+	snapshot, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Equal(t, "1-restore-4", snapshot.GetVersion(rsrc.ClusterType))
+	assert.Equal(t, "", snapshot.GetVersion(rsrc.EndpointType))
+
+	assert.Error(t, c.(cache.SnapshotHistory).RestoreSnapshot(context.Background(), key, 42))
+}
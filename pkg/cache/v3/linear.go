@@ -17,18 +17,28 @@ package cache
 import (
 	"context"
 	"errors"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/log"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
 type watches = map[chan Response]struct{}
 
+// linearWatch is an open SotW watch of a LinearCache, with the event
+// reporting its opening.
+type linearWatch struct {
+	request *Request
+	event   Event
+}
+
 // LinearCache supports collections of opaque resources. This cache has a
 // single collection indexed by resource names and manages resource versions
 // internally. It implements the cache interface for a single type URL and
@@ -42,6 +52,8 @@ type LinearCache struct {
 	// Watches open by clients, indexed by resource name. Whenever resources
 	// are changed, the watch is triggered.
 	watches map[string]watches
+	// Glob collections with open watches, indexed by canonical name.
+	globs map[string]*resource.XdstpName
 	// Set of watches for all resources in the collection
 	watchAll watches
 	// Set of delta watches. A delta watch always contain the list of subscribed resources
@@ -59,6 +71,27 @@ type LinearCache struct {
 	versionPrefix string
 	// Versions for each resource by name.
 	versionVector map[string]uint64
+	// TTLs of the resources which have one, indexed by name.
+	ttls map[string]*time.Duration
+	// Interval between heartbeat responses for resources with a TTL. Zero disables heartbeating.
+	heartbeatInterval time.Duration
+	// Context cancelling the heartbeating routine.
+	heartbeatCtx context.Context
+	// Run protoc-gen-validate checks on updated resources.
+	validate bool
+	// Marshaled resources shared by all responses until the resources change.
+	marshaled *marshalCache
+	// Resource names indexed by the aliases they are requested by on demand, and the reverse index.
+	aliases         map[string]string
+	resourceAliases map[string][]string
+	// Reply explicitly to the delta subscriptions of missing resources.
+	onDemand bool
+	// Requests and opening events of the watches still open, indexed by response channel.
+	openWatches map[chan Response]linearWatch
+	// Continuously incremented counter used to identify watches for observers.
+	watchCount int64
+	// Observers notified of the events of the cache.
+	observers observers
 
 	log log.Logger
 
@@ -66,6 +99,7 @@ type LinearCache struct {
 }
 
 var _ Cache = &LinearCache{}
+var _ Observable = &LinearCache{}
 
 // Options for modifying the behavior of the linear cache.
 type LinearCacheOption func(*LinearCache)
@@ -89,6 +123,46 @@ func WithInitialResources(resources map[string]types.Resource) LinearCacheOption
 	}
 }
 
+// WithInitialResourcesByType initializes the initial set of resources of the
+// caches of each type URL, e.g. of a MultiTypeLinearCache. A LinearCache takes
+// the resources of its type.
+func WithInitialResourcesByType(resources map[resource.Type]map[string]types.Resource) LinearCacheOption {
+	return func(cache *LinearCache) {
+		if typed, ok := resources[cache.typeURL]; ok {
+			WithInitialResources(typed)(cache)
+		}
+	}
+}
+
+// WithHeartbeating sends periodic heartbeat responses for resources with a TTL,
+// allowing clients to refresh the TTL of resources which did not change.
+// The context provides a way to cancel the heartbeating routine, while the
+// interval controls how often heartbeating occurs.
+func WithHeartbeating(ctx context.Context, interval time.Duration) LinearCacheOption {
+	return func(cache *LinearCache) {
+		cache.heartbeatCtx = ctx
+		cache.heartbeatInterval = interval
+	}
+}
+
+// WithResourceValidation runs the protoc-gen-validate rules of every updated
+// resource. An update containing invalid resources is rejected with
+// ValidationErrors listing all of them, and the cache is left untouched.
+func WithResourceValidation() LinearCacheOption {
+	return func(cache *LinearCache) {
+		cache.validate = true
+	}
+}
+
+// WithOnDemand replies explicitly to delta subscriptions naming missing
+// resources, as expected by on-demand discovery: VHDS aliases are replied
+// without a resource, and other names as removed.
+func WithOnDemand() LinearCacheOption {
+	return func(cache *LinearCache) {
+		cache.onDemand = true
+	}
+}
+
 func WithLogger(log log.Logger) LinearCacheOption {
 	return func(cache *LinearCache) {
 		cache.log = log
@@ -101,32 +175,125 @@ func NewLinearCache(typeURL string, opts ...LinearCacheOption) *LinearCache {
 		typeURL:       typeURL,
 		resources:     make(map[string]types.Resource),
 		watches:       make(map[string]watches),
+		globs:         make(map[string]*resource.XdstpName),
 		watchAll:      make(watches),
 		deltaWatches:  make(map[int64]DeltaResponseWatch),
+		openWatches:   make(map[chan Response]linearWatch),
 		versionMap:    nil,
 		version:       0,
 		versionVector: make(map[string]uint64),
+		ttls:          make(map[string]*time.Duration),
+		marshaled:     newMarshalCache(),
 	}
 	for _, opt := range opts {
 		opt(out)
 	}
+	out.aliases = make(map[string]string)
+	out.resourceAliases = make(map[string][]string)
+	for name, res := range out.resources {
+		if aliases := GetResourceAliases(res); len(aliases) > 0 {
+			out.resourceAliases[name] = aliases
+			for _, alias := range aliases {
+				out.aliases[alias] = name
+			}
+		}
+	}
+	if out.heartbeatInterval > 0 {
+		go out.heartbeat()
+	}
 	return out
 }
 
-func (cache *LinearCache) respond(value chan Response, staleResources []string) {
+func (cache *LinearCache) heartbeat() {
+	t := time.NewTicker(cache.heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			cache.sendHeartbeats()
+		case <-cache.heartbeatCtx.Done():
+			return
+		}
+	}
+}
+
+// sendHeartbeats responds to the open watches subscribed to resources with a TTL,
+// with the current version of these resources.
+func (cache *LinearCache) sendHeartbeats() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.ttls) == 0 {
+		return
+	}
+
+	notifyList := make(map[chan Response][]string)
+	for name := range cache.ttls {
+		for watch := range cache.watches[name] {
+			notifyList[watch] = append(notifyList[watch], name)
+		}
+	}
+	for value, names := range notifyList {
+		cache.respondHeartbeat(value, names)
+		// The watch must be deleted and we must rely on the client to ack this response to create a new watch.
+		for name, set := range cache.watches {
+			delete(set, value)
+			if len(set) == 0 {
+				cache.deleteWatches(name)
+			}
+		}
+	}
+
+	if len(cache.watchAll) > 0 {
+		names := make([]string, 0, len(cache.ttls))
+		for name := range cache.ttls {
+			names = append(names, name)
+		}
+		for value := range cache.watchAll {
+			cache.respondHeartbeat(value, names)
+		}
+		cache.watchAll = make(watches)
+	}
+}
+
+// respondHeartbeat responds to an open watch with the resources of the given
+// names, on behalf of the request of the watch.
+func (cache *LinearCache) respondHeartbeat(value chan Response, names []string) {
+	watch := cache.openWatches[value]
+	resources := make([]types.ResourceWithTTL, 0, len(names))
+	for _, name := range names {
+		resources = append(resources, types.ResourceWithTTL{Resource: cache.resources[name], TTL: cache.ttls[name]})
+	}
+	if cache.log != nil {
+		cache.log.Debugf("[linear cache] respond open watch with heartbeat for %v version %q", names, cache.getVersion())
+	}
+	value <- &RawResponse{
+		Request:   watch.request,
+		Resources: resources,
+		Version:   cache.getVersion(),
+		Heartbeat: true,
+		Ctx:       context.Background(),
+		marshaler: cache.marshaled,
+	}
+	cache.responded(watch.event.Node, value, resources)
+}
+
+// respond sends the stale resources to a watch, or all resources if staleResources is nil.
+func (cache *LinearCache) respond(node string, value chan Response, staleResources []string) {
 	var resources []types.ResourceWithTTL
 	// TODO: optimize the resources slice creations across different clients
-	if len(staleResources) == 0 {
+	if staleResources == nil {
 		resources = make([]types.ResourceWithTTL, 0, len(cache.resources))
-		for _, resource := range cache.resources {
-			resources = append(resources, types.ResourceWithTTL{Resource: resource})
+		for name, resource := range cache.resources {
+			resources = append(resources, types.ResourceWithTTL{Resource: resource, TTL: cache.ttls[name]})
 		}
 	} else {
 		resources = make([]types.ResourceWithTTL, 0, len(staleResources))
 		for _, name := range staleResources {
 			resource := cache.resources[name]
 			if resource != nil {
-				resources = append(resources, types.ResourceWithTTL{Resource: resource})
+				resources = append(resources, types.ResourceWithTTL{Resource: resource, TTL: cache.ttls[name]})
 			}
 		}
 	}
@@ -135,7 +302,62 @@ func (cache *LinearCache) respond(value chan Response, staleResources []string)
 		Resources: resources,
 		Version:   cache.getVersion(),
 		Ctx:       context.Background(),
+		marshaler: cache.marshaled,
+	}
+	cache.responded(node, value, resources)
+}
+
+// responded reports a response to the observers, along with the closure of
+// the watch if it was open.
+func (cache *LinearCache) responded(node string, value chan Response, resources []types.ResourceWithTTL) {
+	if cache.observers.active() {
+		cache.observers.publish(Event{
+			Kind:          ResponseSent,
+			Node:          node,
+			TypeURL:       cache.typeURL,
+			Version:       cache.getVersion(),
+			ResourceNames: sentNames(resources),
+		})
+	}
+	cache.closeWatch(value)
+}
+
+// openWatch reports a watch left open to the observers.
+func (cache *LinearCache) openWatch(request *Request, value chan Response) {
+	cache.watchCount++
+	event := Event{
+		Kind:          WatchOpened,
+		Node:          request.GetNode().GetId(),
+		TypeURL:       cache.typeURL,
+		WatchID:       cache.watchCount,
+		Version:       request.VersionInfo,
+		ResourceNames: request.ResourceNames,
+	}
+	cache.openWatches[value] = linearWatch{request: request, event: event}
+	cache.observers.publish(event)
+}
+
+// closeWatch reports an open watch as closed to the observers.
+func (cache *LinearCache) closeWatch(value chan Response) {
+	watch, ok := cache.openWatches[value]
+	if !ok {
+		return
 	}
+	delete(cache.openWatches, value)
+	cache.observers.publish(Event{Kind: WatchClosed, Node: watch.event.Node, TypeURL: watch.event.TypeURL, WatchID: watch.event.WatchID})
+}
+
+// publishUpdate reports updated and removed resources to the observers.
+func (cache *LinearCache) publishUpdate(updated, removed []string) {
+	sort.Strings(updated)
+	sort.Strings(removed)
+	cache.observers.publish(Event{
+		Kind:             ResourcesUpdated,
+		TypeURL:          cache.typeURL,
+		Version:          cache.getVersion(),
+		ResourceNames:    updated,
+		RemovedResources: removed,
+	})
 }
 
 func (cache *LinearCache) notifyAll(modified map[string]struct{}) {
@@ -147,14 +369,36 @@ func (cache *LinearCache) notifyAll(modified map[string]struct{}) {
 		}
 		delete(cache.watches, name)
 	}
+	for key, glob := range cache.globs {
+		var members []string
+		for name := range modified {
+			if inCollection(name, glob) {
+				members = append(members, name)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		for watch := range cache.watches[key] {
+			for _, name := range members {
+				if !contains(notifyList[watch], name) {
+					notifyList[watch] = append(notifyList[watch], name)
+				}
+			}
+		}
+		cache.deleteWatches(key)
+	}
 	for value, stale := range notifyList {
-		cache.respond(value, stale)
+		cache.respond(cache.openWatches[value].event.Node, value, stale)
 	}
 	for value := range cache.watchAll {
-		cache.respond(value, nil)
+		cache.respond(cache.openWatches[value].event.Node, value, nil)
 	}
 	cache.watchAll = make(watches)
 
+	// Subscriptions to the aliases of the modified resources are triggered as well.
+	triggers := cache.updateAliases(modified)
+
 	// Building the version map has a very high cost when using SetResources to do full updates.
 	// As it is only used with delta watches, it is only maintained when applicable.
 	if cache.versionMap != nil {
@@ -164,16 +408,50 @@ func (cache *LinearCache) notifyAll(modified map[string]struct{}) {
 		}
 
 		for id, watch := range cache.deltaWatches {
-			if !watch.StreamState.WatchesResources(modified) {
+			if !watch.StreamState.WatchesResources(triggers) {
 				continue
 			}
 
 			res := cache.respondDelta(watch.Request, watch.Response, watch.StreamState)
 			if res != nil {
 				delete(cache.deltaWatches, id)
+				cache.observers.publish(Event{Kind: WatchClosed, Node: watch.Request.GetNode().GetId(), TypeURL: cache.typeURL, WatchID: id, Delta: true})
+			}
+		}
+	}
+}
+
+// updateAliases indexes the aliases of the modified resources, and returns the
+// modified resources along with their previous and current aliases.
+func (cache *LinearCache) updateAliases(modified map[string]struct{}) map[string]struct{} {
+	triggers := modified
+	for name := range modified {
+		previous := cache.resourceAliases[name]
+		current := GetResourceAliases(cache.resources[name])
+		if len(previous) == 0 && len(current) == 0 {
+			continue
+		}
+		if len(triggers) == len(modified) {
+			triggers = make(map[string]struct{}, len(modified))
+			for n := range modified {
+				triggers[n] = struct{}{}
 			}
 		}
+		for _, alias := range previous {
+			delete(cache.aliases, alias)
+			triggers[alias] = struct{}{}
+		}
+		for _, alias := range current {
+			cache.aliases[alias] = name
+			triggers[alias] = struct{}{}
+		}
+		if len(current) == 0 {
+			delete(cache.resourceAliases, name)
+		} else {
+			cache.resourceAliases[name] = current
+		}
 	}
+	return triggers
 }
 
 func (cache *LinearCache) respondDelta(request *DeltaRequest, value chan DeltaResponse, state stream.StreamState) *RawDeltaResponse {
@@ -181,31 +459,61 @@ func (cache *LinearCache) respondDelta(request *DeltaRequest, value chan DeltaRe
 		resourceMap:   cache.resources,
 		versionMap:    cache.versionMap,
 		systemVersion: cache.getVersion(),
+		marshaler:     cache.marshaled,
+		aliases:       cache.aliases,
+		onDemand:      cache.onDemand,
 	})
 
 	// Only send a response if there were changes
-	if len(resp.Resources) > 0 || len(resp.RemovedResources) > 0 {
+	if len(resp.Resources) > 0 || len(resp.RemovedResources) > 0 || len(resp.NotFound) > 0 {
 		if cache.log != nil {
 			cache.log.Debugf("[linear cache] node: %s, sending delta response for typeURL %s with resources: %v removed resources: %v with wildcard: %t",
 				request.GetNode().GetId(), request.TypeUrl, GetResourceNames(resp.Resources), resp.RemovedResources, state.IsWildcard())
 		}
 		value <- resp
+		if cache.observers.active() {
+			cache.observers.publish(Event{
+				Kind:             ResponseSent,
+				Node:             request.GetNode().GetId(),
+				TypeURL:          cache.typeURL,
+				Delta:            true,
+				Version:          resp.SystemVersionInfo,
+				ResourceNames:    GetResourceNames(resp.Resources),
+				RemovedResources: resp.RemovedResources,
+			})
+		}
 		return resp
 	}
 	return nil
 }
 
+// AddObserver registers an observer of the watches, responses and resource updates of the cache.
+func (cache *LinearCache) AddObserver(observer Observer) func() {
+	return cache.observers.add(observer)
+}
+
 // UpdateResource updates a resource in the collection.
 func (cache *LinearCache) UpdateResource(name string, res types.Resource) error {
-	if res == nil {
+	return cache.UpdateResourceWithTTL(name, types.ResourceWithTTL{Resource: res})
+}
+
+// UpdateResourceWithTTL updates a resource in the collection, together with its optional TTL.
+func (cache *LinearCache) UpdateResourceWithTTL(name string, res types.ResourceWithTTL) error {
+	if res.Resource == nil {
 		return errors.New("nil resource")
 	}
+	if err := cache.validateResources(map[string]types.ResourceWithTTL{name: res}); err != nil {
+		return err
+	}
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
 	cache.version++
 	cache.versionVector[name] = cache.version
-	cache.resources[name] = res
+	cache.resources[name] = res.Resource
+	cache.setTTL(name, res.TTL)
+	cache.marshaled.forget(cache.typeURL, name)
+	cache.publishUpdate([]string{name}, nil)
 
 	// TODO: batch watch closures to prevent rapid updates
 	cache.notifyAll(map[string]struct{}{name: {}})
@@ -221,6 +529,9 @@ func (cache *LinearCache) DeleteResource(name string) error {
 	cache.version++
 	delete(cache.versionVector, name)
 	delete(cache.resources, name)
+	delete(cache.ttls, name)
+	cache.marshaled.forget(cache.typeURL, name)
+	cache.publishUpdate(nil, []string{name})
 
 	// TODO: batch watch closures to prevent rapid updates
 	cache.notifyAll(map[string]struct{}{name: {}})
@@ -231,6 +542,32 @@ func (cache *LinearCache) DeleteResource(name string) error {
 // Calling UpdateResources instead of iterating on UpdateResource and DeleteResource
 // is significantly more efficient when using delta or wildcard watches.
 func (cache *LinearCache) UpdateResources(toUpdate map[string]types.Resource, toDelete []string) error {
+	if cache.validate {
+		if err := validateResources(cache.typeURL, toUpdate).err(); err != nil {
+			return err
+		}
+	}
+	return cache.updateResources(toUpdate, toDelete)
+}
+
+// updateResources updates/deletes a list of resources without validating them.
+func (cache *LinearCache) updateResources(toUpdate map[string]types.Resource, toDelete []string) error {
+	withTTL := make(map[string]types.ResourceWithTTL, len(toUpdate))
+	for name, resource := range toUpdate {
+		withTTL[name] = types.ResourceWithTTL{Resource: resource}
+	}
+	return cache.updateResourcesWithTTL(withTTL, toDelete)
+}
+
+// UpdateResourcesWithTTL updates/deletes a list of resources in the cache, together with their optional TTL.
+func (cache *LinearCache) UpdateResourcesWithTTL(toUpdate map[string]types.ResourceWithTTL, toDelete []string) error {
+	if err := cache.validateResources(toUpdate); err != nil {
+		return err
+	}
+	return cache.updateResourcesWithTTL(toUpdate, toDelete)
+}
+
+func (cache *LinearCache) updateResourcesWithTTL(toUpdate map[string]types.ResourceWithTTL, toDelete []string) error {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
@@ -239,15 +576,27 @@ func (cache *LinearCache) UpdateResources(toUpdate map[string]types.Resource, to
 	modified := make(map[string]struct{}, len(toUpdate)+len(toDelete))
 	for name, resource := range toUpdate {
 		cache.versionVector[name] = cache.version
-		cache.resources[name] = resource
+		cache.resources[name] = resource.Resource
+		cache.setTTL(name, resource.TTL)
+		cache.marshaled.forget(cache.typeURL, name)
 		modified[name] = struct{}{}
 	}
 	for _, name := range toDelete {
 		delete(cache.versionVector, name)
 		delete(cache.resources, name)
+		delete(cache.ttls, name)
+		cache.marshaled.forget(cache.typeURL, name)
 		modified[name] = struct{}{}
 	}
 
+	if cache.observers.active() {
+		updated := make([]string, 0, len(toUpdate))
+		for name := range toUpdate {
+			updated = append(updated, name)
+		}
+		cache.publishUpdate(updated, append([]string(nil), toDelete...))
+	}
+
 	cache.notifyAll(modified)
 
 	return nil
@@ -256,6 +605,7 @@ func (cache *LinearCache) UpdateResources(toUpdate map[string]types.Resource, to
 // SetResources replaces current resources with a new set of resources.
 // This function is useful for wildcard xDS subscriptions.
 // This way watches that are subscribed to all resources are triggered only once regardless of how many resources are changed.
+// The resources are not validated, even with WithResourceValidation; use ValidateAndSetResources to check them.
 func (cache *LinearCache) SetResources(resources map[string]types.Resource) {
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
@@ -272,10 +622,24 @@ func (cache *LinearCache) SetResources(resources map[string]types.Resource) {
 	}
 
 	cache.resources = resources
+	cache.ttls = make(map[string]*time.Duration)
+	cache.marshaled = newMarshalCache()
 
 	// Collect changed resource names.
 	// We assume all resources passed to SetResources are changed.
 	// Otherwise we would have to do proto.Equal on resources which is pretty expensive operation
+	if cache.observers.active() {
+		removed := make([]string, 0, len(modified))
+		for name := range modified {
+			removed = append(removed, name)
+		}
+		updated := make([]string, 0, len(resources))
+		for name := range resources {
+			updated = append(updated, name)
+		}
+		cache.publishUpdate(updated, removed)
+	}
+
 	for name := range resources {
 		cache.versionVector[name] = cache.version
 		modified[name] = struct{}{}
@@ -284,6 +648,17 @@ func (cache *LinearCache) SetResources(resources map[string]types.Resource) {
 	cache.notifyAll(modified)
 }
 
+// ValidateAndSetResources replaces current resources with a new set of resources
+// after running their protoc-gen-validate rules. A set containing invalid resources
+// is rejected with ValidationErrors listing all of them, and the cache is left untouched.
+func (cache *LinearCache) ValidateAndSetResources(resources map[string]types.Resource) error {
+	if err := validateResources(cache.typeURL, resources).err(); err != nil {
+		return err
+	}
+	cache.SetResources(resources)
+	return nil
+}
+
 // GetResources returns current resources stored in the cache
 func (cache *LinearCache) GetResources() map[string]types.Resource {
 	cache.mu.RLock()
@@ -307,7 +682,7 @@ func (cache *LinearCache) CreateWatch(request *Request, streamState stream.Strea
 	// been updated between the last version and the current version. This avoids the problem
 	// of sending empty updates whenever an irrelevant resource changes.
 	stale := false
-	staleResources := []string{} // empty means all
+	var staleResources []string // nil means all
 
 	// strip version prefix if it is present
 	var lastVersion uint64
@@ -321,13 +696,20 @@ func (cache *LinearCache) CreateWatch(request *Request, streamState stream.Strea
 	cache.mu.Lock()
 	defer cache.mu.Unlock()
 
+	// Requested xdstp:// names are canonicalized, and glob collections expanded.
+	names, keys := cache.resolveNames(request.ResourceNames)
+
 	if err != nil {
 		stale = true
-		staleResources = request.ResourceNames
+		// Requested names resolving to no resource, e.g. an empty glob
+		// collection, are responded empty rather than as a wildcard.
+		if len(request.ResourceNames) != 0 {
+			staleResources = names
+		}
 	} else if len(request.ResourceNames) == 0 {
 		stale = lastVersion != cache.version
 	} else {
-		for _, name := range request.ResourceNames {
+		for _, name := range names {
 			// When a resource is removed, its version defaults 0 and it is not considered stale.
 			if lastVersion < cache.versionVector[name] {
 				stale = true
@@ -336,39 +718,82 @@ func (cache *LinearCache) CreateWatch(request *Request, streamState stream.Strea
 		}
 	}
 	if stale {
-		cache.respond(value, staleResources)
+		cache.respond(request.GetNode().GetId(), value, staleResources)
 		return nil
 	}
 	// Create open watches since versions are up to date.
+	cache.openWatch(request, value)
 	if len(request.ResourceNames) == 0 {
 		cache.watchAll[value] = struct{}{}
 		return func() {
 			cache.mu.Lock()
 			defer cache.mu.Unlock()
 			delete(cache.watchAll, value)
+			cache.closeWatch(value)
 		}
 	}
-	for _, name := range request.ResourceNames {
-		set, exists := cache.watches[name]
+	for _, key := range keys {
+		set, exists := cache.watches[key]
 		if !exists {
 			set = make(watches)
-			cache.watches[name] = set
+			cache.watches[key] = set
 		}
 		set[value] = struct{}{}
 	}
 	return func() {
 		cache.mu.Lock()
 		defer cache.mu.Unlock()
-		for _, name := range request.ResourceNames {
-			set, exists := cache.watches[name]
+		for _, key := range keys {
+			set, exists := cache.watches[key]
 			if exists {
 				delete(set, value)
 			}
 			if len(set) == 0 {
-				delete(cache.watches, name)
+				cache.deleteWatches(key)
+			}
+		}
+		cache.closeWatch(value)
+	}
+}
+
+// resolveNames returns the resources matching the requested names, and the
+// names to watch. xdstp:// names are canonicalized, and glob collections are
+// watched as such and expanded to their current resources.
+func (cache *LinearCache) resolveNames(requested []string) ([]string, []string) {
+	names := make([]string, 0, len(requested))
+	keys := make([]string, 0, len(requested))
+	for _, name := range requested {
+		if !resource.IsXdstpName(name) {
+			names = append(names, name)
+			keys = append(keys, name)
+			continue
+		}
+		parsed, err := resource.ParseXdstpName(name)
+		if err != nil {
+			names = append(names, name)
+			keys = append(keys, name)
+			continue
+		}
+		key := parsed.String()
+		keys = append(keys, key)
+		if !parsed.IsGlob() {
+			names = append(names, key)
+			continue
+		}
+		cache.globs[key] = parsed
+		for resourceName := range cache.resources {
+			if inCollection(resourceName, parsed) {
+				names = append(names, resourceName)
 			}
 		}
 	}
+	return names, keys
+}
+
+// deleteWatches drops the watches of a resource name or glob collection.
+func (cache *LinearCache) deleteWatches(key string) {
+	delete(cache.watches, key)
+	delete(cache.globs, key)
 }
 
 func (cache *LinearCache) CreateDeltaWatch(request *DeltaRequest, state stream.StreamState, value chan DeltaResponse) func() {
@@ -400,6 +825,17 @@ func (cache *LinearCache) CreateDeltaWatch(request *DeltaRequest, state stream.S
 		}
 
 		cache.deltaWatches[watchID] = DeltaResponseWatch{Request: request, Response: value, StreamState: state}
+		if cache.observers.active() {
+			cache.observers.publish(Event{
+				Kind:          WatchOpened,
+				Node:          request.GetNode().GetId(),
+				TypeURL:       cache.typeURL,
+				WatchID:       watchID,
+				Delta:         true,
+				Version:       cache.getVersion(),
+				ResourceNames: sortedNames(state.GetSubscribedResourceNames()),
+			})
+		}
 
 		return cache.cancelDeltaWatch(watchID)
 	}
@@ -419,11 +855,11 @@ func (cache *LinearCache) updateVersionMap(modified map[string]struct{}) error {
 			continue
 		}
 		// hash our version in here and build the version map
-		marshaledResource, err := MarshalResource(r)
+		marshaledResource, err := cache.marshaled.marshal(cache.typeURL, r)
 		if err != nil {
 			return err
 		}
-		v := HashResource(marshaledResource)
+		v := marshaledResource.version()
 		if v == "" {
 			return errors.New("failed to build resource version")
 		}
@@ -433,6 +869,27 @@ func (cache *LinearCache) updateVersionMap(modified map[string]struct{}) error {
 	return nil
 }
 
+// validateResources checks updated resources if validation is enabled.
+func (cache *LinearCache) validateResources(resources map[string]types.ResourceWithTTL) error {
+	if !cache.validate {
+		return nil
+	}
+	plain := make(map[string]types.Resource, len(resources))
+	for name, res := range resources {
+		plain[name] = res.Resource
+	}
+	return validateResources(cache.typeURL, plain).err()
+}
+
+// setTTL must be called with the cache mutex held.
+func (cache *LinearCache) setTTL(name string, ttl *time.Duration) {
+	if ttl == nil {
+		delete(cache.ttls, name)
+	} else {
+		cache.ttls[name] = ttl
+	}
+}
+
 func (cache *LinearCache) getVersion() string {
 	return cache.versionPrefix + strconv.FormatUint(cache.version, 10)
 }
@@ -442,7 +899,10 @@ func (cache *LinearCache) cancelDeltaWatch(watchID int64) func() {
 	return func() {
 		cache.mu.Lock()
 		defer cache.mu.Unlock()
-		delete(cache.deltaWatches, watchID)
+		if watch, ok := cache.deltaWatches[watchID]; ok {
+			delete(cache.deltaWatches, watchID)
+			cache.observers.publish(Event{Kind: WatchClosed, Node: watch.Request.GetNode().GetId(), TypeURL: cache.typeURL, WatchID: watchID, Delta: true})
+		}
 	}
 }
 
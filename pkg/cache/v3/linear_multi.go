@@ -0,0 +1,275 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// updateOrder is the order in which resource types are updated in a batch,
+// following the xDS recommendation to update referenced resources before the
+// resources referencing them. Removals are applied in the reverse order.
+var updateOrder = []resource.Type{
+	resource.SecretType,
+	resource.ExtensionConfigType,
+	resource.ClusterType,
+	resource.EndpointType,
+	resource.ListenerType,
+	resource.ScopedRouteType,
+	resource.RouteType,
+	resource.VirtualHostType,
+	resource.RuntimeType,
+	resource.RateLimitConfigType,
+}
+
+// MultiTypeLinearCache is an incremental cache serving every xDS type from a
+// single cache, so that it can be used directly as the config watcher of an
+// ADS server, for both SotW and delta streams. Each type is stored in its own
+// LinearCache and versioned independently. Batch updates spanning several
+// types are applied atomically with respect to new watches.
+type MultiTypeLinearCache struct {
+	// Caches for each type URL, created on first use.
+	caches map[string]*LinearCache
+	// Options applied to each per-type cache.
+	opts []LinearCacheOption
+
+	mu sync.RWMutex
+}
+
+var _ Cache = &MultiTypeLinearCache{}
+
+// NewMultiTypeLinearCache creates a new multi-type cache. The options are
+// applied to the cache of each type URL. Initial resources are set with
+// WithInitialResourcesByType, or with WithInitialResources holding resources
+// of several types, each served by the cache of its type.
+func NewMultiTypeLinearCache(opts ...LinearCacheOption) *MultiTypeLinearCache {
+	return &MultiTypeLinearCache{
+		caches: make(map[string]*LinearCache),
+		opts:   opts,
+	}
+}
+
+// typeCache returns the cache for a type URL, creating it if needed.
+// It must be called with the cache mutex held.
+func (cache *MultiTypeLinearCache) typeCache(typeURL string) *LinearCache {
+	c, ok := cache.caches[typeURL]
+	if !ok {
+		opts := append(append([]LinearCacheOption(nil), cache.opts...), withResourcesOfType())
+		c = NewLinearCache(typeURL, opts...)
+		cache.caches[typeURL] = c
+	}
+	return c
+}
+
+// withResourcesOfType keeps the initial resources of the type of a cache, so
+// that the resources set with WithInitialResources are only served by the
+// cache of their type, and the caches do not share their resources.
+func withResourcesOfType() LinearCacheOption {
+	return func(cache *LinearCache) {
+		resources := make(map[string]types.Resource, len(cache.resources))
+		for name, res := range cache.resources {
+			if resource.APITypePrefix+string(proto.MessageName(res)) == cache.typeURL {
+				resources[name] = res
+			} else {
+				delete(cache.versionVector, name)
+			}
+		}
+		cache.resources = resources
+	}
+}
+
+// readTypeCache returns the cache for a type URL, creating it if needed, while
+// only holding the read lock in the common case.
+func (cache *MultiTypeLinearCache) readTypeCache(typeURL string) *LinearCache {
+	cache.mu.RLock()
+	c, ok := cache.caches[typeURL]
+	cache.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.typeCache(typeURL)
+}
+
+// UpdateResource updates a resource of the given type.
+func (cache *MultiTypeLinearCache) UpdateResource(typeURL, name string, res types.Resource) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.typeCache(typeURL).UpdateResource(name, res)
+}
+
+// UpdateResourceWithTTL updates a resource of the given type, together with its optional TTL.
+func (cache *MultiTypeLinearCache) UpdateResourceWithTTL(typeURL, name string, res types.ResourceWithTTL) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.typeCache(typeURL).UpdateResourceWithTTL(name, res)
+}
+
+// DeleteResource removes a resource of the given type.
+func (cache *MultiTypeLinearCache) DeleteResource(typeURL, name string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.typeCache(typeURL).DeleteResource(name)
+}
+
+// UpdateResources updates/deletes resources of several types in a single batch.
+// Updates are applied type by type so that referenced resources are updated
+// before the resources referencing them, and deletions are applied afterwards
+// in the reverse order. Types not known to xDS are updated last.
+// Watches created concurrently observe either none or all of the batch.
+// With WithResourceValidation, the whole batch is rejected if any resource is invalid.
+func (cache *MultiTypeLinearCache) UpdateResources(toUpdate map[resource.Type]map[string]types.Resource, toDelete map[resource.Type][]string) error {
+	typeURLs := batchOrder(toUpdate, toDelete)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var errs ValidationErrors
+	for _, typeURL := range typeURLs {
+		if resources := toUpdate[typeURL]; len(resources) > 0 && cache.typeCache(typeURL).validate {
+			errs = append(errs, validateResources(typeURL, resources)...)
+		}
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+
+	for _, typeURL := range typeURLs {
+		if resources := toUpdate[typeURL]; len(resources) > 0 {
+			if err := cache.typeCache(typeURL).updateResources(resources, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(typeURLs) - 1; i >= 0; i-- {
+		typeURL := typeURLs[i]
+		if names := toDelete[typeURL]; len(names) > 0 {
+			if err := cache.typeCache(typeURL).updateResources(nil, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// batchOrder returns the type URLs of a batch in update order.
+func batchOrder(toUpdate map[resource.Type]map[string]types.Resource, toDelete map[resource.Type][]string) []string {
+	out := make([]string, 0, len(updateOrder))
+	out = append(out, updateOrder...)
+
+	var others []string
+	for typeURL := range toUpdate {
+		if GetResponseType(typeURL) == types.UnknownType {
+			others = append(others, typeURL)
+		}
+	}
+	for typeURL := range toDelete {
+		if _, ok := toUpdate[typeURL]; !ok && GetResponseType(typeURL) == types.UnknownType {
+			others = append(others, typeURL)
+		}
+	}
+	sort.Strings(others)
+	return append(out, others...)
+}
+
+// SetResources replaces the resources of the given type, without validating them.
+func (cache *MultiTypeLinearCache) SetResources(typeURL string, resources map[string]types.Resource) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.typeCache(typeURL).SetResources(resources)
+}
+
+// ValidateAndSetResources replaces the resources of the given type after
+// validating them. The resources are left untouched if any of them is invalid.
+func (cache *MultiTypeLinearCache) ValidateAndSetResources(typeURL string, resources map[string]types.Resource) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.typeCache(typeURL).ValidateAndSetResources(resources)
+}
+
+// GetResources returns the current resources of the given type.
+func (cache *MultiTypeLinearCache) GetResources(typeURL string) map[string]types.Resource {
+	return cache.readTypeCache(typeURL).GetResources()
+}
+
+// GetVersion returns the current version of the given type.
+func (cache *MultiTypeLinearCache) GetVersion(typeURL string) string {
+	c := cache.readTypeCache(typeURL)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.getVersion()
+}
+
+// withTypeCache calls fn with the cache for a type URL while holding the cache
+// mutex, so that fn never observes a partially applied batch.
+func (cache *MultiTypeLinearCache) withTypeCache(typeURL string, fn func(*LinearCache)) {
+	cache.mu.RLock()
+	if c, ok := cache.caches[typeURL]; ok {
+		defer cache.mu.RUnlock()
+		fn(c)
+		return
+	}
+	cache.mu.RUnlock()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	fn(cache.typeCache(typeURL))
+}
+
+func (cache *MultiTypeLinearCache) CreateWatch(request *Request, state stream.StreamState, value chan Response) func() {
+	var cancel func()
+	cache.withTypeCache(request.TypeUrl, func(c *LinearCache) {
+		cancel = c.CreateWatch(request, state, value)
+	})
+	return cancel
+}
+
+func (cache *MultiTypeLinearCache) CreateDeltaWatch(request *DeltaRequest, state stream.StreamState, value chan DeltaResponse) func() {
+	var cancel func()
+	cache.withTypeCache(request.TypeUrl, func(c *LinearCache) {
+		cancel = c.CreateDeltaWatch(request, state, value)
+	})
+	return cancel
+}
+
+func (cache *MultiTypeLinearCache) Fetch(ctx context.Context, request *Request) (Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+// Number of resources of the given type currently on the cache.
+func (cache *MultiTypeLinearCache) NumResources(typeURL string) int {
+	return cache.readTypeCache(typeURL).NumResources()
+}
+
+// Number of active watches for a resource name of the given type.
+func (cache *MultiTypeLinearCache) NumWatches(typeURL, name string) int {
+	return cache.readTypeCache(typeURL).NumWatches(name)
+}
+
+// Number of active delta watches of the given type.
+func (cache *MultiTypeLinearCache) NumDeltaWatches(typeURL string) int {
+	return cache.readTypeCache(typeURL).NumDeltaWatches()
+}
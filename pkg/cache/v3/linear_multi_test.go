@@ -0,0 +1,149 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+func TestMultiTypeLinearCache(t *testing.T) {
+	c := NewMultiTypeLinearCache(WithVersionPrefix("p"))
+	state := stream.NewStreamState(false, map[string]string{})
+
+	clusters := make(chan Response, 1)
+	c.CreateWatch(&Request{TypeUrl: resource.ClusterType}, state, clusters)
+	listeners := make(chan Response, 1)
+	c.CreateWatch(&Request{TypeUrl: resource.ListenerType}, state, listeners)
+	endpoints := make(chan Response, 1)
+	c.CreateWatch(&Request{TypeUrl: resource.EndpointType, ResourceNames: []string{"a"}, VersionInfo: "p0"}, state, endpoints)
+
+	// Wildcard watches on an empty cache are answered right away, as with LinearCache.
+	require.Len(t, clusters, 1)
+	require.Len(t, listeners, 1)
+	<-clusters
+	<-listeners
+	mustBlock(t, endpoints)
+
+	c.CreateWatch(&Request{TypeUrl: resource.ClusterType, VersionInfo: "p0"}, state, clusters)
+	c.CreateWatch(&Request{TypeUrl: resource.ListenerType, VersionInfo: "p0"}, state, listeners)
+
+	require.NoError(t, c.UpdateResources(map[string]map[string]types.Resource{
+		resource.ClusterType:  {"a": &cluster.Cluster{Name: "a"}},
+		resource.EndpointType: {"a": &endpoint.ClusterLoadAssignment{ClusterName: "a"}},
+	}, nil))
+
+	// Types are versioned independently.
+	assert.Equal(t, "p1", c.GetVersion(resource.ClusterType))
+	assert.Equal(t, "p1", c.GetVersion(resource.EndpointType))
+	assert.Equal(t, "p0", c.GetVersion(resource.ListenerType))
+
+	require.Len(t, clusters, 1)
+	resp := <-clusters
+	assert.Equal(t, resource.ClusterType, resp.GetRequest().TypeUrl)
+	require.Len(t, endpoints, 1)
+	resp = <-endpoints
+	assert.Equal(t, resource.EndpointType, resp.GetRequest().TypeUrl)
+	mustBlock(t, listeners)
+
+	require.NoError(t, c.UpdateResource(resource.ListenerType, "l", &listener.Listener{Name: "l"}))
+	require.Len(t, listeners, 1)
+	resp = <-listeners
+	out, err := resp.GetDiscoveryResponse()
+	require.NoError(t, err)
+	assert.Equal(t, resource.ListenerType, out.TypeUrl)
+	assert.Equal(t, "p1", out.VersionInfo)
+	assert.Len(t, out.Resources, 1)
+
+	assert.Equal(t, 1, c.NumResources(resource.ClusterType))
+	assert.Len(t, c.GetResources(resource.EndpointType), 1)
+}
+
+func TestMultiTypeLinearCacheDelta(t *testing.T) {
+	c := NewMultiTypeLinearCache()
+	require.NoError(t, c.UpdateResource(resource.ClusterType, "a", &cluster.Cluster{Name: "a"}))
+
+	clusters := make(chan DeltaResponse, 1)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.ClusterType}, stream.NewStreamState(true, nil), clusters)
+	require.Len(t, clusters, 1)
+	out, err := (<-clusters).GetDeltaDiscoveryResponse()
+	require.NoError(t, err)
+	assert.Equal(t, resource.ClusterType, out.TypeUrl)
+	assert.Len(t, out.Resources, 1)
+
+	endpoints := make(chan DeltaResponse, 1)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.EndpointType}, stream.NewStreamState(true, nil), endpoints)
+	mustBlockDelta(t, endpoints)
+	assert.Equal(t, 1, c.NumDeltaWatches(resource.EndpointType))
+
+	require.NoError(t, c.UpdateResources(
+		map[string]map[string]types.Resource{resource.EndpointType: {"a": &endpoint.ClusterLoadAssignment{ClusterName: "a"}}},
+		map[string][]string{resource.ClusterType: {"a"}},
+	))
+	require.Len(t, endpoints, 1)
+	out, err = (<-endpoints).GetDeltaDiscoveryResponse()
+	require.NoError(t, err)
+	assert.Equal(t, resource.EndpointType, out.TypeUrl)
+	assert.Len(t, out.Resources, 1)
+	assert.Equal(t, 0, c.NumResources(resource.ClusterType))
+}
+
+func TestMultiTypeLinearCacheValidation(t *testing.T) {
+	c := NewMultiTypeLinearCache(WithResourceValidation())
+
+	// An invalid resource of one type rejects the whole batch.
+	err := c.UpdateResources(map[string]map[string]types.Resource{
+		resource.ClusterType:  {"a": &cluster.Cluster{Name: "a"}},
+		resource.EndpointType: {"a": &endpoint.ClusterLoadAssignment{}},
+	}, nil)
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 1)
+	assert.Equal(t, resource.EndpointType, errs[0].TypeURL)
+	assert.Equal(t, 0, c.NumResources(resource.ClusterType))
+	assert.Equal(t, "0", c.GetVersion(resource.ClusterType))
+}
+
+func TestMultiTypeLinearCacheInitialResources(t *testing.T) {
+	// Initial resources of several types are each served by the cache of their type.
+	c := NewMultiTypeLinearCache(WithInitialResources(map[string]types.Resource{
+		"a": &cluster.Cluster{Name: "a"},
+		"l": &listener.Listener{Name: "l"},
+	}))
+	assert.Len(t, c.GetResources(resource.ClusterType), 1)
+	assert.Contains(t, c.GetResources(resource.ClusterType), "a")
+	assert.Len(t, c.GetResources(resource.ListenerType), 1)
+	assert.Contains(t, c.GetResources(resource.ListenerType), "l")
+	assert.Empty(t, c.GetResources(resource.EndpointType))
+
+	// Resources of different types may share their name when set by type.
+	c = NewMultiTypeLinearCache(WithInitialResourcesByType(map[resource.Type]map[string]types.Resource{
+		resource.ClusterType:  {"x": &cluster.Cluster{Name: "x"}},
+		resource.ListenerType: {"x": &listener.Listener{Name: "x"}},
+	}))
+	assert.IsType(t, &cluster.Cluster{}, c.GetResources(resource.ClusterType)["x"])
+	assert.IsType(t, &listener.Listener{}, c.GetResources(resource.ListenerType)["x"])
+	assert.Empty(t, c.GetResources(resource.EndpointType))
+}
@@ -15,6 +15,7 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
@@ -25,8 +26,11 @@ import (
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
@@ -773,3 +777,166 @@ func TestLinearMixedWatches(t *testing.T) {
 	verifyResponse(t, w, c.getVersion(), 0)
 	verifyDeltaResponse(t, wd, nil, []string{"b"})
 }
+
+func TestLinearTTL(t *testing.T) {
+	ttl := 2 * time.Second
+	c := NewLinearCache(testType)
+	require.NoError(t, c.UpdateResourceWithTTL("a", types.ResourceWithTTL{Resource: testResource("a"), TTL: &ttl}))
+	require.NoError(t, c.UpdateResource("b", testResource("b")))
+
+	w := make(chan Response, 1)
+	c.CreateWatch(&Request{ResourceNames: []string{"a", "b"}, TypeUrl: testType}, stream.NewStreamState(false, nil), w)
+	resp := <-w
+	out, err := resp.GetDiscoveryResponse()
+	require.NoError(t, err)
+	require.Len(t, out.Resources, 2)
+	typeURLs := []string{out.Resources[0].TypeUrl, out.Resources[1].TypeUrl}
+	assert.ElementsMatch(t, []string{deltaResourceTypeURL, testType}, typeURLs)
+
+	// Updating a resource without TTL clears its TTL.
+	require.NoError(t, c.UpdateResources(map[string]types.Resource{"a": testResource("a")}, nil))
+	assert.Empty(t, c.ttls)
+}
+
+func TestLinearHeartbeat(t *testing.T) {
+	ttl := 2 * time.Second
+	c := NewLinearCache(testType)
+	require.NoError(t, c.UpdateResourcesWithTTL(map[string]types.ResourceWithTTL{
+		"a": {Resource: testResource("a"), TTL: &ttl},
+		"b": {Resource: testResource("b")},
+	}, nil))
+
+	state := stream.NewStreamState(false, nil)
+	named := make(chan Response, 1)
+	c.CreateWatch(&Request{ResourceNames: []string{"a", "b"}, TypeUrl: testType, VersionInfo: c.getVersion()}, state, named)
+	withoutTTL := make(chan Response, 1)
+	c.CreateWatch(&Request{ResourceNames: []string{"b"}, TypeUrl: testType, VersionInfo: c.getVersion()}, state, withoutTTL)
+	all := make(chan Response, 1)
+	c.CreateWatch(&Request{TypeUrl: testType, VersionInfo: c.getVersion()}, state, all)
+	mustBlock(t, named)
+	mustBlock(t, all)
+
+	c.sendHeartbeats()
+
+	for _, w := range []chan Response{named, all} {
+		resp := (<-w).(*RawResponse)
+		assert.True(t, resp.Heartbeat)
+		assert.Equal(t, c.getVersion(), resp.Version)
+		require.Len(t, resp.Resources, 1)
+		assert.Equal(t, &ttl, resp.Resources[0].TTL)
+	}
+	mustBlock(t, withoutTTL)
+
+	// Watches are closed after a heartbeat, watches without TTL resources are kept.
+	checkWatchCount(t, c, "a", 0)
+	checkWatchCount(t, c, "b", 1)
+}
+
+func TestLinearHeartbeatWatchRequest(t *testing.T) {
+	ttl := 2 * time.Second
+	c := NewLinearCache(testType)
+	require.NoError(t, c.UpdateResourceWithTTL("a", types.ResourceWithTTL{Resource: testResource("a"), TTL: &ttl}))
+
+	glob := "xdstp://example.com/google.protobuf.StringValue/foo/*"
+	request := &Request{ResourceNames: []string{"a", glob}, TypeUrl: testType, VersionInfo: c.getVersion(), Node: &core.Node{Id: "node"}}
+	value := make(chan Response, 1)
+	c.CreateWatch(request, stream.NewStreamState(false, nil), value)
+	mustBlock(t, value)
+
+	// Heartbeats respond on behalf of the request of the watch, and drop all its subscriptions.
+	c.sendHeartbeats()
+	assert.Same(t, request, (<-value).GetRequest())
+	assert.Empty(t, c.watches)
+	assert.Empty(t, c.globs)
+}
+
+func TestLinearHeartbeatRoutine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ttl := 2 * time.Second
+	c := NewLinearCache(testType, WithHeartbeating(ctx, 10*time.Millisecond))
+	require.NoError(t, c.UpdateResourceWithTTL("a", types.ResourceWithTTL{Resource: testResource("a"), TTL: &ttl}))
+
+	w := make(chan Response, 1)
+	c.mu.RLock()
+	version := c.getVersion()
+	c.mu.RUnlock()
+	c.CreateWatch(&Request{ResourceNames: []string{"a"}, TypeUrl: testType, VersionInfo: version}, stream.NewStreamState(false, nil), w)
+
+	select {
+	case resp := <-w:
+		assert.True(t, resp.(*RawResponse).Heartbeat)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for heartbeat")
+	}
+}
+
+func TestLinearResourceValidation(t *testing.T) {
+	valid := &endpoint.ClusterLoadAssignment{ClusterName: "a"}
+	invalid := &endpoint.ClusterLoadAssignment{}
+	c := NewLinearCache(resource.EndpointType, WithResourceValidation())
+
+	err := c.UpdateResource("a", invalid)
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 1)
+	assert.Equal(t, resource.EndpointType, errs[0].TypeURL)
+	assert.Equal(t, "a", errs[0].Name)
+	assert.Equal(t, 0, c.NumResources())
+
+	// Batches are rejected as a whole, listing every invalid resource.
+	err = c.UpdateResources(map[string]types.Resource{"a": valid, "b": invalid, "c": invalid}, nil)
+	require.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 2)
+	assert.Error(t, c.ValidateAndSetResources(map[string]types.Resource{"a": valid, "b": invalid}))
+	assert.Equal(t, 0, c.NumResources())
+	c.mu.RLock()
+	assert.Equal(t, "0", c.getVersion())
+	c.mu.RUnlock()
+
+	require.NoError(t, c.UpdateResource("a", valid))
+	require.NoError(t, c.ValidateAndSetResources(map[string]types.Resource{"a": valid, "b": valid}))
+	assert.Equal(t, 2, c.NumResources())
+
+	// SetResources keeps accepting any resources.
+	c.SetResources(map[string]types.Resource{"b": invalid})
+	assert.Equal(t, 1, c.NumResources())
+
+	// Resources without generated validation are accepted.
+	require.NoError(t, NewLinearCache(testType, WithResourceValidation()).UpdateResource("a", testResource("a")))
+}
+
+func TestLinearDeltaOnDemand(t *testing.T) {
+	c := NewLinearCache(resource.VirtualHostType, WithOnDemand())
+	state := stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{"local_route/foo.com": {}})
+
+	// The missing virtual host is replied as such.
+	w := make(chan DeltaResponse, 1)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.VirtualHostType}, state, w)
+	require.Len(t, w, 1)
+	resp := (<-w).(*RawDeltaResponse)
+	assert.Equal(t, []string{"local_route/foo.com"}, resp.NotFound)
+	assert.Empty(t, resp.Resources)
+
+	// It is sent once added, under its name.
+	state.SetResourceVersions(resp.NextVersionMap)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.VirtualHostType}, state, w)
+	assert.Empty(t, w)
+	vhost := &route.VirtualHost{Name: "local_route/vhost", Domains: []string{"foo.com"}}
+	require.NoError(t, c.UpdateResource("local_route/vhost", vhost))
+	require.Len(t, w, 1)
+	resp = (<-w).(*RawDeltaResponse)
+	assert.Equal(t, []types.Resource{vhost}, resp.Resources)
+	assert.Equal(t, map[string][]string{"local_route/vhost": {"local_route/foo.com"}}, resp.Aliases)
+	assert.Empty(t, resp.NotFound)
+
+	// Removing the domain removes the alias.
+	state.SetResourceVersions(resp.NextVersionMap)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.VirtualHostType}, state, w)
+	require.NoError(t, c.UpdateResource("local_route/vhost", &route.VirtualHost{Name: "local_route/vhost", Domains: []string{"bar.com"}}))
+	require.Len(t, w, 1)
+	resp = (<-w).(*RawDeltaResponse)
+	assert.Equal(t, []string{"local_route/foo.com"}, resp.RemovedResources)
+}
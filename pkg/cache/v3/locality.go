@@ -0,0 +1,134 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// LocalityHash uses the locality of the nodes as their hash, so that the nodes
+// of a locality share their snapshot.
+type LocalityHash struct{}
+
+// ID returns the region, zone and sub-zone of the node, separated by slashes.
+func (LocalityHash) ID(node *core.Node) string {
+	locality := node.GetLocality()
+	return locality.GetRegion() + "/" + locality.GetZone() + "/" + locality.GetSubZone()
+}
+
+// Proximity ranks a locality by its distance to a node.
+type Proximity int
+
+const (
+	// SameZone localities are in the zone of the node.
+	SameZone Proximity = iota
+
+	// SameRegion localities are in the region of the node, but not its zone.
+	SameRegion
+
+	// OtherRegion localities are in other regions, or the locality of the node is unknown.
+	OtherRegion
+)
+
+// LocalityProximity returns the proximity of a locality to the locality of a node.
+func LocalityProximity(node, locality *core.Locality) Proximity {
+	switch {
+	case node.GetRegion() != locality.GetRegion():
+		return OtherRegion
+	case node.GetZone() != "" && node.GetZone() == locality.GetZone():
+		return SameZone
+	case node.GetRegion() != "":
+		return SameRegion
+	}
+	return OtherRegion
+}
+
+// LocalityPriority is a ResourceTransformer assigning the priorities of the
+// endpoints of ClusterLoadAssignment resources by their proximity to the
+// node, so that nodes fail over from their zone to their region, and then to
+// other regions.
+//
+// Priorities are assigned by proximity, and then by the priority of the
+// endpoints in the shared resource, and are kept contiguous from 0. Resources
+// of other types, and nodes with no locality, are left unchanged.
+//
+// LocalityPriority implements NodeHash with LocalityHash, so that the resources
+// transformed for a node are kept while its locality is unchanged. Transformed
+// resources are memoized per node ID: nodes of a locality only share them if
+// the cache uses LocalityHash as well.
+type LocalityPriority struct {
+	// Weights optionally sets the load balancing weight of the localities of
+	// each proximity. Localities of proximities without weight keep theirs.
+	Weights map[Proximity]uint32
+}
+
+var _ ResourceTransformer = &LocalityPriority{}
+var _ NodeHash = &LocalityPriority{}
+
+// ID returns the hash of the locality of the node.
+func (p *LocalityPriority) ID(node *core.Node) string {
+	return LocalityHash{}.ID(node)
+}
+
+// Transform assigns the priorities and weights of the endpoints of a node.
+func (p *LocalityPriority) Transform(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+	assignment, ok := res.(*endpoint.ClusterLoadAssignment)
+	if !ok || node.GetLocality() == nil {
+		return res, nil
+	}
+
+	type rank struct {
+		proximity Proximity
+		priority  uint32
+	}
+	out := proto.Clone(assignment).(*endpoint.ClusterLoadAssignment)
+	ranks := make([]rank, len(out.GetEndpoints()))
+	distinct := make(map[rank]int)
+	for i, endpoints := range out.GetEndpoints() {
+		ranks[i] = rank{
+			proximity: LocalityProximity(node.GetLocality(), endpoints.GetLocality()),
+			priority:  endpoints.GetPriority(),
+		}
+		distinct[ranks[i]] = 0
+		if weight, ok := p.Weights[ranks[i].proximity]; ok {
+			endpoints.LoadBalancingWeight = wrapperspb.UInt32(weight)
+		}
+	}
+
+	sorted := make([]rank, 0, len(distinct))
+	for r := range distinct {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].proximity != sorted[j].proximity {
+			return sorted[i].proximity < sorted[j].proximity
+		}
+		return sorted[i].priority < sorted[j].priority
+	})
+	for i, r := range sorted {
+		distinct[r] = i
+	}
+	for i, endpoints := range out.GetEndpoints() {
+		endpoints.Priority = uint32(distinct[ranks[i]])
+	}
+	return out, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// localityAssignment returns an assignment with endpoints in zones a and b of
+// region r1, and zone c of region r2 at priority 1.
+func localityAssignment() *endpoint.ClusterLoadAssignment {
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints: []*endpoint.LocalityLbEndpoints{
+			{Locality: &core.Locality{Region: "r1", Zone: "a"}},
+			{Locality: &core.Locality{Region: "r1", Zone: "b"}},
+			{Locality: &core.Locality{Region: "r2", Zone: "c"}, Priority: 1},
+		},
+	}
+}
+
+// priorities returns the priorities of the endpoints of an assignment.
+func priorities(t *testing.T, res types.Resource) []uint32 {
+	var out []uint32
+	for _, endpoints := range res.(*endpoint.ClusterLoadAssignment).Endpoints {
+		out = append(out, endpoints.Priority)
+	}
+	return out
+}
+
+func TestLocalityPriority(t *testing.T) {
+	transformer := &cache.LocalityPriority{Weights: map[cache.Proximity]uint32{cache.SameZone: 10}}
+
+	for _, tc := range []struct {
+		locality *core.Locality
+		expected []uint32
+	}{
+		{locality: &core.Locality{Region: "r1", Zone: "a"}, expected: []uint32{0, 1, 2}},
+		{locality: &core.Locality{Region: "r1", Zone: "x"}, expected: []uint32{0, 0, 1}},
+		{locality: &core.Locality{Region: "r2", Zone: "c"}, expected: []uint32{1, 1, 0}},
+		{locality: &core.Locality{Region: "r3"}, expected: []uint32{0, 0, 1}},
+		{locality: nil, expected: []uint32{0, 0, 1}},
+	} {
+		shared := localityAssignment()
+		out, err := transformer.Transform(&core.Node{Locality: tc.locality}, rsrc.EndpointType, shared)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, priorities(t, out), tc.locality.String())
+		assert.Equal(t, []uint32{0, 0, 1}, priorities(t, shared))
+	}
+
+	out, err := transformer.Transform(&core.Node{Locality: &core.Locality{Region: "r1", Zone: "b"}}, rsrc.EndpointType, localityAssignment())
+	require.NoError(t, err)
+	endpoints := out.(*endpoint.ClusterLoadAssignment).Endpoints
+	assert.Nil(t, endpoints[0].LoadBalancingWeight)
+	assert.Equal(t, uint32(10), endpoints[1].LoadBalancingWeight.GetValue())
+}
+
+// countingTransformer counts the resources it transforms.
+type countingTransformer struct {
+	*cache.LocalityPriority
+	calls int
+}
+
+func (c *countingTransformer) Transform(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+	c.calls++
+	return c.LocalityPriority.Transform(node, typeURL, res)
+}
+
+func TestSnapshotCacheLocalityPriority(t *testing.T) {
+	transformer := &countingTransformer{LocalityPriority: &cache.LocalityPriority{}}
+	c := cache.NewSnapshotCache(false, cache.LocalityHash{}, logger{t: t}, cache.WithResourceTransformer(transformer))
+
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{rsrc.EndpointType: {localityAssignment()}})
+	require.NoError(t, err)
+	locality := &core.Locality{Region: "r1", Zone: "b"}
+	require.NoError(t, c.SetSnapshot(context.Background(), cache.LocalityHash{}.ID(&core.Node{Locality: locality}), snapshot))
+
+	// The nodes of a locality share their snapshot and transformed resources.
+	for _, id := range []string{"node1", "node2"} {
+		resp, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{
+			TypeUrl: rsrc.EndpointType,
+			Node:    &core.Node{Id: id, Locality: locality},
+		})
+		require.NoError(t, err)
+		resources := resp.(*cache.RawResponse).Resources
+		require.Len(t, resources, 1)
+		assert.Equal(t, []uint32{1, 0, 2}, priorities(t, resources[0].Resource))
+	}
+	assert.Equal(t, 1, transformer.calls)
+}
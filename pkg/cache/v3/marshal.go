@@ -0,0 +1,156 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// marshalCache memoizes the marshaled form of resources, so that the responses
+// built from the same snapshot or linear cache version for many nodes share
+// the same encoded bytes instead of marshaling each resource every time.
+//
+// Entries are indexed by type URL and name, and are reused as long as they
+// hold the same resource object. Resources must not be modified while they are
+// served, and caches forget the entries of updated resources. A nil
+// marshalCache marshals without memoizing.
+type marshalCache struct {
+	mu      sync.RWMutex
+	entries map[resourceID]*marshaledResource
+
+	// fallbacks are looked up for resources shared with other caches, and are never updated.
+	fallbacks []*marshalCache
+}
+
+type resourceID struct {
+	typeURL string
+	name    string
+}
+
+// marshaledResource is the shared encoding of a resource. The bytes must not be modified.
+type marshaledResource struct {
+	resource types.Resource
+	value    types.MarshaledResource
+
+	hashOnce sync.Once
+	hash     string
+}
+
+func newMarshalCache(fallbacks ...*marshalCache) *marshalCache {
+	return &marshalCache{
+		entries:   make(map[resourceID]*marshaledResource),
+		fallbacks: fallbacks,
+	}
+}
+
+// version returns the hash of the marshaled resource, as used in delta xDS.
+func (r *marshaledResource) version() string {
+	r.hashOnce.Do(func() {
+		r.hash = HashResource(r.value)
+	})
+	return r.hash
+}
+
+// marshal returns the marshaled form of a resource of the given type.
+func (c *marshalCache) marshal(typeURL string, res types.Resource) (*marshaledResource, error) {
+	// Resources are compared by identity, which is only possible for comparable types such as pointers.
+	if c == nil || res == nil || !reflect.TypeOf(res).Comparable() {
+		value, err := MarshalResource(res)
+		if err != nil {
+			return nil, err
+		}
+		return &marshaledResource{resource: res, value: value}, nil
+	}
+
+	id := resourceID{typeURL: typeURL, name: GetResourceName(res)}
+	if entry := c.lookup(id, res); entry != nil {
+		return entry, nil
+	}
+	for _, fallback := range c.fallbacks {
+		if entry := fallback.lookup(id, res); entry != nil {
+			return entry, nil
+		}
+	}
+
+	value, err := MarshalResource(res)
+	if err != nil {
+		return nil, err
+	}
+	entry := &marshaledResource{resource: res, value: value}
+
+	c.mu.Lock()
+	c.entries[id] = entry
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// lookup returns the entry of a resource, if memoized.
+func (c *marshalCache) lookup(id resourceID, res types.Resource) *marshaledResource {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if entry, ok := c.entries[id]; ok && entry.resource == res {
+		return entry
+	}
+	return nil
+}
+
+// inherit copies the entries of another cache which still hold the given
+// resources of a type.
+func (c *marshalCache) inherit(from *marshalCache, typeURL string, resources map[string]types.ResourceWithTTL) {
+	if c == nil || from == nil {
+		return
+	}
+	from.mu.RLock()
+	defer from.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, r := range resources {
+		id := resourceID{typeURL: typeURL, name: name}
+		if entry, ok := from.entries[id]; ok && entry.resource == r.Resource {
+			c.entries[id] = entry
+		}
+	}
+}
+
+// forget drops the entries of resources which were removed.
+func (c *marshalCache) forget(typeURL string, names ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		delete(c.entries, resourceID{typeURL: typeURL, name: name})
+	}
+}
+
+// marshalCacheProvider is implemented by snapshots owning a marshalCache.
+type marshalCacheProvider interface {
+	getMarshalCache() *marshalCache
+}
+
+// getMarshalCache returns the marshalCache of a snapshot, if any.
+func getMarshalCache(snapshot ResourceSnapshot) *marshalCache {
+	if p, ok := snapshot.(marshalCacheProvider); ok {
+		return p.getMarshalCache()
+	}
+	return nil
+}
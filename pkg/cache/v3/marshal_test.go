@@ -0,0 +1,170 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// sameBytes checks whether two byte slices share their backing array.
+func sameBytes(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+func discoveryResponseValue(t *testing.T, value chan Response) []byte {
+	t.Helper()
+	require.Len(t, value, 1)
+	out, err := (<-value).GetDiscoveryResponse()
+	require.NoError(t, err)
+	require.Len(t, out.Resources, 1)
+	return out.Resources[0].Value
+}
+
+func TestSnapshotMarshalSharedAcrossNodes(t *testing.T) {
+	c := NewSnapshotCache(false, IDHash{}, nil)
+	snapshot, err := NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.ClusterType: {&cluster.Cluster{Name: "a"}},
+	})
+	require.NoError(t, err)
+
+	var values [][]byte
+	for _, node := range []string{"n1", "n2"} {
+		require.NoError(t, c.SetSnapshot(context.Background(), node, snapshot))
+		value := make(chan Response, 1)
+		c.CreateWatch(&Request{TypeUrl: resource.ClusterType, Node: &core.Node{Id: node}}, stream.NewStreamState(false, nil), value)
+		values = append(values, discoveryResponseValue(t, value))
+	}
+	assert.True(t, sameBytes(values[0], values[1]))
+
+	// Delta responses share the same bytes and version hash.
+	require.NoError(t, snapshot.ConstructVersionMap())
+	delta := make(chan DeltaResponse, 1)
+	c.CreateDeltaWatch(&DeltaRequest{TypeUrl: resource.ClusterType, Node: &core.Node{Id: "n1"}}, stream.NewStreamState(true, nil), delta)
+	require.Len(t, delta, 1)
+	out, err := (<-delta).GetDeltaDiscoveryResponse()
+	require.NoError(t, err)
+	require.Len(t, out.Resources, 1)
+	assert.True(t, sameBytes(values[0], out.Resources[0].Resource.Value))
+	assert.Equal(t, snapshot.GetVersionMap(resource.ClusterType)["a"], out.Resources[0].Version)
+}
+
+func TestLinearMarshalShared(t *testing.T) {
+	c := NewLinearCache(resource.ClusterType)
+	require.NoError(t, c.UpdateResource("a", &cluster.Cluster{Name: "a"}))
+
+	watch := func() []byte {
+		value := make(chan Response, 1)
+		c.CreateWatch(&Request{TypeUrl: resource.ClusterType}, stream.NewStreamState(false, nil), value)
+		return discoveryResponseValue(t, value)
+	}
+	first := watch()
+	assert.True(t, sameBytes(first, watch()))
+
+	// Updating a resource, even the same object, invalidates its encoding.
+	res := &cluster.Cluster{Name: "a"}
+	require.NoError(t, c.UpdateResource("a", res))
+	second := watch()
+	assert.False(t, sameBytes(first, second))
+	res.AltStatName = "modified"
+	require.NoError(t, c.UpdateResource("a", res))
+	assert.NotEqual(t, second, watch())
+}
+
+func TestLayeredSnapshotMarshalFallback(t *testing.T) {
+	base, err := NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.ClusterType: {&cluster.Cluster{Name: "a"}},
+	})
+	require.NoError(t, err)
+	overlay, err := NewSnapshot("o", map[resource.Type][]types.Resource{
+		resource.ClusterType: {&cluster.Cluster{Name: "b"}},
+	})
+	require.NoError(t, err)
+
+	a := base.GetResources(resource.ClusterType)["a"]
+	fromBase, err := base.marshaled.marshal(resource.ClusterType, a)
+	require.NoError(t, err)
+
+	layered := &layeredSnapshot{base: base, overlay: overlay, marshaled: newMarshalCache(overlay.marshaled, base.marshaled)}
+	fromLayered, err := getMarshalCache(layered).marshal(resource.ClusterType, a)
+	require.NoError(t, err)
+	assert.Same(t, fromBase, fromLayered)
+
+	// Resources marshaled for the view do not leak into the layers.
+	_, err = layered.marshaled.marshal(resource.ClusterType, overlay.GetResources(resource.ClusterType)["b"])
+	require.NoError(t, err)
+	assert.Empty(t, overlay.marshaled.entries)
+}
+
+func TestSnapshotAliasIndexMemoized(t *testing.T) {
+	snapshot, err := NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.VirtualHostType: {&route.VirtualHost{Name: "local_route/vhost", Domains: []string{"foo.com"}}},
+	})
+	require.NoError(t, err)
+
+	aliases := getAliasIndex(snapshot)
+	assert.Equal(t, map[string]string{"local_route/foo.com": "local_route/vhost"}, aliases)
+	// The index is computed once, and shared by the responses of the snapshot.
+	aliases["local_route/bar.com"] = "local_route/vhost"
+	assert.Len(t, getAliasIndex(snapshot), 2)
+}
+
+func TestTransformedSnapshotMarshalInherited(t *testing.T) {
+	transformer := ResourceTransformerFunc(func(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+		return proto.Clone(res), nil
+	})
+	c := NewSnapshotCache(false, IDHash{}, nil, WithResourceTransformer(transformer))
+	snapshot, err := NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.ClusterType:  {&cluster.Cluster{Name: "a"}},
+		resource.ListenerType: {&listener.Listener{Name: "l"}},
+	})
+	require.NoError(t, err)
+	node := &core.Node{Id: "n"}
+	require.NoError(t, c.SetSnapshot(context.Background(), node.Id, snapshot))
+
+	watch := func() []byte {
+		value := make(chan Response, 1)
+		c.CreateWatch(&Request{TypeUrl: resource.ListenerType, Node: node}, stream.NewStreamState(false, nil), value)
+		return discoveryResponseValue(t, value)
+	}
+	first := watch()
+
+	// The encoding of unchanged types is kept across several versions,
+	// without chaining the views of the node.
+	for _, name := range []string{"b", "c"} {
+		require.NoError(t, c.(ResourceUpdater).UpdateResources(context.Background(), node.Id, resource.ClusterType, map[string]types.Resource{
+			name: &cluster.Cluster{Name: name},
+		}, nil))
+	}
+	assert.True(t, sameBytes(first, watch()))
+
+	sc := c.(*snapshotCache)
+	transformed := sc.shard(node.Id).transformed[node.Id]
+	current, err := c.GetSnapshot(node.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []*marshalCache{getMarshalCache(current)}, transformed.marshaled.fallbacks)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// MissingResourcePolicy handles the state of the world watches naming
+// resources missing from the snapshot of their node.
+type MissingResourcePolicy struct {
+	// Timeout fails the watches still missing resources this long after they
+	// went missing, by responding nil, which terminates their stream. Zero
+	// keeps the watches open until the resources are set.
+	Timeout time.Duration
+
+	// OnMissing is optionally called when a watch is opened for resources
+	// missing from the snapshot of its node, with the names of the missing
+	// resources. It is called while the cache is locked, and must not call the
+	// cache.
+	OnMissing func(node, typeURL string, missing []string)
+}
+
+// WithMissingResourcePolicy responds to the state of the world watches naming
+// resources missing from the snapshot of their node with the resources which
+// exist, rather than waiting for all of them. In ADS mode, watches are also
+// responded if the snapshot holds resources they do not name.
+//
+// The missing resources are reported by GetMissingResources of the StatusInfo
+// of the node, and to the OnMissing callback of the policy. Watches opened
+// before the node has a snapshot wait for it as usual.
+func WithMissingResourcePolicy(policy MissingResourcePolicy) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.missing = &policy
+	}
+}
+
+// missingNames returns the sorted requested names missing from the resources.
+// Glob collections are never missing.
+func missingNames(requested []string, resources map[string]types.ResourceWithTTL) []string {
+	var missing []string
+	for _, name := range requested {
+		if _, ok := resources[name]; ok {
+			continue
+		}
+		if _, ok := isGlob(name); ok {
+			continue
+		}
+		if _, ok := resources[resource.CanonicalResourceName(name)]; ok {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// trackMissing records the resources missing for an open watch, and arms its
+// timeout. The shard of the node must be locked.
+func (cache *snapshotCache) trackMissing(info *statusInfo, nodeID string, watchID int64, request *Request, snapshot ResourceSnapshot) {
+	resources := snapshot.GetResourcesAndTTL(request.TypeUrl)
+
+	info.mu.Lock()
+	info.refreshMissing(request.TypeUrl, resources, time.Now(), false)
+	missing := missingNames(request.ResourceNames, resources)
+	var since time.Time
+	for _, name := range missing {
+		if t := info.missing[request.TypeUrl][name]; since.IsZero() || t.Before(since) {
+			since = t
+		}
+	}
+	info.mu.Unlock()
+
+	if len(missing) == 0 {
+		return
+	}
+	cache.log.Warnf("watch %d of node %q for %s is missing resources %v", watchID, nodeID, request.TypeUrl, missing)
+	if cache.missing.OnMissing != nil {
+		cache.missing.OnMissing(nodeID, request.TypeUrl, missing)
+	}
+	if cache.missing.Timeout > 0 {
+		timer := time.AfterFunc(time.Until(since.Add(cache.missing.Timeout)), func() {
+			cache.failMissingWatch(nodeID, request.TypeUrl, watchID)
+		})
+		info.mu.Lock()
+		info.missingTimers[watchID] = timer
+		info.mu.Unlock()
+	}
+}
+
+// failMissingWatch terminates a watch if it is still missing resources.
+func (cache *snapshotCache) failMissingWatch(nodeID, typeURL string, watchID int64) {
+	shard := cache.shard(nodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	info, ok := shard.status[nodeID]
+	snapshot, exists := shard.snapshots[nodeID]
+	if !ok || !exists {
+		return
+	}
+	snapshot = cache.nodeSnapshot(shard, nodeID, info.node, snapshot)
+
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	delete(info.missingTimers, watchID)
+	watch, ok := info.watches[typeURL][watchID]
+	if !ok {
+		return
+	}
+	missing := missingNames(watch.Request.ResourceNames, snapshot.GetResourcesAndTTL(typeURL))
+	if len(missing) == 0 {
+		return
+	}
+
+	cache.log.Warnf("failing watch %d of node %q for %s missing resources %v", watchID, nodeID, typeURL, missing)
+	delete(info.watches[typeURL], watchID)
+	if len(info.watches[typeURL]) == 0 {
+		delete(info.watches, typeURL)
+	}
+	info.lastWatchCloseTime = time.Now()
+	info.pruneMissing(typeURL)
+	watch.Response <- nil
+	cache.observers.publish(Event{Kind: WatchClosed, Node: nodeID, TypeURL: typeURL, WatchID: watchID})
+}
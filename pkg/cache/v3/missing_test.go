@@ -0,0 +1,112 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+func TestSnapshotCacheMissingResources(t *testing.T) {
+	var reported [][]string
+	c := cache.NewSnapshotCache(true, group{}, logger{t: t}, cache.WithMissingResourcePolicy(cache.MissingResourcePolicy{
+		OnMissing: func(node, typeURL string, missing []string) {
+			assert.Equal(t, rsrc.ClusterType, typeURL)
+			reported = append(reported, missing)
+		},
+	}))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+
+	// The resources which exist are sent, even in ADS mode.
+	out := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"b"}}, stream.NewStreamState(false, nil), out)
+	assert.Empty(t, responseNames(t, <-out))
+	out = make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, ResourceNames: []string{"a", "b"}}, stream.NewStreamState(false, nil), out)
+	assert.Equal(t, []string{"a"}, responseNames(t, <-out))
+
+	// The watch acknowledging the response tracks the missing resources.
+	watch := namedWatch(c, rsrc.ClusterType, "1", "a", "b")
+	assert.Equal(t, [][]string{{"b"}}, reported)
+	missing := c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType)
+	assert.Len(t, missing, 1)
+	assert.Contains(t, missing, "b")
+
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, nil))
+	assert.Equal(t, []string{"a", "b"}, responseNames(t, <-watch))
+	assert.Empty(t, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType))
+}
+
+func TestSnapshotCacheMissingResourcesTimeout(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithMissingResourcePolicy(cache.MissingResourcePolicy{
+		Timeout: 50 * time.Millisecond,
+	}))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+
+	// Watches whose resources are set in time are not failed.
+	set := namedWatch(c, rsrc.ClusterType, "1", "b")
+	failed := namedWatch(c, rsrc.ClusterType, "1", "c")
+	since := c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType)
+	require.Len(t, since, 2)
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, nil))
+	assert.Equal(t, []string{"b"}, responseNames(t, <-set))
+
+	// Resources still missing keep the time they went missing, across the
+	// responses of their watch.
+	assert.Equal(t, map[string]time.Time{"c": since["c"]}, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "2", "a", "la")))
+	assert.Empty(t, responseNames(t, <-failed))
+	failed = namedWatch(c, rsrc.ClusterType, "2", "c")
+	assert.Equal(t, map[string]time.Time{"c": since["c"]}, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType))
+
+	select {
+	case resp := <-failed:
+		assert.Nil(t, resp)
+	case <-time.After(time.Second):
+		t.Fatal("watch missing a resource was not failed")
+	}
+	assert.Equal(t, 0, c.GetStatusInfo(key).GetNumWatches())
+	assert.Empty(t, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType))
+}
+
+func TestSnapshotCacheMissingResourcesCancel(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithMissingResourcePolicy(cache.MissingResourcePolicy{}))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+
+	state := stream.NewStreamState(false, map[string]string{})
+	state.SetKnownResourceNamesAsList(rsrc.ClusterType, []string{"b"})
+	cancel := c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, VersionInfo: "1", ResourceNames: []string{"b"}}, state, make(chan cache.Response, 1))
+	require.NotNil(t, cancel)
+	assert.Len(t, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType), 1)
+
+	// Resources are no longer missing once their watches are cancelled.
+	cancel()
+	assert.Empty(t, c.GetStatusInfo(key).GetMissingResources(rsrc.ClusterType))
+}
@@ -36,6 +36,7 @@ type MuxCache struct {
 }
 
 var _ Cache = &MuxCache{}
+var _ Observable = &MuxCache{}
 
 func (mux *MuxCache) CreateWatch(request *Request, state stream.StreamState, value chan Response) func() {
 	key := mux.Classify(request)
@@ -60,3 +61,19 @@ func (mux *MuxCache) CreateDeltaWatch(request *DeltaRequest, state stream.Stream
 func (mux *MuxCache) Fetch(ctx context.Context, request *Request) (Response, error) {
 	return nil, errors.New("not implemented")
 }
+
+// AddObserver registers an observer on all the muxed caches which report their
+// events. Caches added to the mux afterwards are not observed.
+func (mux *MuxCache) AddObserver(observer Observer) func() {
+	var removes []func()
+	for _, cache := range mux.Caches {
+		if observable, ok := cache.(Observable); ok {
+			removes = append(removes, observable.AddObserver(observer))
+		}
+	}
+	return func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}
+}
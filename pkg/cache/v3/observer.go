@@ -0,0 +1,189 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// WatchOpened reports a watch left open until the requested resources change.
+	WatchOpened EventKind = iota
+
+	// WatchClosed reports an open watch being discarded, because it was
+	// responded, canceled, or its node was cleared.
+	WatchClosed
+
+	// ResponseSent reports a response sent to a watch, whether open or
+	// responded immediately.
+	ResponseSent
+
+	// SnapshotSet reports the snapshot of a node being replaced.
+	SnapshotSet
+
+	// ResourcesUpdated reports resources of a LinearCache being updated or removed.
+	ResourcesUpdated
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case WatchOpened:
+		return "WatchOpened"
+	case WatchClosed:
+		return "WatchClosed"
+	case ResponseSent:
+		return "ResponseSent"
+	case SnapshotSet:
+		return "SnapshotSet"
+	case ResourcesUpdated:
+		return "ResourcesUpdated"
+	}
+	return "Unknown"
+}
+
+// Event is an action of a cache, as reported to its observers.
+type Event struct {
+	Kind EventKind
+
+	// Node is the ID of the node, as returned by the NodeHash of snapshot
+	// caches. It is empty for resource updates.
+	Node string
+
+	TypeURL string
+
+	// WatchID identifies the watch of WatchOpened and WatchClosed events.
+	// State of the world and delta watches are numbered separately.
+	WatchID int64
+
+	// Delta is set for the events of delta watches.
+	Delta bool
+
+	// Version is the version of the resources requested by an opened watch,
+	// sent in a response, or of a LinearCache after an update.
+	Version string
+
+	// ResourceNames are the names requested by an opened watch, sent in a
+	// response, or updated in a LinearCache.
+	ResourceNames []string
+
+	// RemovedResources are the names removed by a delta response, or from a LinearCache.
+	RemovedResources []string
+
+	// Snapshot is the snapshot set by a SnapshotSet event.
+	Snapshot ResourceSnapshot
+}
+
+// Observer is notified of the events of a cache.
+//
+// Observers are called synchronously, while the cache holds its locks, so
+// they must return quickly and must not call the cache.
+type Observer interface {
+	OnEvent(Event)
+}
+
+// ObserverFunc is a function observing the events of a cache.
+type ObserverFunc func(Event)
+
+// OnEvent invokes the function.
+func (f ObserverFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// Observable is implemented by caches reporting their events to observers.
+type Observable interface {
+	// AddObserver registers an observer, and returns a function unregistering it.
+	AddObserver(Observer) func()
+}
+
+// observers are the observers registered on a cache. The zero value has no observers.
+type observers struct {
+	mu     sync.RWMutex
+	nextID int64
+
+	// list is replaced on every change, so that it is iterated without the lock.
+	list []registeredObserver
+}
+
+type registeredObserver struct {
+	id       int64
+	observer Observer
+}
+
+func (o *observers) add(observer Observer) func() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.nextID++
+	id := o.nextID
+	list := make([]registeredObserver, 0, len(o.list)+1)
+	list = append(list, o.list...)
+	o.list = append(list, registeredObserver{id: id, observer: observer})
+
+	return func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		list := make([]registeredObserver, 0, len(o.list))
+		for _, r := range o.list {
+			if r.id != id {
+				list = append(list, r)
+			}
+		}
+		o.list = list
+	}
+}
+
+// active returns whether any observer is registered, so that events are only
+// built when needed.
+func (o *observers) active() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.list) > 0
+}
+
+func (o *observers) publish(event Event) {
+	o.mu.RLock()
+	list := o.list
+	o.mu.RUnlock()
+
+	for _, r := range list {
+		r.observer.OnEvent(event)
+	}
+}
+
+// sortedNames returns the sorted names of a set.
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sentNames returns the sorted names of the resources of a response.
+func sentNames(resources []types.ResourceWithTTL) []string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		names = append(names, GetResourceName(r.Resource))
+	}
+	sort.Strings(names)
+	return names
+}
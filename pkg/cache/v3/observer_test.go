@@ -0,0 +1,115 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// recorder records the events of a cache.
+type recorder struct {
+	events []cache.Event
+}
+
+func (r *recorder) OnEvent(event cache.Event) {
+	r.events = append(r.events, event)
+}
+
+// kinds returns the kinds of the recorded events, and forgets them.
+func (r *recorder) kinds() []cache.EventKind {
+	var out []cache.EventKind
+	for _, event := range r.events {
+		out = append(out, event.Kind)
+	}
+	r.events = nil
+	return out
+}
+
+func TestSnapshotCacheObserver(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	r := &recorder{}
+	remove := c.(cache.Observable).AddObserver(r)
+
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+	assert.Equal(t, []cache.EventKind{cache.SnapshotSet}, r.kinds())
+
+	clusters := orderedWatch(c, rsrc.ClusterType, "1")
+	cancel := c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ListenerType, VersionInfo: "1"},
+		stream.NewStreamState(false, map[string]string{}), make(chan cache.Response, 1))
+	require.Len(t, r.events, 2)
+	assert.Equal(t, cache.Event{Kind: cache.WatchOpened, Node: key, TypeURL: rsrc.ClusterType, WatchID: r.events[0].WatchID, Version: "1"}, r.events[0])
+	r.kinds()
+
+	cancel()
+	assert.Equal(t, []cache.EventKind{cache.WatchClosed}, r.kinds())
+
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "2", "b", "lb")))
+	require.Len(t, clusters, 1)
+	require.Len(t, r.events, 3)
+	assert.Equal(t, cache.SnapshotSet, r.events[0].Kind)
+	assert.Equal(t, cache.Event{Kind: cache.ResponseSent, Node: key, TypeURL: rsrc.ClusterType, Version: "2", ResourceNames: []string{"b"}}, r.events[1])
+	assert.Equal(t, cache.WatchClosed, r.events[2].Kind)
+	r.kinds()
+
+	// Delta watches report the names they subscribe to.
+	state := stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{"c": {}})
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, make(chan cache.DeltaResponse, 1))
+	require.Len(t, r.events, 1)
+	assert.True(t, r.events[0].Delta)
+	assert.Equal(t, []string{"c"}, r.events[0].ResourceNames)
+	r.kinds()
+
+	// Clearing a node closes its watches.
+	c.ClearSnapshot(key)
+	assert.Equal(t, []cache.EventKind{cache.WatchClosed}, r.kinds())
+
+	remove()
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "3", "b", "lb")))
+	assert.Empty(t, r.kinds())
+}
+
+func TestMuxCacheObserver(t *testing.T) {
+	linear := cache.NewLinearCache(rsrc.EndpointType)
+	mux := &cache.MuxCache{Caches: map[string]cache.Cache{"eds": linear}}
+	r := &recorder{}
+	mux.AddObserver(r)
+
+	value := make(chan cache.Response, 1)
+	linear.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.EndpointType, ResourceNames: []string{clusterName}, VersionInfo: "0", Node: &core.Node{Id: "node"}},
+		stream.NewStreamState(false, map[string]string{}), value)
+	assert.Equal(t, []cache.EventKind{cache.WatchOpened}, r.kinds())
+
+	require.NoError(t, linear.UpdateResource(clusterName, testEndpoint))
+	require.Len(t, value, 1)
+	require.Len(t, r.events, 3)
+	assert.Equal(t, cache.Event{Kind: cache.ResourcesUpdated, TypeURL: rsrc.EndpointType, Version: "1", ResourceNames: []string{clusterName}}, r.events[0])
+	assert.Equal(t, cache.Event{Kind: cache.ResponseSent, Node: "node", TypeURL: rsrc.EndpointType, Version: "1", ResourceNames: []string{clusterName}}, r.events[1])
+	assert.Equal(t, cache.Event{Kind: cache.WatchClosed, Node: "node", TypeURL: rsrc.EndpointType, WatchID: 1}, r.events[2])
+	r.kinds()
+
+	require.NoError(t, linear.UpdateResources(nil, []string{clusterName}))
+	assert.Equal(t, []cache.Event{{Kind: cache.ResourcesUpdated, TypeURL: rsrc.EndpointType, Version: "2", ResourceNames: []string{}, RemovedResources: []string{clusterName}}}, r.events)
+}
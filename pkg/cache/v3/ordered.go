@@ -0,0 +1,359 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// WithOrderedUpdates sequences the types of each snapshot set for a node,
+// following the make-before-break order of the xDS protocol: clusters and
+// endpoints are sent before the listeners and routes which reference them, and
+// the resources removed by a snapshot are only removed once the node accepted
+// the new resources of all types, starting with routes and listeners.
+//
+// Each type waits for the node to ACK the previous one, as reported by servers
+// using the cache as a ResponseTracker, so ordering is only meaningful when
+// all the types of a node are served on a single ADS stream. A node rejecting
+// a type stays on the partial update until a new snapshot is set.
+func WithOrderedUpdates() SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.ordering = &orderedUpdates{nodes: make(map[string]*nodeUpdates)}
+	}
+}
+
+// orderedUpdates holds the updates of the nodes in progress.
+type orderedUpdates struct {
+	// mu only guards the map, the updates of each node are locked on their own.
+	mu    sync.Mutex
+	nodes map[string]*nodeUpdates
+}
+
+// nodeUpdates holds the update in progress of a node.
+type nodeUpdates struct {
+	// mu serializes the steps of the sequence of the node, so that a step
+	// never overtakes a newer snapshot.
+	mu       sync.Mutex
+	sequence *updateSequence
+	// removed is set once the updates are dropped from the map, so that
+	// callers waiting on the lock look them up again.
+	removed bool
+}
+
+// lock returns the locked updates of a node. They are created if create is
+// set, and nil is returned otherwise if the node has none.
+func (o *orderedUpdates) lock(node string, create bool) *nodeUpdates {
+	for {
+		o.mu.Lock()
+		updates, ok := o.nodes[node]
+		if !ok {
+			if !create {
+				o.mu.Unlock()
+				return nil
+			}
+			updates = &nodeUpdates{}
+			o.nodes[node] = updates
+		}
+		o.mu.Unlock()
+
+		updates.mu.Lock()
+		if !updates.removed {
+			return updates
+		}
+		updates.mu.Unlock()
+	}
+}
+
+// unlock releases the updates of a node, dropping them if no sequence is in
+// progress.
+func (o *orderedUpdates) unlock(node string, updates *nodeUpdates) {
+	if updates.sequence == nil {
+		o.mu.Lock()
+		delete(o.nodes, node)
+		o.mu.Unlock()
+		updates.removed = true
+	}
+	updates.mu.Unlock()
+}
+
+// updateSequence is the list of snapshots leading a node to a new snapshot.
+type updateSequence struct {
+	steps []updateStep
+	next  int
+}
+
+// updateStep is a snapshot updating a single type, and the version of that
+// type the node must accept before the next step.
+type updateStep struct {
+	snapshot ResourceSnapshot
+	typeURL  string
+	version  string
+}
+
+// setOrderedSnapshot starts the sequence of updates of a node to a snapshot,
+// replacing any sequence in progress.
+func (cache *snapshotCache) setOrderedSnapshot(ctx context.Context, node string, snapshot ResourceSnapshot) error {
+	updates := cache.ordering.lock(node, true)
+	defer cache.ordering.unlock(node, updates)
+
+	previous, err := cache.GetSnapshot(node)
+	if err != nil {
+		// Nothing references the resources of a new node yet.
+		updates.sequence = nil
+		return cache.setSnapshot(ctx, node, snapshot)
+	}
+
+	updates.sequence = &updateSequence{steps: orderedSteps(previous, snapshot)}
+	return cache.advance(ctx, node, updates)
+}
+
+// onOrderedAck moves the update of a node forward once it accepted the type
+// sent by the current step.
+func (cache *snapshotCache) onOrderedAck(nodeID, typeURL, version string) {
+	updates := cache.ordering.lock(nodeID, false)
+	if updates == nil {
+		return
+	}
+	defer cache.ordering.unlock(nodeID, updates)
+
+	sequence := updates.sequence
+	if sequence == nil {
+		return
+	}
+	step := sequence.steps[sequence.next-1]
+	if current, err := cache.GetSnapshot(nodeID); err != nil || current != step.snapshot {
+		// The snapshot was replaced outside of the sequence, e.g. by a rollback.
+		updates.sequence = nil
+		return
+	}
+	if step.typeURL != typeURL || step.version != version {
+		return
+	}
+	if err := cache.advance(context.Background(), nodeID, updates); err != nil {
+		cache.log.Errorf("failed to update node %q: %v", nodeID, err)
+	}
+}
+
+// advance sets the next steps of the sequence of a node, until one must be
+// accepted by the node. The updates of the node must be locked.
+func (cache *snapshotCache) advance(ctx context.Context, node string, updates *nodeUpdates) error {
+	sequence := updates.sequence
+	for sequence.next < len(sequence.steps) {
+		step := sequence.steps[sequence.next]
+		sequence.next++
+		// The subscription is checked first, as the step may close the watches of the type.
+		subscribed := cache.awaitsAck(node, step.typeURL)
+		if err := cache.setSnapshot(ctx, node, step.snapshot); err != nil {
+			updates.sequence = nil
+			return err
+		}
+		if sequence.next < len(sequence.steps) && subscribed {
+			return nil
+		}
+	}
+	updates.sequence = nil
+	return nil
+}
+
+// awaitsAck returns whether a node is subscribed to a type, and hence expected
+// to acknowledge its updates.
+func (cache *snapshotCache) awaitsAck(node, typeURL string) bool {
+	shard := cache.shard(node)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	info, ok := shard.status[node]
+	if !ok {
+		return false
+	}
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	return len(info.watches[typeURL]) > 0 || len(info.deltaWatches[typeURL]) > 0 || info.types[typeURL].SentVersion != ""
+}
+
+// forgetSequence drops the update in progress of a node.
+func (o *orderedUpdates) forgetSequence(node string) {
+	if o == nil {
+		return
+	}
+	if updates := o.lock(node, false); updates != nil {
+		updates.sequence = nil
+		o.unlock(node, updates)
+	}
+}
+
+// orderedSteps returns the snapshots leading from a snapshot to another. The
+// new and updated resources of each type are added in updateOrder, along with the
+// stale resources of the type, which are then removed in the reverse order.
+// The last step is always the target snapshot.
+func orderedSteps(previous, target ResourceSnapshot) []updateStep {
+	current := newStagedSnapshot(previous, target)
+	for _, typeURL := range updateOrder {
+		current.versions[typeURL] = previous.GetVersion(typeURL)
+		current.resources[typeURL] = previous.GetResourcesAndTTL(typeURL)
+	}
+
+	var steps []updateStep
+	var stale []string
+	for _, typeURL := range updateOrder {
+		version := target.GetVersion(typeURL)
+		if version == previous.GetVersion(typeURL) {
+			continue
+		}
+		added := target.GetResourcesAndTTL(typeURL)
+		removed := false
+		for name := range previous.GetResourcesAndTTL(typeURL) {
+			if _, ok := added[name]; !ok {
+				removed = true
+				break
+			}
+		}
+		if removed {
+			stale = append(stale, typeURL)
+		}
+		if len(added) == 0 {
+			continue
+		}
+
+		if removed {
+			merged := make(map[string]types.ResourceWithTTL)
+			for name, r := range previous.GetResourcesAndTTL(typeURL) {
+				merged[name] = r
+			}
+			for name, r := range added {
+				merged[name] = r
+			}
+			version += "-staged"
+			added = merged
+		}
+		current = current.with(typeURL, version, added)
+		steps = append(steps, updateStep{snapshot: current, typeURL: typeURL, version: version})
+	}
+
+	for i := len(stale) - 1; i >= 0; i-- {
+		typeURL := stale[i]
+		version := target.GetVersion(typeURL)
+		current = current.with(typeURL, version, target.GetResourcesAndTTL(typeURL))
+		steps = append(steps, updateStep{snapshot: current, typeURL: typeURL, version: version})
+	}
+
+	if len(steps) == 0 {
+		return []updateStep{{snapshot: target}}
+	}
+	steps[len(steps)-1].snapshot = target
+	return steps
+}
+
+// stagedSnapshot is an intermediate snapshot of an ordered update, whose
+// types are taken from either the previous or the target snapshot.
+type stagedSnapshot struct {
+	versions    map[string]string
+	resources   map[string]map[string]types.ResourceWithTTL
+	versionMaps map[string]map[string]string
+	// versionMapMu serializes the construction of the version maps.
+	versionMapMu sync.Mutex
+	// aliases memoizes the virtual hosts indexed by their aliases.
+	aliases aliasMemo
+
+	// marshaled reuses the resources marshaled for the snapshots of the update.
+	marshaled *marshalCache
+}
+
+var _ ResourceSnapshot = &stagedSnapshot{}
+
+func newStagedSnapshot(previous, target ResourceSnapshot) *stagedSnapshot {
+	return &stagedSnapshot{
+		versions:  make(map[string]string),
+		resources: make(map[string]map[string]types.ResourceWithTTL),
+		marshaled: newMarshalCache(getMarshalCache(previous), getMarshalCache(target)),
+	}
+}
+
+// with returns a copy of the snapshot with the resources of a type replaced.
+func (s *stagedSnapshot) with(typeURL, version string, resources map[string]types.ResourceWithTTL) *stagedSnapshot {
+	out := &stagedSnapshot{
+		versions:  make(map[string]string, len(s.versions)),
+		resources: make(map[string]map[string]types.ResourceWithTTL, len(s.resources)),
+		marshaled: s.marshaled,
+	}
+	for k, v := range s.versions {
+		out.versions[k] = v
+	}
+	for k, v := range s.resources {
+		out.resources[k] = v
+	}
+	out.versions[typeURL] = version
+	out.resources[typeURL] = resources
+	return out
+}
+
+func (s *stagedSnapshot) GetVersion(typeURL string) string {
+	return s.versions[typeURL]
+}
+
+func (s *stagedSnapshot) GetResourcesAndTTL(typeURL string) map[string]types.ResourceWithTTL {
+	return s.resources[typeURL]
+}
+
+func (s *stagedSnapshot) GetResources(typeURL string) map[string]types.Resource {
+	resources := s.resources[typeURL]
+	if resources == nil {
+		return nil
+	}
+	out := make(map[string]types.Resource, len(resources))
+	for name, r := range resources {
+		out[name] = r.Resource
+	}
+	return out
+}
+
+func (s *stagedSnapshot) GetVersionMap(typeURL string) map[string]string {
+	return s.versionMaps[typeURL]
+}
+
+func (s *stagedSnapshot) ConstructVersionMap() error {
+	s.versionMapMu.Lock()
+	defer s.versionMapMu.Unlock()
+
+	if s.versionMaps != nil {
+		return nil
+	}
+
+	versionMaps := make(map[string]map[string]string, len(s.resources))
+	for typeURL, resources := range s.resources {
+		versions := make(map[string]string, len(resources))
+		for name, r := range resources {
+			marshaledResource, err := s.marshaled.marshal(typeURL, r.Resource)
+			if err != nil {
+				return err
+			}
+			versions[name] = marshaledResource.version()
+		}
+		versionMaps[typeURL] = versions
+	}
+	s.versionMaps = versionMaps
+	return nil
+}
+
+func (s *stagedSnapshot) getAliasIndex() map[string]string {
+	return s.aliases.get(s)
+}
+
+func (s *stagedSnapshot) getMarshalCache() *marshalCache {
+	return s.marshaled
+}
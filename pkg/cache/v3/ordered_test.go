@@ -0,0 +1,131 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// orderedSnapshot returns a snapshot of a cluster and a listener.
+func orderedSnapshot(t *testing.T, version, clusterName, listenerName string) *cache.Snapshot {
+	snapshot, err := cache.NewSnapshot(version, map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {&cluster.Cluster{Name: clusterName}},
+		rsrc.ListenerType: {&listener.Listener{Name: listenerName}},
+	})
+	require.NoError(t, err)
+	return snapshot
+}
+
+func orderedWatch(c cache.SnapshotCache, typeURL, version string) chan cache.Response {
+	out := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: version},
+		stream.NewStreamState(false, map[string]string{}), out)
+	return out
+}
+
+// receive returns the version and resource names of a response, and acknowledges it.
+func receive(t *testing.T, c cache.SnapshotCache, typeURL string, out chan cache.Response) (string, []string) {
+	require.Len(t, out, 1)
+	resp := (<-out).(*cache.RawResponse)
+	var names []string
+	for _, r := range resp.Resources {
+		names = append(names, cache.GetResourceName(r.Resource))
+	}
+	sort.Strings(names)
+
+	tracker := c.(cache.ResponseTracker)
+	tracker.OnResponseSent(&core.Node{Id: key}, typeURL, resp.Version, resp.Version)
+	tracker.OnResponseAck(&core.Node{Id: key}, typeURL, resp.Version, resp.Version, nil)
+	return resp.Version, names
+}
+
+func TestOrderedUpdates(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithOrderedUpdates())
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+	clusters, listeners := orderedWatch(c, rsrc.ClusterType, "1"), orderedWatch(c, rsrc.ListenerType, "1")
+
+	// The new cluster is added first, along with the cluster it replaces.
+	target := orderedSnapshot(t, "2", "b", "lb")
+	require.NoError(t, c.SetSnapshot(context.Background(), key, target))
+	assert.Empty(t, listeners)
+	version, names := receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, "2-staged", version)
+	assert.Equal(t, []string{"a", "b"}, names)
+	clusters = orderedWatch(c, rsrc.ClusterType, version)
+
+	// The listener is updated once the clusters are accepted.
+	version, names = receive(t, c, rsrc.ListenerType, listeners)
+	assert.Equal(t, "2-staged", version)
+	assert.Equal(t, []string{"la", "lb"}, names)
+	assert.Empty(t, clusters)
+	listeners = orderedWatch(c, rsrc.ListenerType, version)
+
+	// Stale resources are removed in the reverse order.
+	version, names = receive(t, c, rsrc.ListenerType, listeners)
+	assert.Equal(t, "2", version)
+	assert.Equal(t, []string{"lb"}, names)
+	version, names = receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, "2", version)
+	assert.Equal(t, []string{"b"}, names)
+
+	current, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Same(t, target, current)
+}
+
+func TestOrderedUpdatesUnusedTypes(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithOrderedUpdates())
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+	clusters := orderedWatch(c, rsrc.ClusterType, "1")
+
+	// Types the node is not subscribed to are not waited for, so the update
+	// completes once the clusters are accepted.
+	target := orderedSnapshot(t, "2", "b", "lb")
+	require.NoError(t, c.SetSnapshot(context.Background(), key, target))
+	version, _ := receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, "2-staged", version)
+
+	current, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Same(t, target, current)
+
+	// A new snapshot replaces the update in progress.
+	clusters = orderedWatch(c, rsrc.ClusterType, "2")
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "3", "c", "lb")))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "4", "b", "lb")))
+	version, names := receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, "3-staged", version)
+	assert.Equal(t, []string{"b", "c"}, names)
+
+	clusters = orderedWatch(c, rsrc.ClusterType, version)
+	version, names = receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, "4-staged", version)
+	assert.Equal(t, []string{"b", "c"}, names)
+	assert.Equal(t, "4", currentVersion(t, c, key))
+}
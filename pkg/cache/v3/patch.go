@@ -0,0 +1,330 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// ResourceUpdater is implemented by snapshot caches updating the resources of
+// a node without replacing its whole snapshot.
+type ResourceUpdater interface {
+	// UpdateResources updates the resources of a single type in the snapshot
+	// of a node, replacing or adding the resources of toUpdate, indexed by
+	// name, and removing the resources named in toDelete. Only the version of
+	// the type changes, and only the watches of the changed resources are
+	// responded. The node must have a snapshot.
+	UpdateResources(ctx context.Context, node, typeURL string, toUpdate map[string]types.Resource, toDelete []string) error
+}
+
+// UpdateResources updates the resources of a type in the snapshot of a node.
+func (cache *snapshotCache) UpdateResources(ctx context.Context, node, typeURL string, toUpdate map[string]types.Resource, toDelete []string) error {
+	if GetResponseType(typeURL) == types.UnknownType {
+		return fmt.Errorf("unknown resource type %q", typeURL)
+	}
+	for name, res := range toUpdate {
+		if res == nil {
+			return fmt.Errorf("resource %q is nil", name)
+		}
+		if resName := GetResourceName(res); resName != name {
+			return fmt.Errorf("resource %q is named %q", name, resName)
+		}
+	}
+	if cache.validate {
+		if err := validateResources(typeURL, toUpdate).err(); err != nil {
+			return err
+		}
+	}
+
+	// A partial update would be undone by the next step of an ordered update.
+	if cache.ordering != nil {
+		updates := cache.ordering.lock(node, true)
+		defer cache.ordering.unlock(node, updates)
+		if updates.sequence != nil {
+			return fmt.Errorf("ordered update of node %q in progress", node)
+		}
+	}
+
+	shard := cache.shard(node)
+	shard.writeMu.Lock()
+	defer shard.writeMu.Unlock()
+
+	shard.mu.RLock()
+	previous, ok := shard.snapshots[node]
+	shard.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no snapshot found for node %s", node)
+	}
+	snapshot, changed, err := patchSnapshot(previous, typeURL, toUpdate, toDelete)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		// nothing changed
+		return nil
+	}
+	if err := cache.persist(node, snapshot); err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// The snapshot may only have been evicted meanwhile, as writes are serialized.
+	if _, ok := shard.snapshots[node]; !ok {
+		return fmt.Errorf("no snapshot found for node %s", node)
+	}
+	return cache.applySnapshot(ctx, shard, node, snapshot, &resourcePatch{typeURL: typeURL, names: changed})
+}
+
+// resourcePatch lists the resources changed by a partial update, so that only
+// the watches of these resources are evaluated.
+type resourcePatch struct {
+	typeURL string
+	names   map[string]struct{}
+}
+
+// watchedBy returns whether a state of the world request names a changed resource.
+func (p *resourcePatch) watchedBy(request *Request) bool {
+	if len(request.ResourceNames) == 0 {
+		return true
+	}
+	matcher := newNameMatcher(request.ResourceNames)
+	for name := range p.names {
+		if matcher.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// triggers returns the changed resources, along with the aliases they are
+// subscribed to in delta xDS.
+func (p *resourcePatch) triggers(previous, snapshot ResourceSnapshot) map[string]struct{} {
+	if p.typeURL != resource.VirtualHostType {
+		return p.names
+	}
+	out := make(map[string]struct{}, len(p.names))
+	before, after := previous.GetResources(p.typeURL), snapshot.GetResources(p.typeURL)
+	for name := range p.names {
+		out[name] = struct{}{}
+		for _, res := range []types.Resource{before[name], after[name]} {
+			if res == nil {
+				continue
+			}
+			for _, alias := range GetResourceAliases(res) {
+				out[alias] = struct{}{}
+			}
+		}
+	}
+	return out
+}
+
+// patchSnapshot returns a snapshot with the resources of a type updated, and
+// the names of the resources which changed. It returns a nil snapshot if no
+// resource changed.
+//
+// Updated resources keep the TTL of the resources they replace. The version of
+// the type is derived from the previous version and the changes, so that
+// nodes applying the same changes to the same snapshot share it.
+func patchSnapshot(previous ResourceSnapshot, typeURL string, toUpdate map[string]types.Resource, toDelete []string) (*patchedSnapshot, map[string]struct{}, error) {
+	out := &patchedSnapshot{
+		base:      previous,
+		versions:  make(map[string]string),
+		resources: make(map[string]map[string]types.ResourceWithTTL),
+		hashes:    make(map[string]map[string]string),
+	}
+	// Successive updates are applied to the original snapshot, so that
+	// lookups never go through a chain of updates.
+	if p, ok := previous.(*patchedSnapshot); ok {
+		out.base = p.base
+		out.marshaled = p.marshaled
+		for k, v := range p.versions {
+			out.versions[k] = v
+		}
+		for k, v := range p.resources {
+			out.resources[k] = v
+		}
+		for k, v := range p.hashes {
+			out.hashes[k] = v
+		}
+	} else {
+		out.marshaled = newMarshalCache(getMarshalCache(previous))
+	}
+
+	current := previous.GetResourcesAndTTL(typeURL)
+	items := make(map[string]types.ResourceWithTTL, len(current)+len(toUpdate))
+	for name, r := range current {
+		items[name] = r
+	}
+	hashes := make(map[string]string, len(out.hashes[typeURL])+len(toUpdate))
+	for name, hash := range out.hashes[typeURL] {
+		hashes[name] = hash
+	}
+
+	changed := make(map[string]struct{})
+	for _, name := range toDelete {
+		if _, ok := items[name]; !ok {
+			continue
+		}
+		delete(items, name)
+		delete(hashes, name)
+		changed[name] = struct{}{}
+	}
+	for name, res := range toUpdate {
+		existing, ok := items[name]
+		if ok && proto.Equal(existing.Resource, res) {
+			continue
+		}
+		marshaled, err := out.marshaled.marshal(typeURL, res)
+		if err != nil {
+			return nil, nil, err
+		}
+		items[name] = types.ResourceWithTTL{Resource: res, TTL: existing.TTL}
+		hashes[name] = marshaled.version()
+		changed[name] = struct{}{}
+	}
+	if len(changed) == 0 {
+		return nil, nil, nil
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(previous.GetVersion(typeURL))
+	for _, name := range names {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		if _, ok := items[name]; ok {
+			b.WriteByte('=')
+			b.WriteString(hashes[name])
+		}
+	}
+
+	out.versions[typeURL] = HashResource([]byte(b.String()))
+	out.resources[typeURL] = items
+	out.hashes[typeURL] = hashes
+	return out, changed, nil
+}
+
+// patchedSnapshot is a snapshot with the resources of some types replaced by
+// partial updates.
+type patchedSnapshot struct {
+	base ResourceSnapshot
+
+	// versions and resources of the updated types
+	versions  map[string]string
+	resources map[string]map[string]types.ResourceWithTTL
+
+	// hashes are the delta versions of the updated resources, which are the
+	// only ones hashed when constructing the version map.
+	hashes map[string]map[string]string
+
+	versionMaps map[string]map[string]string
+	// versionMapMu serializes the construction of the version maps.
+	versionMapMu sync.Mutex
+
+	// aliases memoizes the virtual hosts indexed by their aliases.
+	aliases aliasMemo
+
+	// marshaled memoizes the updated resources, falling back to the original snapshot.
+	marshaled *marshalCache
+}
+
+var _ ResourceSnapshot = &patchedSnapshot{}
+
+func (s *patchedSnapshot) GetVersion(typeURL string) string {
+	if version, ok := s.versions[typeURL]; ok {
+		return version
+	}
+	return s.base.GetVersion(typeURL)
+}
+
+func (s *patchedSnapshot) GetResourcesAndTTL(typeURL string) map[string]types.ResourceWithTTL {
+	if resources, ok := s.resources[typeURL]; ok {
+		return resources
+	}
+	return s.base.GetResourcesAndTTL(typeURL)
+}
+
+func (s *patchedSnapshot) GetResources(typeURL string) map[string]types.Resource {
+	resources, ok := s.resources[typeURL]
+	if !ok {
+		return s.base.GetResources(typeURL)
+	}
+	out := make(map[string]types.Resource, len(resources))
+	for name, r := range resources {
+		out[name] = r.Resource
+	}
+	return out
+}
+
+func (s *patchedSnapshot) GetVersionMap(typeURL string) map[string]string {
+	if _, ok := s.resources[typeURL]; ok {
+		return s.versionMaps[typeURL]
+	}
+	return s.base.GetVersionMap(typeURL)
+}
+
+func (s *patchedSnapshot) ConstructVersionMap() error {
+	// The version maps of the original snapshot are reused for the resources
+	// which were not updated.
+	if err := s.base.ConstructVersionMap(); err != nil {
+		return err
+	}
+
+	s.versionMapMu.Lock()
+	defer s.versionMapMu.Unlock()
+
+	if s.versionMaps != nil {
+		return nil
+	}
+
+	versionMaps := make(map[string]map[string]string, len(s.resources))
+	for typeURL, resources := range s.resources {
+		base, hashes := s.base.GetVersionMap(typeURL), s.hashes[typeURL]
+		versions := make(map[string]string, len(resources))
+		for name := range resources {
+			if hash, ok := hashes[name]; ok {
+				versions[name] = hash
+			} else {
+				versions[name] = base[name]
+			}
+		}
+		versionMaps[typeURL] = versions
+	}
+	s.versionMaps = versionMaps
+	return nil
+}
+
+func (s *patchedSnapshot) getAliasIndex() map[string]string {
+	return s.aliases.get(s)
+}
+
+func (s *patchedSnapshot) getMarshalCache() *marshalCache {
+	return s.marshaled
+}
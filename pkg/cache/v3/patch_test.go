@@ -0,0 +1,111 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// namedWatch opens a watch for resources already known to the stream.
+func namedWatch(c cache.SnapshotCache, typeURL, version string, names ...string) chan cache.Response {
+	state := stream.NewStreamState(false, map[string]string{})
+	state.SetKnownResourceNamesAsList(typeURL, names)
+	out := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: typeURL, VersionInfo: version, ResourceNames: names}, state, out)
+	return out
+}
+
+func TestSnapshotCacheUpdateResources(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	require.Error(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, nil, []string{"a"}))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+
+	a, b := namedWatch(c, rsrc.ClusterType, "1", "a"), namedWatch(c, rsrc.ClusterType, "1", "b")
+	clusters, listeners := orderedWatch(c, rsrc.ClusterType, "1"), orderedWatch(c, rsrc.ListenerType, "1")
+
+	// Only the watches of the updated resources are responded.
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, nil))
+	assert.Empty(t, a)
+	assert.Empty(t, listeners)
+	version, names := receive(t, c, rsrc.ClusterType, b)
+	assert.NotEqual(t, "1", version)
+	assert.Equal(t, []string{"b"}, names)
+	_, names = receive(t, c, rsrc.ClusterType, clusters)
+	assert.Equal(t, []string{"a", "b"}, names)
+
+	snapshot, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Equal(t, version, snapshot.GetVersion(rsrc.ClusterType))
+	assert.Equal(t, "1", snapshot.GetVersion(rsrc.ListenerType))
+
+	// Updates leaving the resources unchanged are ignored.
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, []string{"c"}))
+	assert.Equal(t, version, currentVersion(t, c, key))
+
+	// Removals respond to the watches of the removed resources.
+	b = namedWatch(c, rsrc.ClusterType, version, "b")
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, nil, []string{"a"}))
+	assert.Empty(t, b)
+	_, names = receive(t, c, rsrc.ClusterType, a)
+	assert.Empty(t, names)
+
+	// Resources are indexed by name.
+	assert.Error(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"c": &cluster.Cluster{Name: "d"},
+	}, nil))
+}
+
+func TestSnapshotCacheUpdateResourcesDelta(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	require.NoError(t, c.SetSnapshot(context.Background(), key, orderedSnapshot(t, "1", "a", "la")))
+
+	state := stream.NewStreamState(true, nil)
+	value := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, value)
+	require.Len(t, value, 1)
+	state.SetResourceVersions((<-value).(*cache.RawDeltaResponse).NextVersionMap)
+
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state, value)
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), key, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, []string{"a"}))
+	require.Len(t, value, 1)
+	resp := (<-value).(*cache.RawDeltaResponse)
+	assert.Equal(t, []string{"b"}, cache.GetResourceNames(resp.Resources))
+	assert.Equal(t, []string{"a"}, resp.RemovedResources)
+
+	// The version map matches the one of a snapshot holding the same resources.
+	expected := orderedSnapshot(t, "2", "b", "la")
+	require.NoError(t, expected.ConstructVersionMap())
+	assert.Equal(t, expected.GetVersionMap(rsrc.ClusterType), resp.NextVersionMap)
+	snapshot, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Equal(t, expected.GetVersionMap(rsrc.ListenerType), snapshot.GetVersionMap(rsrc.ListenerType))
+}
@@ -0,0 +1,301 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// ResourceKey identifies a resource within a snapshot.
+type ResourceKey struct {
+	TypeURL resource.Type
+	Name    string
+}
+
+func (k ResourceKey) String() string {
+	return k.TypeURL + "/" + k.Name
+}
+
+// ResourceReference is an edge from a resource to a resource it depends on.
+type ResourceReference struct {
+	From ResourceKey
+	To   ResourceKey
+}
+
+func (r ResourceReference) String() string {
+	return r.From.String() + " -> " + r.To.String()
+}
+
+// GetSnapshotReferences returns every reference between the resources of a
+// snapshot, sorted. The following edges are considered:
+// - clusters to their EDS load assignment
+// - clusters and listener filter chains to the SDS secrets of their TLS transport sockets
+// - listeners to RDS route configurations, directly or through an inline scoped route list
+// - listener, network and HTTP filters to the ECDS extension configs they discover
+// - TCP proxies, routes and virtual hosts to the clusters they route to
+// - scoped routes to their route configuration
+// - VHDS route configurations to the virtual hosts named "<route configuration>/<suffix>"
+//
+// Virtual hosts are matched by prefix against the snapshot content, so a
+// reference to a virtual host is never dangling.
+func GetSnapshotReferences(snapshot ResourceSnapshot) []ResourceReference {
+	var out []ResourceReference
+	if snapshot == nil {
+		return out
+	}
+
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			continue
+		}
+		for name, res := range snapshot.GetResources(typeURL) {
+			from := ResourceKey{TypeURL: typeURL, Name: name}
+			for _, to := range getResourceDependencies(res) {
+				out = append(out, ResourceReference{From: from, To: to})
+			}
+		}
+	}
+
+	virtualHosts := snapshot.GetResources(resource.VirtualHostType)
+	for name, res := range snapshot.GetResources(resource.RouteType) {
+		if rc, ok := res.(*route.RouteConfiguration); !ok || rc.GetVhds() == nil {
+			continue
+		}
+		prefix := name + "/"
+		for vh := range virtualHosts {
+			if strings.HasPrefix(vh, prefix) {
+				out = append(out, ResourceReference{
+					From: ResourceKey{TypeURL: resource.RouteType, Name: name},
+					To:   ResourceKey{TypeURL: resource.VirtualHostType, Name: vh},
+				})
+			}
+		}
+	}
+
+	sortReferences(out)
+	return out
+}
+
+func sortReferences(refs []ResourceReference) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].From != refs[j].From {
+			return lessKey(refs[i].From, refs[j].From)
+		}
+		return lessKey(refs[i].To, refs[j].To)
+	})
+}
+
+func lessKey(a, b ResourceKey) bool {
+	if a.TypeURL != b.TypeURL {
+		return a.TypeURL < b.TypeURL
+	}
+	return a.Name < b.Name
+}
+
+// dependencies collects the resources referenced by a single resource.
+type dependencies struct {
+	seen map[ResourceKey]struct{}
+	out  []ResourceKey
+}
+
+func (d *dependencies) add(typeURL resource.Type, name string) {
+	if name == "" {
+		return
+	}
+	key := ResourceKey{TypeURL: typeURL, Name: name}
+	if _, ok := d.seen[key]; ok {
+		return
+	}
+	d.seen[key] = struct{}{}
+	d.out = append(d.out, key)
+}
+
+// getResourceDependencies returns the resources directly referenced by a resource.
+func getResourceDependencies(res types.Resource) []ResourceKey {
+	d := &dependencies{seen: map[ResourceKey]struct{}{}}
+
+	switch v := res.(type) {
+	case *cluster.Cluster:
+		d.cluster(v)
+	case *listener.Listener:
+		d.listener(v)
+	case *route.ScopedRouteConfiguration:
+		d.add(resource.RouteType, v.GetRouteConfigurationName())
+	case *route.RouteConfiguration:
+		d.routeConfiguration(v)
+	case *route.VirtualHost:
+		d.virtualHost(v)
+	case *core.TypedExtensionConfig:
+		// An ECDS network filter may itself be an HTTP connection manager.
+		if config := unmarshalHTTPConnectionManager(v.GetTypedConfig()); config != nil {
+			d.httpConnectionManager(config)
+		}
+	}
+
+	return d.out
+}
+
+func (d *dependencies) cluster(src *cluster.Cluster) {
+	if src.GetType() == cluster.Cluster_EDS {
+		if name := src.GetEdsClusterConfig().GetServiceName(); name != "" {
+			d.add(resource.EndpointType, name)
+		} else {
+			d.add(resource.EndpointType, src.GetName())
+		}
+	}
+
+	d.transportSocket(src.GetTransportSocket())
+	for _, match := range src.GetTransportSocketMatches() {
+		d.transportSocket(match.GetTransportSocket())
+	}
+}
+
+func (d *dependencies) listener(src *listener.Listener) {
+	for _, filter := range src.GetListenerFilters() {
+		d.configDiscovery(filter.GetName(), filter.GetConfigDiscovery())
+	}
+
+	chains := src.GetFilterChains()
+	if src.GetDefaultFilterChain() != nil {
+		chains = append(chains[:len(chains):len(chains)], src.GetDefaultFilterChain())
+	}
+	for _, chain := range chains {
+		d.transportSocket(chain.GetTransportSocket())
+
+		for _, filter := range chain.GetFilters() {
+			d.configDiscovery(filter.GetName(), filter.GetConfigDiscovery())
+
+			if config := unmarshalHTTPConnectionManager(filter.GetTypedConfig()); config != nil {
+				d.httpConnectionManager(config)
+				continue
+			}
+
+			proxy := &tcp.TcpProxy{}
+			if filter.GetTypedConfig() == nil {
+				continue
+			}
+			if err := anypb.UnmarshalTo(filter.GetTypedConfig(), proxy, proto.UnmarshalOptions{}); err == nil {
+				d.add(resource.ClusterType, proxy.GetCluster())
+				for _, c := range proxy.GetWeightedClusters().GetClusters() {
+					d.add(resource.ClusterType, c.GetName())
+				}
+			}
+		}
+	}
+}
+
+func (d *dependencies) httpConnectionManager(config *hcm.HttpConnectionManager) {
+	d.add(resource.RouteType, config.GetRds().GetRouteConfigName())
+
+	for _, s := range config.GetScopedRoutes().GetScopedRouteConfigurationsList().GetScopedRouteConfigurations() {
+		d.add(resource.RouteType, s.GetRouteConfigurationName())
+	}
+
+	if rc := config.GetRouteConfig(); rc != nil {
+		d.routeConfiguration(rc)
+	}
+
+	for _, filter := range config.GetHttpFilters() {
+		d.configDiscovery(filter.GetName(), filter.GetConfigDiscovery())
+	}
+}
+
+func (d *dependencies) routeConfiguration(src *route.RouteConfiguration) {
+	for _, vh := range src.GetVirtualHosts() {
+		d.virtualHost(vh)
+	}
+}
+
+func (d *dependencies) virtualHost(src *route.VirtualHost) {
+	for _, policy := range src.GetRequestMirrorPolicies() {
+		d.add(resource.ClusterType, policy.GetCluster())
+	}
+
+	for _, r := range src.GetRoutes() {
+		action := r.GetRoute()
+		d.add(resource.ClusterType, action.GetCluster())
+		for _, c := range action.GetWeightedClusters().GetClusters() {
+			d.add(resource.ClusterType, c.GetName())
+		}
+		for _, policy := range action.GetRequestMirrorPolicies() {
+			d.add(resource.ClusterType, policy.GetCluster())
+		}
+	}
+}
+
+// configDiscovery adds the ECDS extension config discovered by a filter.
+// Discovered filter configurations are named after the filter.
+func (d *dependencies) configDiscovery(name string, src *core.ExtensionConfigSource) {
+	if src.GetConfigSource() == nil {
+		return
+	}
+	d.add(resource.ExtensionConfigType, name)
+}
+
+// transportSocket adds the SDS secrets referenced by a TLS transport socket.
+func (d *dependencies) transportSocket(src *core.TransportSocket) {
+	typedConfig := src.GetTypedConfig()
+	if typedConfig == nil {
+		return
+	}
+
+	var common *auth.CommonTlsContext
+	upstream := &auth.UpstreamTlsContext{}
+	downstream := &auth.DownstreamTlsContext{}
+	if err := anypb.UnmarshalTo(typedConfig, upstream, proto.UnmarshalOptions{}); err == nil {
+		common = upstream.GetCommonTlsContext()
+	} else if err := anypb.UnmarshalTo(typedConfig, downstream, proto.UnmarshalOptions{}); err == nil {
+		common = downstream.GetCommonTlsContext()
+	} else {
+		return
+	}
+
+	configs := append([]*auth.SdsSecretConfig{}, common.GetTlsCertificateSdsSecretConfigs()...)
+	configs = append(configs,
+		common.GetValidationContextSdsSecretConfig(),
+		common.GetCombinedValidationContext().GetValidationContextSdsSecretConfig(),
+	)
+	for _, config := range configs {
+		if config.GetSdsConfig() != nil {
+			d.add(resource.SecretType, config.GetName())
+		}
+	}
+}
+
+func unmarshalHTTPConnectionManager(typedConfig *anypb.Any) *hcm.HttpConnectionManager {
+	if typedConfig == nil {
+		return nil
+	}
+	config := &hcm.HttpConnectionManager{}
+	if err := anypb.UnmarshalTo(typedConfig, config, proto.UnmarshalOptions{}); err != nil {
+		return nil
+	}
+	return config
+}
@@ -18,6 +18,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strings"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 
@@ -127,6 +129,65 @@ func GetResourceNames(resources []types.Resource) []string {
 	return out
 }
 
+// GetResourceAliases returns the names a resource is requested by on demand,
+// besides its own name. Virtual hosts named "<route configuration>/<name>" are
+// requested by VHDS as "<route configuration>/<domain>" for each of their domains.
+func GetResourceAliases(res types.Resource) []string {
+	vh, ok := res.(*route.VirtualHost)
+	if !ok {
+		return nil
+	}
+	i := strings.Index(vh.GetName(), "/")
+	if i < 0 {
+		return nil
+	}
+	out := make([]string, 0, len(vh.GetDomains()))
+	for _, domain := range vh.GetDomains() {
+		out = append(out, vh.GetName()[:i+1]+domain)
+	}
+	return out
+}
+
+// aliasIndex returns the resources indexed by their aliases, or nil if none has any.
+func aliasIndex(resources map[string]types.Resource) map[string]string {
+	var out map[string]string
+	for name, r := range resources {
+		for _, alias := range GetResourceAliases(r) {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[alias] = name
+		}
+	}
+	return out
+}
+
+// aliasMemo memoizes the virtual hosts of a snapshot indexed by their aliases.
+type aliasMemo struct {
+	once    sync.Once
+	aliases map[string]string
+}
+
+func (m *aliasMemo) get(snapshot ResourceSnapshot) map[string]string {
+	m.once.Do(func() {
+		m.aliases = aliasIndex(snapshot.GetResources(resource.VirtualHostType))
+	})
+	return m.aliases
+}
+
+// aliasIndexProvider is implemented by snapshots memoizing the aliases of their virtual hosts.
+type aliasIndexProvider interface {
+	getAliasIndex() map[string]string
+}
+
+// getAliasIndex returns the virtual hosts of a snapshot indexed by their aliases.
+func getAliasIndex(snapshot ResourceSnapshot) map[string]string {
+	if p, ok := snapshot.(aliasIndexProvider); ok {
+		return p.getAliasIndex()
+	}
+	return aliasIndex(snapshot.GetResources(resource.VirtualHostType))
+}
+
 // MarshalResource converts the Resource to MarshaledResource.
 func MarshalResource(resource types.Resource) (types.MarshaledResource, error) {
 	return proto.MarshalOptions{Deterministic: true}.Marshal(resource)
@@ -0,0 +1,172 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"sort"
+
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// NackRollbackPolicy configures a snapshot cache to revert the nodes rejecting
+// their snapshot to the last snapshot they fully accepted. Nodes must be served
+// by an xDS server reporting their ACKs and NACKs to the cache.
+type NackRollbackPolicy struct {
+	// Fraction of the nodes sent a version of a type which must reject it for
+	// the rejecting nodes to be reverted. Zero reverts every rejecting node
+	// right away.
+	Fraction float64
+
+	// Nodes are reverted as soon as they reject a version, regardless of Fraction.
+	Nodes []string
+
+	// OnRollback is optionally called after nodes were reverted.
+	OnRollback func(RollbackReport)
+}
+
+// RollbackReport describes the nodes reverted after rejecting a version.
+type RollbackReport struct {
+	// TypeURL and Version identify the rejected resources.
+	TypeURL string
+	Version string
+
+	// Detail is the error detail of the NACK triggering the rollback.
+	Detail *rpcstatus.Status
+
+	// Nodes lists the nodes reverted to their last good snapshot.
+	Nodes []string
+
+	// Skipped lists the rejecting nodes which never fully accepted a snapshot,
+	// and were left untouched.
+	Skipped []string
+}
+
+type nackRollback struct {
+	policy NackRollbackPolicy
+	nodes  map[string]struct{}
+}
+
+// WithNackRollback keeps the last snapshot fully accepted by each node, and
+// reverts the nodes rejecting a newer snapshot to it according to the policy.
+func WithNackRollback(policy NackRollbackPolicy) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		nodes := make(map[string]struct{}, len(policy.Nodes))
+		for _, node := range policy.Nodes {
+			nodes[node] = struct{}{}
+		}
+		cache.rollback = &nackRollback{policy: policy, nodes: nodes}
+	}
+}
+
+// recordAck keeps the snapshot of a node as its last good one, once the node
+// has accepted the versions of all the types it was sent.
+func (cache *snapshotCache) recordAck(nodeID string) {
+	shard := cache.shard(nodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	snapshot, ok := shard.snapshots[nodeID]
+	info, hasInfo := shard.status[nodeID]
+	if !ok || !hasInfo {
+		return
+	}
+
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	for typeURL, status := range info.types {
+		if status.AckedVersion != snapshot.GetVersion(typeURL) {
+			return
+		}
+	}
+	shard.lastGood[nodeID] = snapshot
+}
+
+// handleNack reverts the nodes rejecting the version of a type, if the policy is met.
+func (cache *snapshotCache) handleNack(nodeID, typeURL, version string, errorDetail *rpcstatus.Status) {
+	// Only the rejection of the current snapshot is acted upon.
+	if snapshot, err := cache.GetSnapshot(nodeID); err != nil || snapshot.GetVersion(typeURL) != version {
+		return
+	}
+
+	policy := cache.rollback.policy
+	targets := []string{nodeID}
+	if _, ok := cache.rollback.nodes[nodeID]; !ok && policy.Fraction > 0 {
+		sent, rejected, nacking := cache.nackingNodes(typeURL, version)
+		if sent == 0 || float64(rejected)/float64(sent) < policy.Fraction {
+			return
+		}
+		targets = nacking
+	}
+
+	report := RollbackReport{TypeURL: typeURL, Version: version, Detail: errorDetail}
+	for _, node := range targets {
+		shard := cache.shard(node)
+		shard.mu.RLock()
+		lastGood, ok := shard.lastGood[node]
+		current := shard.snapshots[node]
+		shard.mu.RUnlock()
+
+		switch {
+		case !ok:
+			report.Skipped = append(report.Skipped, node)
+		case current == nil || current.GetVersion(typeURL) != version:
+			// The node was updated or reverted concurrently.
+		default:
+			if err := cache.setSnapshot(context.Background(), node, lastGood); err != nil {
+				cache.log.Errorf("failed to revert node %q to its last good snapshot: %v", node, err)
+				continue
+			}
+			report.Nodes = append(report.Nodes, node)
+		}
+	}
+	if len(report.Nodes) == 0 && len(report.Skipped) == 0 {
+		return
+	}
+
+	cache.log.Warnf("reverted nodes %v rejecting %s version %q: %s", report.Nodes, typeURL, version, errorDetail.GetMessage())
+	if policy.OnRollback != nil {
+		policy.OnRollback(report)
+	}
+}
+
+// nackingNodes returns the number of nodes sent the version of a type and of
+// nodes rejecting it, including the nodes already reverted, and the nodes still
+// holding the rejected version.
+func (cache *snapshotCache) nackingNodes(typeURL, version string) (int, int, []string) {
+	sent, rejected := 0, 0
+	var nacking []string
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.mu.RLock()
+		for node, info := range shard.status {
+			status := info.GetTypeStatus(typeURL)
+			if status.SentVersion != version && status.NackedVersion != version {
+				continue
+			}
+			sent++
+			if !status.IsNacking() || status.NackedVersion != version {
+				continue
+			}
+			rejected++
+			if snapshot, ok := shard.snapshots[node]; ok && snapshot.GetVersion(typeURL) == version {
+				nacking = append(nacking, node)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	sort.Strings(nacking)
+	return sent, rejected, nacking
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func clusterSnapshot(t *testing.T, version string) *cache.Snapshot {
+	snapshot, err := cache.NewSnapshot(version, map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {testCluster},
+	})
+	require.NoError(t, err)
+	return snapshot
+}
+
+// deliver sets a snapshot for nodes and reports it as sent to them.
+func deliver(t *testing.T, c cache.SnapshotCache, snapshot *cache.Snapshot, nodes ...string) {
+	for _, node := range nodes {
+		require.NoError(t, c.SetSnapshot(context.Background(), node, snapshot))
+		c.(cache.ResponseTracker).OnResponseSent(&core.Node{Id: node}, rsrc.ClusterType, snapshot.GetVersion(rsrc.ClusterType), "1")
+	}
+}
+
+func ack(c cache.SnapshotCache, node, version string, errorDetail *rpcstatus.Status) {
+	c.(cache.ResponseTracker).OnResponseAck(&core.Node{Id: node}, rsrc.ClusterType, version, "1", errorDetail)
+}
+
+func currentVersion(t *testing.T, c cache.SnapshotCache, node string) string {
+	snapshot, err := c.GetSnapshot(node)
+	require.NoError(t, err)
+	return snapshot.GetVersion(rsrc.ClusterType)
+}
+
+func TestNackRollback(t *testing.T) {
+	var reports []cache.RollbackReport
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithNackRollback(cache.NackRollbackPolicy{
+		OnRollback: func(report cache.RollbackReport) { reports = append(reports, report) },
+	}))
+	nack := &rpcstatus.Status{Message: "invalid cluster"}
+
+	deliver(t, c, clusterSnapshot(t, "1"), "a", "b")
+	ack(c, "a", "1", nil)
+
+	// The node is reverted to the last snapshot it accepted.
+	deliver(t, c, clusterSnapshot(t, "2"), "a")
+	ack(c, "a", "2", nack)
+	assert.Equal(t, "1", currentVersion(t, c, "a"))
+
+	// Nodes which never accepted a snapshot are left untouched.
+	ack(c, "b", "1", nack)
+	assert.Equal(t, "1", currentVersion(t, c, "b"))
+
+	require.Len(t, reports, 2)
+	assert.Equal(t, cache.RollbackReport{TypeURL: rsrc.ClusterType, Version: "2", Detail: nack, Nodes: []string{"a"}}, reports[0])
+	assert.Equal(t, []string{"b"}, reports[1].Skipped)
+	assert.Empty(t, reports[1].Nodes)
+
+	// Stale rejections are ignored.
+	ack(c, "a", "2", nack)
+	assert.Len(t, reports, 2)
+}
+
+func TestNackRollbackFraction(t *testing.T) {
+	var reports []cache.RollbackReport
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithNackRollback(cache.NackRollbackPolicy{
+		Fraction:   0.5,
+		Nodes:      []string{"canary"},
+		OnRollback: func(report cache.RollbackReport) { reports = append(reports, report) },
+	}))
+	nack := &rpcstatus.Status{Message: "invalid cluster"}
+
+	nodes := []string{"canary", "n1", "n2", "n3", "n4"}
+	deliver(t, c, clusterSnapshot(t, "1"), nodes...)
+	for _, node := range nodes {
+		ack(c, node, "1", nil)
+	}
+	deliver(t, c, clusterSnapshot(t, "2"), nodes...)
+
+	// The canary is reverted on its own.
+	ack(c, "canary", "2", nack)
+	assert.Equal(t, "1", currentVersion(t, c, "canary"))
+	require.Len(t, reports, 1)
+	assert.Equal(t, []string{"canary"}, reports[0].Nodes)
+
+	// Other nodes are reverted once half of the nodes sent the version rejected it.
+	ack(c, "n1", "2", nack)
+	assert.Equal(t, "2", currentVersion(t, c, "n1"))
+	ack(c, "n2", "2", nack)
+	for node, version := range map[string]string{"n1": "1", "n2": "1", "n3": "2", "n4": "2"} {
+		assert.Equal(t, version, currentVersion(t, c, node), node)
+	}
+	require.Len(t, reports, 2)
+	assert.Equal(t, []string{"n1", "n2"}, reports[1].Nodes)
+}
@@ -0,0 +1,370 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// ErrRolloutAborted is returned by Rollout.Run when the rollout was aborted,
+// either explicitly or because too many nodes rejected the candidate snapshot.
+var ErrRolloutAborted = errors.New("rollout aborted")
+
+// RolloutStep is a stage of a rollout.
+type RolloutStep struct {
+	// Percentage of the nodes matching the selector which hold the candidate
+	// snapshot at the end of the step, from 0 to 100. Values out of this range
+	// are clamped to it.
+	Percentage float64
+
+	// Selector optionally restricts the step to the matching nodes.
+	Selector func(node *core.Node) bool
+
+	// Pause is how long the updated nodes are observed before the next step.
+	Pause time.Duration
+}
+
+// RolloutPlan describes how a candidate snapshot is rolled out.
+type RolloutPlan struct {
+	Steps []RolloutStep
+
+	// MaxNackFraction is the fraction of the updated nodes which may reject
+	// the candidate snapshot. The rollout is aborted beyond it.
+	MaxNackFraction float64
+}
+
+// RolloutState is the state of a rollout.
+type RolloutState int
+
+const (
+	RolloutPending RolloutState = iota
+	RolloutRunning
+	RolloutCompleted
+	RolloutAborted
+)
+
+func (s RolloutState) String() string {
+	switch s {
+	case RolloutPending:
+		return "pending"
+	case RolloutRunning:
+		return "running"
+	case RolloutCompleted:
+		return "completed"
+	case RolloutAborted:
+		return "aborted"
+	}
+	return fmt.Sprintf("RolloutState(%d)", int(s))
+}
+
+// RolloutProgress reports the progress of a rollout.
+type RolloutProgress struct {
+	State RolloutState
+
+	// Step is the index of the current step of the plan.
+	Step int
+
+	// Updated lists the nodes sent the candidate snapshot.
+	Updated []string
+
+	// Acked and Nacked count the updated nodes which accepted, or rejected,
+	// all the types of the candidate snapshot.
+	Acked  int
+	Nacked int
+}
+
+// MetadataSelector selects the nodes whose metadata holds all the given string fields.
+func MetadataSelector(labels map[string]string) func(node *core.Node) bool {
+	return func(node *core.Node) bool {
+		fields := node.GetMetadata().GetFields()
+		for k, v := range labels {
+			if fields[k].GetStringValue() != v {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Rollout sets a candidate snapshot on the nodes of a snapshot cache in
+// steps, observing whether the updated nodes accept it before proceeding.
+// The nodes of the rollout are the nodes known to the cache when it starts.
+// Acceptance is reported by servers using the cache as a ResponseTracker.
+type Rollout struct {
+	cache     SnapshotCache
+	candidate ResourceSnapshot
+	plan      RolloutPlan
+
+	promote     chan struct{}
+	promoteOnce sync.Once
+	abort       chan struct{}
+	abortOnce   sync.Once
+
+	mu       sync.Mutex
+	progress RolloutProgress
+	previous map[string]ResourceSnapshot
+}
+
+// NewRollout creates a rollout of a candidate snapshot following a plan.
+func NewRollout(cache SnapshotCache, candidate ResourceSnapshot, plan RolloutPlan) *Rollout {
+	return &Rollout{
+		cache:     cache,
+		candidate: candidate,
+		plan:      plan,
+		promote:   make(chan struct{}),
+		abort:     make(chan struct{}),
+		previous:  make(map[string]ResourceSnapshot),
+	}
+}
+
+// Run executes the steps of the plan, and blocks until the rollout is
+// completed or aborted. An aborted rollout reverts the updated nodes to their
+// previous snapshot and returns ErrRolloutAborted. The rollout is aborted as
+// well if the context is done or the candidate snapshot fails to be set, in
+// which case the updated nodes are reverted and Run returns the error.
+func (r *Rollout) Run(ctx context.Context) error {
+	r.mu.Lock()
+	if r.progress.State != RolloutPending {
+		r.mu.Unlock()
+		return fmt.Errorf("rollout is %s", r.progress.State)
+	}
+	r.progress.State = RolloutRunning
+	r.mu.Unlock()
+
+	nodes := r.cache.GetStatusKeys()
+	sort.Slice(nodes, func(i, j int) bool {
+		return rolloutOrder(nodes[i]) < rolloutOrder(nodes[j])
+	})
+
+	for i, step := range r.plan.Steps {
+		r.mu.Lock()
+		r.progress.Step = i
+		r.mu.Unlock()
+
+		if err := r.apply(ctx, r.selectNodes(nodes, step.Selector), step.Percentage); err != nil {
+			return r.fail(err)
+		}
+
+		select {
+		case <-time.After(step.Pause):
+		case <-r.promote:
+			if err := r.finish(ctx, nodes); err != nil {
+				return r.fail(err)
+			}
+			return nil
+		case <-r.abort:
+			return r.revert(ctx)
+		case <-ctx.Done():
+			return r.fail(ctx.Err())
+		}
+
+		if !r.healthy() {
+			return r.revert(ctx)
+		}
+	}
+
+	r.mu.Lock()
+	r.progress.State = RolloutCompleted
+	r.mu.Unlock()
+	return nil
+}
+
+// Promote completes a running rollout, setting the candidate snapshot on all
+// its remaining nodes.
+func (r *Rollout) Promote() {
+	r.promoteOnce.Do(func() { close(r.promote) })
+}
+
+// Abort stops a running rollout, reverting the updated nodes.
+func (r *Rollout) Abort() {
+	r.abortOnce.Do(func() { close(r.abort) })
+}
+
+// Progress returns the current progress of the rollout.
+func (r *Rollout) Progress() RolloutProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	progress := r.progress
+	progress.Updated = append([]string(nil), r.progress.Updated...)
+	progress.Acked, progress.Nacked = 0, 0
+	for _, node := range progress.Updated {
+		switch r.nodeState(node) {
+		case nodeAcked:
+			progress.Acked++
+		case nodeNacked:
+			progress.Nacked++
+		}
+	}
+	return progress
+}
+
+// selectNodes returns the nodes matching a selector.
+func (r *Rollout) selectNodes(nodes []string, selector func(*core.Node) bool) []string {
+	if selector == nil {
+		return nodes
+	}
+	var out []string
+	for _, node := range nodes {
+		if info := r.cache.GetStatusInfo(node); info != nil && selector(info.GetNode()) {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// apply sets the candidate snapshot on a percentage of the nodes.
+func (r *Rollout) apply(ctx context.Context, nodes []string, percentage float64) error {
+	count := 0
+	if percentage > 0 {
+		count = int(math.Ceil(float64(len(nodes)) * math.Min(percentage, 100) / 100))
+	}
+	if count > len(nodes) {
+		count = len(nodes)
+	}
+
+	for _, node := range nodes[:count] {
+		r.mu.Lock()
+		_, updated := r.previous[node]
+		r.mu.Unlock()
+		if updated {
+			continue
+		}
+
+		previous, _ := r.cache.GetSnapshot(node)
+		if err := r.cache.SetSnapshot(ctx, node, r.candidate); err != nil {
+			return fmt.Errorf("failed to set candidate snapshot for node %q: %w", node, err)
+		}
+
+		r.mu.Lock()
+		r.previous[node] = previous
+		r.progress.Updated = append(r.progress.Updated, node)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// finish sets the candidate snapshot on all nodes of the rollout.
+func (r *Rollout) finish(ctx context.Context, nodes []string) error {
+	if err := r.apply(ctx, nodes, 100); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.progress.State = RolloutCompleted
+	r.mu.Unlock()
+	return nil
+}
+
+// revert sets the previous snapshot of the updated nodes back, and clears
+// the snapshot of the updated nodes which had none.
+func (r *Rollout) revert(ctx context.Context) error {
+	r.mu.Lock()
+	r.progress.State = RolloutAborted
+	nodes := append([]string(nil), r.progress.Updated...)
+	previous := make(map[string]ResourceSnapshot, len(nodes))
+	for _, node := range nodes {
+		previous[node] = r.previous[node]
+	}
+	r.mu.Unlock()
+
+	for _, node := range nodes {
+		if previous[node] == nil {
+			r.cache.ClearSnapshot(node)
+			continue
+		}
+		if err := r.cache.SetSnapshot(ctx, node, previous[node]); err != nil {
+			return fmt.Errorf("failed to revert node %q: %w", node, err)
+		}
+	}
+	return ErrRolloutAborted
+}
+
+// fail aborts the rollout after an error, and returns the error. The updated
+// nodes are reverted regardless of the context of the rollout, which may be
+// done.
+func (r *Rollout) fail(err error) error {
+	if revertErr := r.revert(context.Background()); !errors.Is(revertErr, ErrRolloutAborted) {
+		return fmt.Errorf("%w, and %v", err, revertErr)
+	}
+	return err
+}
+
+// healthy returns whether the fraction of updated nodes rejecting the
+// candidate snapshot is acceptable.
+func (r *Rollout) healthy() bool {
+	progress := r.Progress()
+	if len(progress.Updated) == 0 {
+		return true
+	}
+	return float64(progress.Nacked)/float64(len(progress.Updated)) <= r.plan.MaxNackFraction
+}
+
+type rolloutNodeState int
+
+const (
+	nodePending rolloutNodeState = iota
+	nodeAcked
+	nodeNacked
+)
+
+// nodeState returns whether a node accepted or rejected the candidate snapshot.
+func (r *Rollout) nodeState(node string) rolloutNodeState {
+	info := r.cache.GetStatusInfo(node)
+	if info == nil {
+		return nodePending
+	}
+
+	state, used := nodeAcked, false
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			continue
+		}
+		version := r.candidate.GetVersion(typeURL)
+		status := info.GetTypeStatus(typeURL)
+		if version == "" || status.SentVersion == "" && status.AckedVersion == "" {
+			// The type is not used by the node.
+			continue
+		}
+		used = true
+		switch {
+		case status.IsNacking() && status.NackedVersion == version:
+			return nodeNacked
+		case status.AckedVersion != version:
+			state = nodePending
+		}
+	}
+	if !used {
+		return nodePending
+	}
+	return state
+}
+
+// rolloutOrder spreads the nodes updated by each step.
+func rolloutOrder(node string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(node))
+	return h.Sum64()
+}
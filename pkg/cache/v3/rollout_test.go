@@ -0,0 +1,206 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+// rolloutCache returns a cache with nodes at version 1, the first of which is a canary.
+func rolloutCache(t *testing.T, n int) (cache.SnapshotCache, []string) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	var nodes []string
+	for i := 0; i < n; i++ {
+		node := fmt.Sprintf("node%d", i)
+		nodes = append(nodes, node)
+		role, err := structpb.NewStruct(map[string]interface{}{"role": "default"})
+		require.NoError(t, err)
+		if i == 0 {
+			role.Fields["role"] = structpb.NewStringValue("canary")
+		}
+
+		c.CreateWatch(&discovery.DiscoveryRequest{Node: &core.Node{Id: node, Metadata: role}, TypeUrl: rsrc.ClusterType, VersionInfo: "1"},
+			stream.NewStreamState(false, map[string]string{}), make(chan cache.Response, 1))
+		deliver(t, c, clusterSnapshot(t, "1"), node)
+	}
+	return c, nodes
+}
+
+// waitForUpdate waits until a rollout updated the given number of nodes.
+func waitForUpdate(t *testing.T, rollout *cache.Rollout, n int) []string {
+	assert.Eventually(t, func() bool { return len(rollout.Progress().Updated) >= n }, time.Second, time.Millisecond)
+	return rollout.Progress().Updated
+}
+
+func TestRollout(t *testing.T) {
+	c, nodes := rolloutCache(t, 10)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{
+			{Percentage: 100, Selector: cache.MetadataSelector(map[string]string{"role": "canary"}), Pause: time.Hour},
+			{Percentage: 50},
+			{Percentage: 100},
+		},
+	})
+	assert.Equal(t, cache.RolloutPending, rollout.Progress().State)
+
+	done := make(chan error)
+	go func() { done <- rollout.Run(context.Background()) }()
+
+	// The canary is updated first, and observed until it accepts the snapshot.
+	assert.Equal(t, []string{nodes[0]}, waitForUpdate(t, rollout, 1))
+	assert.Equal(t, "2", currentVersion(t, c, nodes[0]))
+	assert.Equal(t, "1", currentVersion(t, c, nodes[1]))
+	c.(cache.ResponseTracker).OnResponseSent(&core.Node{Id: nodes[0]}, rsrc.ClusterType, "2", "2")
+	ack(c, nodes[0], "2", nil)
+	progress := rollout.Progress()
+	assert.Equal(t, cache.RolloutRunning, progress.State)
+	assert.Equal(t, 1, progress.Acked)
+
+	rollout.Promote()
+	require.NoError(t, <-done)
+
+	progress = rollout.Progress()
+	assert.Equal(t, cache.RolloutCompleted, progress.State)
+	assert.Len(t, progress.Updated, 10)
+	for _, node := range nodes {
+		assert.Equal(t, "2", currentVersion(t, c, node))
+	}
+	assert.Error(t, rollout.Run(context.Background()))
+}
+
+func TestRolloutSteps(t *testing.T) {
+	c, nodes := rolloutCache(t, 10)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{{Percentage: 30}, {Percentage: 100}},
+	})
+	require.NoError(t, rollout.Run(context.Background()))
+
+	for _, node := range nodes {
+		assert.Equal(t, "2", currentVersion(t, c, node))
+	}
+	assert.Equal(t, cache.RolloutCompleted, rollout.Progress().State)
+}
+
+func TestRolloutAbortOnNack(t *testing.T) {
+	c, nodes := rolloutCache(t, 10)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{
+			{Percentage: 20, Pause: 100 * time.Millisecond},
+			{Percentage: 100},
+		},
+		MaxNackFraction: 0.4,
+	})
+
+	done := make(chan error)
+	go func() { done <- rollout.Run(context.Background()) }()
+
+	updated := waitForUpdate(t, rollout, 2)
+	tracker := c.(cache.ResponseTracker)
+	tracker.OnResponseSent(&core.Node{Id: updated[0]}, rsrc.ClusterType, "2", "2")
+	ack(c, updated[0], "2", &rpcstatus.Status{Message: "invalid cluster"})
+	tracker.OnResponseSent(&core.Node{Id: updated[1]}, rsrc.ClusterType, "2", "2")
+	ack(c, updated[1], "2", nil)
+
+	// Half of the updated nodes reject the snapshot, so all of them are reverted.
+	assert.ErrorIs(t, <-done, cache.ErrRolloutAborted)
+	progress := rollout.Progress()
+	assert.Equal(t, cache.RolloutAborted, progress.State)
+	assert.Equal(t, 1, progress.Nacked)
+	for _, node := range nodes {
+		assert.Equal(t, "1", currentVersion(t, c, node))
+	}
+}
+
+func TestRolloutAbort(t *testing.T) {
+	c, nodes := rolloutCache(t, 4)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{{Percentage: 50, Pause: time.Hour}},
+	})
+
+	done := make(chan error)
+	go func() { done <- rollout.Run(context.Background()) }()
+	waitForUpdate(t, rollout, 2)
+
+	rollout.Abort()
+	assert.ErrorIs(t, <-done, cache.ErrRolloutAborted)
+	for _, node := range nodes {
+		assert.Equal(t, "1", currentVersion(t, c, node))
+	}
+}
+
+func TestRolloutAbortClearsNodesWithoutSnapshot(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	c.CreateWatch(&discovery.DiscoveryRequest{Node: &core.Node{Id: "new"}, TypeUrl: rsrc.ClusterType},
+		stream.NewStreamState(false, map[string]string{}), make(chan cache.Response, 1))
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{{Percentage: 100, Pause: time.Hour}},
+	})
+
+	done := make(chan error)
+	go func() { done <- rollout.Run(context.Background()) }()
+	waitForUpdate(t, rollout, 1)
+	assert.Equal(t, "2", currentVersion(t, c, "new"))
+
+	// The node had no snapshot before the rollout, so it is left without one.
+	rollout.Abort()
+	assert.ErrorIs(t, <-done, cache.ErrRolloutAborted)
+	_, err := c.GetSnapshot("new")
+	assert.Error(t, err)
+}
+
+func TestRolloutPercentageClamped(t *testing.T) {
+	c, nodes := rolloutCache(t, 4)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{{Percentage: -10}, {Percentage: 150}},
+	})
+	require.NoError(t, rollout.Run(context.Background()))
+	for _, node := range nodes {
+		assert.Equal(t, "2", currentVersion(t, c, node))
+	}
+}
+
+func TestRolloutContextDone(t *testing.T) {
+	c, nodes := rolloutCache(t, 4)
+	rollout := cache.NewRollout(c, clusterSnapshot(t, "2"), cache.RolloutPlan{
+		Steps: []cache.RolloutStep{{Percentage: 50, Pause: time.Hour}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- rollout.Run(ctx) }()
+	waitForUpdate(t, rollout, 2)
+
+	// The rollout ends aborted, with the updated nodes reverted.
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, cache.RolloutAborted, rollout.Progress().State)
+	for _, node := range nodes {
+		assert.Equal(t, "1", currentVersion(t, c, node))
+	}
+}
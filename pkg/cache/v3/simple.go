@@ -21,8 +21,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/log"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
@@ -90,6 +94,11 @@ type SnapshotCache interface {
 	GetStatusKeys() []string
 }
 
+var _ ResourceUpdater = &snapshotCache{}
+var _ SnapshotHistory = &snapshotCache{}
+var _ ResponseTracker = &snapshotCache{}
+var _ Observable = &snapshotCache{}
+
 type snapshotCache struct {
 	// watchCount and deltaWatchCount are atomic counters incremented for each watch respectively. They need to
 	// be the first fields in the struct to guarantee 64-bit alignment,
@@ -103,18 +112,118 @@ type snapshotCache struct {
 	// ads flag to hold responses until all resources are named
 	ads bool
 
+	// shards hold the snapshots and status of the nodes, partitioned by node ID
+	shards [snapshotCacheShards]nodeShard
+
+	// hash is the hashing function for Envoy nodes
+	hash NodeHash
+
+	// store is an optional persistent backing store for snapshots
+	store SnapshotStore
+
+	// validate enables protoc-gen-validate checks of snapshot resources
+	validate bool
+
+	// eviction is an optional policy to evict idle nodes
+	eviction *idleEviction
+
+	// rollback is an optional policy to revert nodes rejecting their snapshot
+	rollback *nackRollback
+
+	// historySize is the number of snapshots retained per node
+	historySize int
+
+	// ordering optionally sequences the types of the snapshots set for a node
+	ordering *orderedUpdates
+
+	// onDemand are the types whose missing resources are replied as not found
+	onDemand map[string]bool
+
+	// observers are notified of the events of the cache
+	observers observers
+
+	// transformer optionally derives the resources served to each node
+	transformer ResourceTransformer
+
+	// missing is an optional policy for watches naming missing resources
+	missing *MissingResourcePolicy
+}
+
+// snapshotCacheShards is the number of partitions of the nodes of a snapshot cache.
+const snapshotCacheShards = 64
+
+// nodeShard holds the state of a partition of the nodes. Each shard has its own
+// lock, so that snapshots of nodes in distinct shards are set in parallel.
+type nodeShard struct {
 	// snapshots are cached resources indexed by node IDs
 	snapshots map[string]ResourceSnapshot
 
 	// status information for all nodes indexed by node IDs
 	status map[string]*statusInfo
 
-	// hash is the hashing function for Envoy nodes
-	hash NodeHash
+	// lastGood are the last snapshots fully accepted by the nodes, if rollback is enabled
+	lastGood map[string]ResourceSnapshot
+
+	// history holds the last snapshots of the nodes, if enabled
+	history map[string]*snapshotHistory
+
+	// transformed are the snapshots served to the nodes, if a transformer is set
+	transformed map[string]*transformedSnapshot
+	transformMu sync.Mutex
+
+	// writeMu serializes the snapshot writes of the shard, so that snapshots
+	// are persisted in the order they are set without holding mu meanwhile
+	writeMu sync.Mutex
 
 	mu sync.RWMutex
 }
 
+// shard returns the shard of a node, selected with the FNV-1a hash of its ID.
+func (cache *snapshotCache) shard(node string) *nodeShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(node); i++ {
+		h ^= uint32(node[i])
+		h *= 16777619
+	}
+	return &cache.shards[h%snapshotCacheShards]
+}
+
+// SnapshotCacheOption is used to modify the behavior of the snapshot cache.
+type SnapshotCacheOption func(*snapshotCache)
+
+// WithSnapshotStore writes every snapshot through to the provided store, and
+// initializes the cache with the snapshots found in the store. This allows a
+// restarted control plane to answer reconnecting clients with the last known
+// config and versions right away.
+func WithSnapshotStore(store SnapshotStore) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.store = store
+	}
+}
+
+// WithSnapshotValidation runs the protoc-gen-validate rules of every resource
+// when a snapshot is set. A snapshot with invalid resources is rejected with
+// ValidationErrors listing all of them, and the cache is left untouched.
+func WithSnapshotValidation() SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.validate = true
+	}
+}
+
+// WithOnDemandTypes replies explicitly to delta subscriptions of the given
+// types naming missing resources, as expected by on-demand discovery: VHDS
+// aliases are replied without a resource, and other names as removed.
+func WithOnDemandTypes(typeURLs ...string) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		if cache.onDemand == nil {
+			cache.onDemand = make(map[string]bool, len(typeURLs))
+		}
+		for _, typeURL := range typeURLs {
+			cache.onDemand[typeURL] = true
+		}
+	}
+}
+
 // NewSnapshotCache initializes a simple cache.
 //
 // ADS flag forces a delay in responding to streaming requests until all
@@ -126,21 +235,43 @@ type snapshotCache struct {
 // is OK.
 //
 // Logger is optional.
-func NewSnapshotCache(ads bool, hash NodeHash, logger log.Logger) SnapshotCache {
-	return newSnapshotCache(ads, hash, logger)
+func NewSnapshotCache(ads bool, hash NodeHash, logger log.Logger, opts ...SnapshotCacheOption) SnapshotCache {
+	return newSnapshotCache(ads, hash, logger, opts...)
 }
 
-func newSnapshotCache(ads bool, hash NodeHash, logger log.Logger) *snapshotCache {
+func newSnapshotCache(ads bool, hash NodeHash, logger log.Logger, opts ...SnapshotCacheOption) *snapshotCache {
 	if logger == nil {
 		logger = log.NewDefaultLogger()
 	}
 
 	cache := &snapshotCache{
-		log:       logger,
-		ads:       ads,
-		snapshots: make(map[string]ResourceSnapshot),
-		status:    make(map[string]*statusInfo),
-		hash:      hash,
+		log:  logger,
+		ads:  ads,
+		hash: hash,
+	}
+	for i := range cache.shards {
+		cache.shards[i].snapshots = make(map[string]ResourceSnapshot)
+		cache.shards[i].status = make(map[string]*statusInfo)
+		cache.shards[i].lastGood = make(map[string]ResourceSnapshot)
+		cache.shards[i].history = make(map[string]*snapshotHistory)
+		cache.shards[i].transformed = make(map[string]*transformedSnapshot)
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+
+	if cache.store != nil {
+		snapshots, err := cache.store.Load()
+		if err != nil {
+			cache.log.Errorf("failed to load snapshots from store: %v", err)
+		}
+		for node, snapshot := range snapshots {
+			cache.shard(node).snapshots[node] = snapshot
+		}
+	}
+
+	if cache.eviction != nil {
+		go cache.runIdleEviction(cache.eviction.ctx, cache.eviction.policy)
 	}
 
 	return cache
@@ -161,20 +292,23 @@ func newSnapshotCache(ads bool, hash NodeHash, logger log.Logger) *snapshotCache
 //
 // The context provides a way to cancel the heartbeating routine, while the heartbeatInterval
 // parameter controls how often heartbeating occurs.
-func NewSnapshotCacheWithHeartbeating(ctx context.Context, ads bool, hash NodeHash, logger log.Logger, heartbeatInterval time.Duration) SnapshotCache {
-	cache := newSnapshotCache(ads, hash, logger)
+func NewSnapshotCacheWithHeartbeating(ctx context.Context, ads bool, hash NodeHash, logger log.Logger, heartbeatInterval time.Duration, opts ...SnapshotCacheOption) SnapshotCache {
+	cache := newSnapshotCache(ads, hash, logger, opts...)
 	go func() {
 		t := time.NewTicker(heartbeatInterval)
 
 		for {
 			select {
 			case <-t.C:
-				cache.mu.Lock()
-				for node := range cache.status {
-					// TODO(snowp): Omit heartbeats if a real response has been sent recently.
-					cache.sendHeartbeats(ctx, node)
+				for i := range cache.shards {
+					shard := &cache.shards[i]
+					shard.mu.Lock()
+					for node := range shard.status {
+						// TODO(snowp): Omit heartbeats if a real response has been sent recently.
+						cache.sendHeartbeats(ctx, shard, node)
+					}
+					shard.mu.Unlock()
 				}
-				cache.mu.Unlock()
 			case <-ctx.Done():
 				return
 			}
@@ -183,20 +317,22 @@ func NewSnapshotCacheWithHeartbeating(ctx context.Context, ads bool, hash NodeHa
 	return cache
 }
 
-func (cache *snapshotCache) sendHeartbeats(ctx context.Context, node string) {
-	snapshot, ok := cache.snapshots[node]
+// sendHeartbeats responds to the watches of a node with its resources having a TTL.
+// The shard of the node must be locked.
+func (cache *snapshotCache) sendHeartbeats(ctx context.Context, shard *nodeShard, node string) {
+	snapshot, ok := shard.snapshots[node]
 	if !ok {
 		return
 	}
 
-	if info, ok := cache.status[node]; ok {
+	if info, ok := shard.status[node]; ok {
+		snapshot = cache.nodeSnapshot(shard, node, info.node, snapshot)
 		info.mu.Lock()
-		for id, watch := range info.watches {
+		for typeURL, watches := range info.watches {
 			// Respond with the current version regardless of whether the version has changed.
-			version := snapshot.GetVersion(watch.Request.TypeUrl)
-			resources := snapshot.GetResourcesAndTTL(watch.Request.TypeUrl)
+			version := snapshot.GetVersion(typeURL)
+			resources := snapshot.GetResourcesAndTTL(typeURL)
 
-			// TODO(snowp): Construct this once per type instead of once per watch.
 			resourcesWithTTL := map[string]types.ResourceWithTTL{}
 			for k, v := range resources {
 				if v.TTL != nil {
@@ -207,14 +343,21 @@ func (cache *snapshotCache) sendHeartbeats(ctx context.Context, node string) {
 			if len(resourcesWithTTL) == 0 {
 				continue
 			}
-			cache.log.Debugf("respond open watch %d%v with heartbeat for version %q", id, watch.Request.ResourceNames, version)
-			err := cache.respond(ctx, watch.Request, watch.Response, resourcesWithTTL, version, true)
-			if err != nil {
-				cache.log.Errorf("received error when attempting to respond to watches: %v", err)
+			for id, watch := range watches {
+				cache.log.Debugf("respond open watch %d%v with heartbeat for version %q", id, watch.Request.ResourceNames, version)
+				err := cache.respond(ctx, watch.Request, watch.Response, getMarshalCache(snapshot), resourcesWithTTL, version, true)
+				if err != nil {
+					cache.log.Errorf("received error when attempting to respond to watches: %v", err)
+				}
 			}
 
-			// The watch must be deleted and we must rely on the client to ack this response to create a new watch.
-			delete(info.watches, id)
+			// The watches must be deleted and we must rely on the client to ack this response to create a new watch.
+			for id := range watches {
+				info.stopMissingTimer(id)
+				cache.observers.publish(Event{Kind: WatchClosed, Node: node, TypeURL: typeURL, WatchID: id})
+			}
+			delete(info.watches, typeURL)
+			info.lastWatchCloseTime = time.Now()
 		}
 		info.mu.Unlock()
 	}
@@ -222,71 +365,186 @@ func (cache *snapshotCache) sendHeartbeats(ctx context.Context, node string) {
 
 // SetSnapshotCacheContext updates a snapshot for a node.
 func (cache *snapshotCache) SetSnapshot(ctx context.Context, node string, snapshot ResourceSnapshot) error {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
+	if cache.validate {
+		if err := ValidateSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+	if cache.ordering != nil {
+		return cache.setOrderedSnapshot(ctx, node, snapshot)
+	}
+	return cache.setSnapshot(ctx, node, snapshot)
+}
+
+// setSnapshot updates a snapshot for a node without validating it.
+func (cache *snapshotCache) setSnapshot(ctx context.Context, node string, snapshot ResourceSnapshot) error {
+	shard := cache.shard(node)
+	shard.writeMu.Lock()
+	defer shard.writeMu.Unlock()
+
+	// persist the snapshot before it becomes visible to watches
+	if err := cache.persist(node, snapshot); err != nil {
+		return err
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return cache.applySnapshot(ctx, shard, node, snapshot, nil)
+}
+
+// persist writes the snapshot of a node through to the store, if any.
+// Intermediate snapshots of ordered updates are not persisted. The write lock
+// of the shard must be held, but not its mutex, so that watches are not
+// blocked while the snapshot is written.
+func (cache *snapshotCache) persist(node string, snapshot ResourceSnapshot) error {
+	if cache.store == nil {
+		return nil
+	}
+	if _, staged := snapshot.(*stagedSnapshot); staged {
+		return nil
+	}
+	if err := cache.store.Store(node, snapshot); err != nil {
+		return fmt.Errorf("failed to persist snapshot for node %q: %w", node, err)
+	}
+	return nil
+}
+
+// applySnapshot updates the snapshot of a node and responds to its watches. If
+// the snapshot results from a partial update, only the watches of the changed
+// resources are evaluated. The shard must be locked, and the snapshot persisted.
+func (cache *snapshotCache) applySnapshot(ctx context.Context, shard *nodeShard, node string, snapshot ResourceSnapshot, patch *resourcePatch) error {
+	// intermediate snapshots of ordered updates are neither persisted nor recorded
+	_, staged := snapshot.(*stagedSnapshot)
 
 	// update the existing entry
-	cache.snapshots[node] = snapshot
+	previous, hasPrevious := shard.snapshots[node]
+	shard.snapshots[node] = snapshot
+
+	if cache.historySize > 0 && !staged {
+		metadata, _ := snapshotMetadataFromContext(ctx)
+		cache.record(shard, node, snapshot, metadata)
+	}
+	cache.observers.publish(Event{Kind: SnapshotSet, Node: node, Snapshot: snapshot})
 
 	// trigger existing watches for which version changed
-	if info, ok := cache.status[node]; ok {
+	if info, ok := shard.status[node]; ok {
+		served := cache.nodeSnapshot(shard, node, info.node, snapshot)
+
 		info.mu.Lock()
 		defer info.mu.Unlock()
-		for id, watch := range info.watches {
-			version := snapshot.GetVersion(watch.Request.TypeUrl)
-			if version != watch.Request.VersionInfo {
-				cache.log.Debugf("respond open watch %d %s%v with new version %q", id, watch.Request.TypeUrl, watch.Request.ResourceNames, version)
 
-				resources := snapshot.GetResourcesAndTTL(watch.Request.TypeUrl)
-				err := cache.respond(ctx, watch.Request, watch.Response, resources, version, false)
+		// Open watches are up to date with the previous snapshot, unless it
+		// failed to be delivered to them. In that case, all watches are evaluated.
+		upToDate := hasPrevious && !info.undelivered
+		info.undelivered = true
+
+		for typeURL, watches := range info.watches {
+			version := snapshot.GetVersion(typeURL)
+
+			// The watches of a type are only evaluated if its version changed.
+			if upToDate && previous.GetVersion(typeURL) == version {
+				continue
+			}
+
+			var resources map[string]types.ResourceWithTTL
+			for id, watch := range watches {
+				if version == watch.Request.VersionInfo {
+					continue
+				}
+				if upToDate && patch != nil && !patch.watchedBy(watch.Request) {
+					continue
+				}
+				cache.log.Debugf("respond open watch %d %s%v with new version %q", id, typeURL, watch.Request.ResourceNames, version)
+
+				if resources == nil {
+					resources = served.GetResourcesAndTTL(typeURL)
+				}
+				err := cache.respond(ctx, watch.Request, watch.Response, getMarshalCache(served), resources, version, false)
 				if err != nil {
 					return err
 				}
 
 				// discard the watch
-				delete(info.watches, id)
+				delete(watches, id)
+				info.stopMissingTimer(id)
+				info.lastWatchCloseTime = time.Now()
+				cache.observers.publish(Event{Kind: WatchClosed, Node: node, TypeURL: typeURL, WatchID: id})
 			}
+			if len(watches) == 0 {
+				delete(info.watches, typeURL)
+			}
+		}
+
+		// forget the missing resources which are now set
+		for typeURL := range info.missing {
+			info.refreshMissing(typeURL, served.GetResourcesAndTTL(typeURL), time.Now(), true)
 		}
 
 		// We only calculate version hashes when using delta. We don't
 		// want to do this when using SOTW so we can avoid unnecessary
 		// computational cost if not using delta.
 		if len(info.deltaWatches) > 0 {
-			err := snapshot.ConstructVersionMap()
+			err := served.ConstructVersionMap()
 			if err != nil {
 				return err
 			}
 		}
 
 		// process our delta watches
-		for id, watch := range info.deltaWatches {
-			res, err := cache.respondDelta(
-				ctx,
-				snapshot,
-				watch.Request,
-				watch.Response,
-				watch.StreamState,
-			)
-			if err != nil {
-				return err
+		var triggers map[string]struct{}
+		if upToDate && patch != nil {
+			triggers = patch.triggers(previous, snapshot)
+		}
+		for typeURL, watches := range info.deltaWatches {
+			if triggers != nil && typeURL != patch.typeURL {
+				continue
+			}
+			for id, watch := range watches {
+				if triggers != nil && !watch.StreamState.WatchesResources(triggers) {
+					continue
+				}
+				res, err := cache.respondDelta(
+					ctx,
+					served,
+					watch.Request,
+					watch.Response,
+					watch.StreamState,
+				)
+				if err != nil {
+					return err
+				}
+				// If we detect a nil response here, that means there has been no state change
+				// so we don't want to respond or remove any existing resource watches
+				if res != nil {
+					delete(watches, id)
+					info.lastWatchCloseTime = time.Now()
+					cache.observers.publish(Event{Kind: WatchClosed, Node: node, TypeURL: typeURL, WatchID: id, Delta: true})
+				}
 			}
-			// If we detect a nil response here, that means there has been no state change
-			// so we don't want to respond or remove any existing resource watches
-			if res != nil {
-				delete(info.deltaWatches, id)
+			if len(watches) == 0 {
+				delete(info.deltaWatches, typeURL)
 			}
 		}
+
+		info.undelivered = false
 	}
 
 	return nil
 }
 
+// AddObserver registers an observer of the watches, responses and snapshots of the cache.
+func (cache *snapshotCache) AddObserver(observer Observer) func() {
+	return cache.observers.add(observer)
+}
+
 // GetSnapshots gets the snapshot for a node, and returns an error if not found.
 func (cache *snapshotCache) GetSnapshot(node string) (ResourceSnapshot, error) {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
+	shard := cache.shard(node)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	snap, ok := cache.snapshots[node]
+	snap, ok := shard.snapshots[node]
 	if !ok {
 		return nil, fmt.Errorf("no snapshot found for node %s", node)
 	}
@@ -295,20 +553,28 @@ func (cache *snapshotCache) GetSnapshot(node string) (ResourceSnapshot, error) {
 
 // ClearSnapshot clears snapshot and info for a node.
 func (cache *snapshotCache) ClearSnapshot(node string) {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
+	cache.ordering.forgetSequence(node)
 
-	delete(cache.snapshots, node)
-	delete(cache.status, node)
-}
+	shard := cache.shard(node)
+	shard.writeMu.Lock()
+	defer shard.writeMu.Unlock()
 
-// nameSet creates a map from a string slice to value true.
-func nameSet(names []string) map[string]bool {
-	set := make(map[string]bool, len(names))
-	for _, name := range names {
-		set[name] = true
+	shard.mu.Lock()
+	if info, ok := shard.status[node]; ok {
+		info.closeWatches(node, &cache.observers)
+	}
+	delete(shard.snapshots, node)
+	delete(shard.status, node)
+	delete(shard.lastGood, node)
+	delete(shard.history, node)
+	shard.forgetTransformed(node)
+	shard.mu.Unlock()
+
+	if cache.store != nil {
+		if err := cache.store.Delete(node); err != nil {
+			cache.log.Errorf("failed to delete snapshot for node %q from store: %v", node, err)
+		}
 	}
-	return set
 }
 
 // superset checks that all resources are listed in the names set.
@@ -325,13 +591,14 @@ func superset(names map[string]bool, resources map[string]types.ResourceWithTTL)
 func (cache *snapshotCache) CreateWatch(request *Request, streamState stream.StreamState, value chan Response) func() {
 	nodeID := cache.hash.ID(request.Node)
 
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
+	shard := cache.shard(nodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	info, ok := cache.status[nodeID]
+	info, ok := shard.status[nodeID]
 	if !ok {
 		info = newStatusInfo(request.Node)
-		cache.status[nodeID] = info
+		shard.status[nodeID] = info
 	}
 
 	// update last watch request time
@@ -341,8 +608,9 @@ func (cache *snapshotCache) CreateWatch(request *Request, streamState stream.Str
 
 	var version string
 
-	snapshot, exists := cache.snapshots[nodeID]
+	snapshot, exists := shard.snapshots[nodeID]
 	if exists {
+		snapshot = cache.nodeSnapshot(shard, nodeID, request.Node, snapshot)
 		version = snapshot.GetVersion(request.TypeUrl)
 	}
 
@@ -361,8 +629,9 @@ func (cache *snapshotCache) CreateWatch(request *Request, streamState stream.Str
 		if len(diff) > 0 {
 			resources := snapshot.GetResourcesAndTTL(request.TypeUrl)
 			for _, name := range diff {
-				if _, exists := resources[name]; exists {
-					if err := cache.respond(context.Background(), request, value, resources, version, false); err != nil {
+				// with a missing resource policy, the resources which exist are sent right away
+				if _, exists := resources[name]; exists || cache.missing != nil {
+					if err := cache.respond(context.Background(), request, value, getMarshalCache(snapshot), resources, version, false); err != nil {
 						cache.log.Errorf("failed to send a response for %s%v to nodeID %q: %s", request.TypeUrl,
 							request.ResourceNames, nodeID, err)
 					}
@@ -376,15 +645,24 @@ func (cache *snapshotCache) CreateWatch(request *Request, streamState stream.Str
 	if !exists || request.VersionInfo == version {
 		watchID := cache.nextWatchID()
 		cache.log.Debugf("open watch %d for %s%v from nodeID %q, version %q", watchID, request.TypeUrl, request.ResourceNames, nodeID, request.VersionInfo)
-		info.mu.Lock()
-		info.watches[watchID] = ResponseWatch{Request: request, Response: value}
-		info.mu.Unlock()
-		return cache.cancelWatch(nodeID, watchID)
+		info.setResponseWatch(watchID, ResponseWatch{Request: request, Response: value})
+		cache.observers.publish(Event{
+			Kind:          WatchOpened,
+			Node:          nodeID,
+			TypeURL:       request.TypeUrl,
+			WatchID:       watchID,
+			Version:       request.VersionInfo,
+			ResourceNames: request.ResourceNames,
+		})
+		if exists && cache.missing != nil && len(request.ResourceNames) != 0 {
+			cache.trackMissing(info, nodeID, watchID, request, snapshot)
+		}
+		return cache.cancelWatch(nodeID, request.TypeUrl, watchID)
 	}
 
 	// otherwise, the watch may be responded immediately
 	resources := snapshot.GetResourcesAndTTL(request.TypeUrl)
-	if err := cache.respond(context.Background(), request, value, resources, version, false); err != nil {
+	if err := cache.respond(context.Background(), request, value, getMarshalCache(snapshot), resources, version, false); err != nil {
 		cache.log.Errorf("failed to send a response for %s%v to nodeID %q: %s", request.TypeUrl,
 			request.ResourceNames, nodeID, err)
 	}
@@ -397,26 +675,25 @@ func (cache *snapshotCache) nextWatchID() int64 {
 }
 
 // cancellation function for cleaning stale watches
-func (cache *snapshotCache) cancelWatch(nodeID string, watchID int64) func() {
+func (cache *snapshotCache) cancelWatch(nodeID, typeURL string, watchID int64) func() {
 	return func() {
-		// uses the cache mutex
-		cache.mu.RLock()
-		defer cache.mu.RUnlock()
-		if info, ok := cache.status[nodeID]; ok {
-			info.mu.Lock()
-			delete(info.watches, watchID)
-			info.mu.Unlock()
+		// uses the shard mutex
+		shard := cache.shard(nodeID)
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		if info, ok := shard.status[nodeID]; ok && info.deleteResponseWatch(typeURL, watchID) {
+			cache.observers.publish(Event{Kind: WatchClosed, Node: nodeID, TypeURL: typeURL, WatchID: watchID})
 		}
 	}
 }
 
 // Respond to a watch with the snapshot value. The value channel should have capacity not to block.
 // TODO(kuat) do not respond always, see issue https://github.com/envoyproxy/go-control-plane/issues/46
-func (cache *snapshotCache) respond(ctx context.Context, request *Request, value chan Response, resources map[string]types.ResourceWithTTL, version string, heartbeat bool) error {
+func (cache *snapshotCache) respond(ctx context.Context, request *Request, value chan Response, marshaler *marshalCache, resources map[string]types.ResourceWithTTL, version string, heartbeat bool) error {
 	// for ADS, the request names must match the snapshot names
 	// if they do not, then the watch is never responded, and it is expected that envoy makes another request
-	if len(request.ResourceNames) != 0 && cache.ads {
-		if err := superset(nameSet(request.ResourceNames), resources); err != nil {
+	if len(request.ResourceNames) != 0 && cache.ads && cache.missing == nil {
+		if err := newNameMatcher(request.ResourceNames).superset(resources); err != nil {
 			cache.log.Warnf("ADS mode: not responding to request: %v", err)
 			return nil
 		}
@@ -424,24 +701,34 @@ func (cache *snapshotCache) respond(ctx context.Context, request *Request, value
 
 	cache.log.Debugf("respond %s%v version %q with version %q", request.TypeUrl, request.ResourceNames, request.VersionInfo, version)
 
+	resp := createResponse(ctx, request, marshaler, resources, version, heartbeat)
 	select {
-	case value <- createResponse(ctx, request, resources, version, heartbeat):
+	case value <- resp:
+		if cache.observers.active() {
+			cache.observers.publish(Event{
+				Kind:          ResponseSent,
+				Node:          cache.hash.ID(request.Node),
+				TypeURL:       request.TypeUrl,
+				Version:       version,
+				ResourceNames: sentNames(resp.(*RawResponse).Resources),
+			})
+		}
 		return nil
 	case <-ctx.Done():
 		return context.Canceled
 	}
 }
 
-func createResponse(ctx context.Context, request *Request, resources map[string]types.ResourceWithTTL, version string, heartbeat bool) Response {
+func createResponse(ctx context.Context, request *Request, marshaler *marshalCache, resources map[string]types.ResourceWithTTL, version string, heartbeat bool) Response {
 	filtered := make([]types.ResourceWithTTL, 0, len(resources))
 
 	// Reply only with the requested resources. Envoy may ask each resource
 	// individually in a separate stream. It is ok to reply with the same version
 	// on separate streams since requests do not share their response versions.
 	if len(request.ResourceNames) != 0 {
-		set := nameSet(request.ResourceNames)
+		matcher := newNameMatcher(request.ResourceNames)
 		for name, resource := range resources {
-			if set[name] {
+			if matcher.matches(name) {
 				filtered = append(filtered, resource)
 			}
 		}
@@ -457,6 +744,7 @@ func createResponse(ctx context.Context, request *Request, resources map[string]
 		Resources: filtered,
 		Heartbeat: heartbeat,
 		Ctx:       ctx,
+		marshaler: marshaler,
 	}
 }
 
@@ -465,20 +753,24 @@ func (cache *snapshotCache) CreateDeltaWatch(request *DeltaRequest, state stream
 	nodeID := cache.hash.ID(request.Node)
 	t := request.GetTypeUrl()
 
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
+	shard := cache.shard(nodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	info, ok := cache.status[nodeID]
+	info, ok := shard.status[nodeID]
 	if !ok {
 		info = newStatusInfo(request.Node)
-		cache.status[nodeID] = info
+		shard.status[nodeID] = info
 	}
 
 	// update last watch request time
 	info.setLastDeltaWatchRequestTime(time.Now())
 
 	// find the current cache snapshot for the provided node
-	snapshot, exists := cache.snapshots[nodeID]
+	snapshot, exists := shard.snapshots[nodeID]
+	if exists {
+		snapshot = cache.nodeSnapshot(shard, nodeID, request.Node, snapshot)
+	}
 
 	// There are three different cases that leads to a delayed watch trigger:
 	// - no snapshot exists for the requested nodeID
@@ -508,7 +800,21 @@ func (cache *snapshotCache) CreateDeltaWatch(request *DeltaRequest, state stream
 		}
 
 		info.setDeltaResponseWatch(watchID, DeltaResponseWatch{Request: request, Response: value, StreamState: state})
-		return cache.cancelDeltaWatch(nodeID, watchID)
+		if cache.observers.active() {
+			event := Event{
+				Kind:          WatchOpened,
+				Node:          nodeID,
+				TypeURL:       t,
+				WatchID:       watchID,
+				Delta:         true,
+				ResourceNames: sortedNames(state.GetSubscribedResourceNames()),
+			}
+			if exists {
+				event.Version = snapshot.GetVersion(t)
+			}
+			cache.observers.publish(event)
+		}
+		return cache.cancelDeltaWatch(nodeID, t, watchID)
 	}
 
 	return nil
@@ -516,22 +822,40 @@ func (cache *snapshotCache) CreateDeltaWatch(request *DeltaRequest, state stream
 
 // Respond to a delta watch with the provided snapshot value. If the response is nil, there has been no state change.
 func (cache *snapshotCache) respondDelta(ctx context.Context, snapshot ResourceSnapshot, request *DeltaRequest, value chan DeltaResponse, state stream.StreamState) (*RawDeltaResponse, error) {
-	resp := createDeltaResponse(ctx, request, state, resourceContainer{
+	resources := resourceContainer{
 		resourceMap:   snapshot.GetResources(request.TypeUrl),
 		versionMap:    snapshot.GetVersionMap(request.TypeUrl),
 		systemVersion: snapshot.GetVersion(request.TypeUrl),
-	})
+		marshaler:     getMarshalCache(snapshot),
+		onDemand:      cache.onDemand[request.TypeUrl],
+	}
+	// Aliases only resolve explicit subscriptions to virtual hosts.
+	if !state.IsWildcard() && request.TypeUrl == resource.VirtualHostType {
+		resources.aliases = getAliasIndex(snapshot)
+	}
+	resp := createDeltaResponse(ctx, request, state, resources)
 
 	// Only send a response if there were changes
 	// We want to respond immediately for the first wildcard request in a stream, even if the response is empty
 	// otherwise, envoy won't complete initialization
-	if len(resp.Resources) > 0 || len(resp.RemovedResources) > 0 || (state.IsWildcard() && state.IsFirst()) {
+	if len(resp.Resources) > 0 || len(resp.RemovedResources) > 0 || len(resp.NotFound) > 0 || (state.IsWildcard() && state.IsFirst()) {
 		if cache.log != nil {
 			cache.log.Debugf("node: %s, sending delta response for typeURL %s with resources: %v removed resources: %v with wildcard: %t",
 				request.GetNode().GetId(), request.TypeUrl, GetResourceNames(resp.Resources), resp.RemovedResources, state.IsWildcard())
 		}
 		select {
 		case value <- resp:
+			if cache.observers.active() {
+				cache.observers.publish(Event{
+					Kind:             ResponseSent,
+					Node:             cache.hash.ID(request.Node),
+					TypeURL:          request.TypeUrl,
+					Delta:            true,
+					Version:          resp.SystemVersionInfo,
+					ResourceNames:    GetResourceNames(resp.Resources),
+					RemovedResources: resp.RemovedResources,
+				})
+			}
 			return resp, nil
 		case <-ctx.Done():
 			return resp, context.Canceled
@@ -545,14 +869,13 @@ func (cache *snapshotCache) nextDeltaWatchID() int64 {
 }
 
 // cancellation function for cleaning stale delta watches
-func (cache *snapshotCache) cancelDeltaWatch(nodeID string, watchID int64) func() {
+func (cache *snapshotCache) cancelDeltaWatch(nodeID, typeURL string, watchID int64) func() {
 	return func() {
-		cache.mu.RLock()
-		defer cache.mu.RUnlock()
-		if info, ok := cache.status[nodeID]; ok {
-			info.mu.Lock()
-			delete(info.deltaWatches, watchID)
-			info.mu.Unlock()
+		shard := cache.shard(nodeID)
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		if info, ok := shard.status[nodeID]; ok && info.deleteDeltaResponseWatch(typeURL, watchID) {
+			cache.observers.publish(Event{Kind: WatchClosed, Node: nodeID, TypeURL: typeURL, WatchID: watchID, Delta: true})
 		}
 	}
 }
@@ -562,10 +885,12 @@ func (cache *snapshotCache) cancelDeltaWatch(nodeID string, watchID int64) func(
 func (cache *snapshotCache) Fetch(ctx context.Context, request *Request) (Response, error) {
 	nodeID := cache.hash.ID(request.Node)
 
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
+	shard := cache.shard(nodeID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	if snapshot, exists := cache.snapshots[nodeID]; exists {
+	if snapshot, exists := shard.snapshots[nodeID]; exists {
+		snapshot = cache.nodeSnapshot(shard, nodeID, request.Node, snapshot)
 		// Respond only if the request version is distinct from the current snapshot state.
 		// It might be beneficial to hold the request since Envoy will re-attempt the refresh.
 		version := snapshot.GetVersion(request.TypeUrl)
@@ -575,7 +900,7 @@ func (cache *snapshotCache) Fetch(ctx context.Context, request *Request) (Respon
 		}
 
 		resources := snapshot.GetResourcesAndTTL(request.TypeUrl)
-		out := createResponse(ctx, request, resources, version, false)
+		out := createResponse(ctx, request, getMarshalCache(snapshot), resources, version, false)
 		return out, nil
 	}
 
@@ -584,10 +909,11 @@ func (cache *snapshotCache) Fetch(ctx context.Context, request *Request) (Respon
 
 // GetStatusInfo retrieves the status info for the node.
 func (cache *snapshotCache) GetStatusInfo(node string) StatusInfo {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
+	shard := cache.shard(node)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	info, exists := cache.status[node]
+	info, exists := shard.status[node]
 	if !exists {
 		cache.log.Warnf("node does not exist")
 		return nil
@@ -598,13 +924,55 @@ func (cache *snapshotCache) GetStatusInfo(node string) StatusInfo {
 
 // GetStatusKeys retrieves all node IDs in the status map.
 func (cache *snapshotCache) GetStatusKeys() []string {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
-
-	out := make([]string, 0, len(cache.status))
-	for id := range cache.status {
-		out = append(out, id)
+	var out []string
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.mu.RLock()
+		for id := range shard.status {
+			out = append(out, id)
+		}
+		shard.mu.RUnlock()
 	}
 
 	return out
 }
+
+// OnResponseSent records the last response sent to a node.
+func (cache *snapshotCache) OnResponseSent(node *core.Node, typeURL, version, nonce string) {
+	version = cache.snapshotVersion(node, version)
+	cache.nodeStatus(node).setResponseSent(typeURL, version, nonce)
+}
+
+// OnResponseAck records whether a node accepted a response.
+func (cache *snapshotCache) OnResponseAck(node *core.Node, typeURL, version, nonce string, errorDetail *rpcstatus.Status) {
+	version = cache.snapshotVersion(node, version)
+	cache.nodeStatus(node).setResponseAck(typeURL, version, errorDetail, time.Now())
+
+	if cache.rollback != nil {
+		nodeID := cache.hash.ID(node)
+		if errorDetail == nil {
+			cache.recordAck(nodeID)
+		} else {
+			cache.handleNack(nodeID, typeURL, version, errorDetail)
+		}
+	}
+
+	if cache.ordering != nil && errorDetail == nil {
+		cache.onOrderedAck(cache.hash.ID(node), typeURL, version)
+	}
+}
+
+// nodeStatus returns the status info of a node, creating it if needed.
+func (cache *snapshotCache) nodeStatus(node *core.Node) *statusInfo {
+	nodeID := cache.hash.ID(node)
+	shard := cache.shard(nodeID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	info, ok := shard.status[nodeID]
+	if !ok {
+		info = newStatusInfo(node)
+		shard.status[nodeID] = info
+	}
+	return info
+}
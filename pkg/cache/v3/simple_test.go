@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -635,3 +636,106 @@ func TestAvertPanicForWatchOnNonExistentSnapshot(t *testing.T) {
 
 	<-responder
 }
+
+func TestSnapshotCacheWatchesByType(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+
+	snapshot := func(clusterVersion, endpointVersion string) *cache.Snapshot {
+		snap := cache.Snapshot{}
+		snap.Resources[types.Cluster] = cache.NewResources(clusterVersion, []types.Resource{testCluster})
+		snap.Resources[types.Endpoint] = cache.NewResources(endpointVersion, []types.Resource{testEndpoint})
+		return &snap
+	}
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot("1", "1")))
+
+	clusters := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, VersionInfo: "1"},
+		stream.NewStreamState(false, map[string]string{}), clusters)
+	endpoints := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.EndpointType, VersionInfo: "1"},
+		stream.NewStreamState(false, map[string]string{}), endpoints)
+	assert.Equal(t, 2, c.GetStatusInfo(key).GetNumWatches())
+
+	// Only the watches of the updated type are responded.
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot("2", "1")))
+	require.Len(t, clusters, 1)
+	version, err := (<-clusters).GetVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "2", version)
+	assert.Empty(t, endpoints)
+	assert.Equal(t, 1, c.GetStatusInfo(key).GetNumWatches())
+
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snapshot("2", "2")))
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, 0, c.GetStatusInfo(key).GetNumWatches())
+}
+
+func TestSnapshotCacheParallelNodes(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	snapshot := fixture.snapshot()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			sotw := make(chan cache.Response, 1)
+			c.CreateWatch(&discovery.DiscoveryRequest{Node: &core.Node{Id: node}, TypeUrl: rsrc.ClusterType},
+				stream.NewStreamState(false, map[string]string{}), sotw)
+			delta := make(chan cache.DeltaResponse, 1)
+			c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{Node: &core.Node{Id: node}, TypeUrl: rsrc.ClusterType},
+				stream.NewStreamState(true, map[string]string{}), delta)
+
+			// The snapshot is shared by all nodes.
+			assert.NoError(t, c.SetSnapshot(context.Background(), node, snapshot))
+			assert.Len(t, sotw, 1)
+			assert.Len(t, delta, 1)
+		}(fmt.Sprintf("node%d", i))
+	}
+	wg.Wait()
+
+	assert.Len(t, c.GetStatusKeys(), 200)
+}
+
+func BenchmarkSnapshotCacheSetSnapshot(b *testing.B) {
+	const numNodes = 10000
+
+	snapshots := make([]*cache.Snapshot, 2)
+	for i := range snapshots {
+		snapshot, err := cache.NewSnapshot(fmt.Sprintf("v%d", i), map[rsrc.Type][]types.Resource{
+			rsrc.ClusterType:  {testCluster},
+			rsrc.EndpointType: {testEndpoint},
+		})
+		require.NoError(b, err)
+		snapshots[i] = snapshot
+	}
+
+	c := cache.NewSnapshotCache(false, group{}, nil)
+	nodes := make([]string, numNodes)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("node%d", i)
+		require.NoError(b, c.SetSnapshot(context.Background(), nodes[i], snapshots[0]))
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&next, 1)
+			node := nodes[n%numNodes]
+
+			// Every node acknowledges its current version and waits for the next one.
+			current, _ := c.GetSnapshot(node)
+			value := make(chan cache.Response, 1)
+			c.CreateWatch(&discovery.DiscoveryRequest{
+				Node:        &core.Node{Id: node},
+				TypeUrl:     rsrc.ClusterType,
+				VersionInfo: current.GetVersion(rsrc.ClusterType),
+			}, stream.NewStreamState(false, map[string]string{}), value)
+
+			if err := c.SetSnapshot(context.Background(), node, snapshots[(n/numNodes)%2]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
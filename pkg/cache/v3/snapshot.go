@@ -15,8 +15,11 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
@@ -33,6 +36,25 @@ type Snapshot struct {
 	// instantiated by calling ConstructVersionMap().
 	// VersionMap is only to be used with delta xDS.
 	VersionMap map[string]map[string]string
+
+	// memo holds the state computed lazily for the responses built from the
+	// snapshot. It is only set by the constructors, and kept behind a pointer
+	// so that snapshots can be copied, the copies sharing it.
+	memo *snapshotMemo
+
+	// marshaled memoizes the marshaled resources shared by all responses
+	// built from the snapshot. It is only set by the constructors.
+	marshaled *marshalCache
+}
+
+// snapshotMemo is the state a snapshot computes lazily.
+type snapshotMemo struct {
+	// versionMapMu serializes the construction of the version map, as a
+	// snapshot may be shared by nodes whose watches are triggered in parallel.
+	versionMapMu sync.Mutex
+
+	// aliases memoizes the virtual hosts indexed by their aliases.
+	aliases aliasMemo
 }
 
 var _ ResourceSnapshot = &Snapshot{}
@@ -40,7 +62,7 @@ var _ ResourceSnapshot = &Snapshot{}
 // NewSnapshot creates a snapshot from response types and a version.
 // The resources map is keyed off the type URL of a resource, followed by the slice of resource objects.
 func NewSnapshot(version string, resources map[resource.Type][]types.Resource) (*Snapshot, error) {
-	out := Snapshot{}
+	out := Snapshot{memo: &snapshotMemo{}, marshaled: newMarshalCache()}
 
 	for typ, resource := range resources {
 		index := GetResponseType(typ)
@@ -57,7 +79,7 @@ func NewSnapshot(version string, resources map[resource.Type][]types.Resource) (
 // NewSnapshotWithTTLs creates a snapshot of ResourceWithTTLs.
 // The resources map is keyed off the type URL of a resource, followed by the slice of resource objects.
 func NewSnapshotWithTTLs(version string, resources map[resource.Type][]types.ResourceWithTTL) (*Snapshot, error) {
-	out := Snapshot{}
+	out := Snapshot{memo: &snapshotMemo{}, marshaled: newMarshalCache()}
 
 	for typ, resource := range resources {
 		index := GetResponseType(typ)
@@ -71,6 +93,84 @@ func NewSnapshotWithTTLs(version string, resources map[resource.Type][]types.Res
 	return &out, nil
 }
 
+// NewSnapshotFromContent creates a snapshot whose per-type versions are derived
+// from a deterministic hash of the resources of each type. A type with the
+// same resources keeps its version, so setting a snapshot with unchanged
+// content does not trigger any response.
+// The resources map is keyed off the type URL of a resource, followed by the slice of resource objects.
+func NewSnapshotFromContent(resources map[resource.Type][]types.Resource) (*Snapshot, error) {
+	withTTL := make(map[resource.Type][]types.ResourceWithTTL, len(resources))
+	for typ, items := range resources {
+		withTTL[typ] = make([]types.ResourceWithTTL, 0, len(items))
+		for _, item := range items {
+			withTTL[typ] = append(withTTL[typ], types.ResourceWithTTL{Resource: item})
+		}
+	}
+	return NewSnapshotFromContentWithTTLs(withTTL)
+}
+
+// NewSnapshotFromContentWithTTLs creates a snapshot of ResourceWithTTLs whose
+// per-type versions are derived from a deterministic hash of the resources of
+// each type, including their TTLs. The version map used for delta xDS is
+// computed along the way.
+func NewSnapshotFromContentWithTTLs(resources map[resource.Type][]types.ResourceWithTTL) (*Snapshot, error) {
+	out := Snapshot{
+		VersionMap: make(map[string]map[string]string),
+		memo:       &snapshotMemo{},
+		marshaled:  newMarshalCache(),
+	}
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			return nil, err
+		}
+		out.VersionMap[typeURL] = make(map[string]string)
+	}
+
+	for typ, items := range resources {
+		index := GetResponseType(typ)
+		if index == types.UnknownType {
+			return nil, errors.New("unknown resource type: " + typ)
+		}
+
+		indexed := IndexResourcesByName(items)
+		versions := out.VersionMap[typ]
+		for name, item := range indexed {
+			marshaledResource, err := out.marshaled.marshal(typ, item.Resource)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %s resource %q: %w", typ, name, err)
+			}
+			versions[name] = marshaledResource.version()
+		}
+
+		out.Resources[index] = Resources{
+			Version: contentVersion(indexed, versions),
+			Items:   indexed,
+		}
+	}
+
+	return &out, nil
+}
+
+// contentVersion hashes the names, resource hashes and TTLs of a set of resources in name order.
+func contentVersion(items map[string]types.ResourceWithTTL, versions map[string]string) string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s\x00%s", name, versions[name])
+		if ttl := items[name].TTL; ttl != nil {
+			fmt.Fprintf(&b, "\x00%d", *ttl)
+		}
+		b.WriteByte('\n')
+	}
+	return HashResource(b.Bytes())
+}
+
 // Consistent check verifies that the dependent resources are exactly listed in the
 // snapshot:
 // - all EDS resources are listed by name in CDS resources
@@ -172,36 +272,56 @@ func (s *Snapshot) ConstructVersionMap() error {
 		return fmt.Errorf("missing snapshot")
 	}
 
+	if s.memo != nil {
+		s.memo.versionMapMu.Lock()
+		defer s.memo.versionMapMu.Unlock()
+	}
+
 	// The snapshot resources never change, so no need to ever rebuild.
 	if s.VersionMap != nil {
 		return nil
 	}
 
-	s.VersionMap = make(map[string]map[string]string)
+	versionMap := make(map[string]map[string]string)
 
 	for i, resources := range s.Resources {
 		typeURL, err := GetResponseTypeURL(types.ResponseType(i))
 		if err != nil {
 			return err
 		}
-		if _, ok := s.VersionMap[typeURL]; !ok {
-			s.VersionMap[typeURL] = make(map[string]string)
+		if _, ok := versionMap[typeURL]; !ok {
+			versionMap[typeURL] = make(map[string]string)
 		}
 
 		for _, r := range resources.Items {
 			// Hash our version in here and build the version map.
-			marshaledResource, err := MarshalResource(r.Resource)
+			marshaledResource, err := s.marshaled.marshal(typeURL, r.Resource)
 			if err != nil {
 				return err
 			}
-			v := HashResource(marshaledResource)
+			v := marshaledResource.version()
 			if v == "" {
 				return fmt.Errorf("failed to build resource version: %w", err)
 			}
 
-			s.VersionMap[typeURL][GetResourceName(r.Resource)] = v
+			versionMap[typeURL][GetResourceName(r.Resource)] = v
 		}
 	}
 
+	s.VersionMap = versionMap
 	return nil
 }
+
+func (s *Snapshot) getAliasIndex() map[string]string {
+	if s.memo == nil {
+		return aliasIndex(s.GetResources(resource.VirtualHostType))
+	}
+	return s.memo.aliases.get(s)
+}
+
+func (s *Snapshot) getMarshalCache() *marshalCache {
+	if s == nil {
+		return nil
+	}
+	return s.marshaled
+}
@@ -15,7 +15,9 @@
 package cache_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -182,6 +184,20 @@ func TestSnapshotGetters(t *testing.T) {
 	}
 }
 
+func TestSnapshotCopy(t *testing.T) {
+	snapshot := fixture.snapshot()
+
+	// Snapshots are copied by value, and the copies are served alike.
+	copied := *snapshot
+	require.NoError(t, copied.ConstructVersionMap())
+	require.NoError(t, snapshot.ConstructVersionMap())
+	assert.Equal(t, snapshot.GetVersionMap(rsrc.ClusterType), copied.GetVersionMap(rsrc.ClusterType))
+
+	literal := cache.Snapshot{Resources: snapshot.Resources}
+	require.NoError(t, literal.ConstructVersionMap())
+	assert.Equal(t, snapshot.GetVersionMap(rsrc.ClusterType), literal.GetVersionMap(rsrc.ClusterType))
+}
+
 func TestNewSnapshotBadType(t *testing.T) {
 	snap, err := cache.NewSnapshot(fixture.version, map[rsrc.Type][]types.Resource{
 		"random.type": nil,
@@ -191,3 +207,71 @@ func TestNewSnapshotBadType(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, snap)
 }
+
+func TestNewSnapshotFromContent(t *testing.T) {
+	snap1, err := cache.NewSnapshotFromContent(map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {testCluster, resource.MakeCluster(resource.Ads, "other")},
+		rsrc.EndpointType: {testEndpoint},
+	})
+	require.NoError(t, err)
+	snap2, err := cache.NewSnapshotFromContent(map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {resource.MakeCluster(resource.Ads, "other"), resource.MakeCluster(resource.Ads, clusterName)},
+		rsrc.EndpointType: {resource.MakeEndpoint(clusterName, 9090)},
+	})
+	require.NoError(t, err)
+
+	// Versions only depend on the content, not on the order of the resources.
+	assert.NotEmpty(t, snap1.GetVersion(rsrc.ClusterType))
+	assert.Equal(t, snap1.GetVersion(rsrc.ClusterType), snap2.GetVersion(rsrc.ClusterType))
+	assert.NotEqual(t, snap1.GetVersion(rsrc.EndpointType), snap2.GetVersion(rsrc.EndpointType))
+	assert.Empty(t, snap1.GetVersion(rsrc.ListenerType))
+
+	// The version map is filled in with the same hashes as ConstructVersionMap.
+	expected, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {testCluster, resource.MakeCluster(resource.Ads, "other")},
+		rsrc.EndpointType: {testEndpoint},
+	})
+	require.NoError(t, err)
+	require.NoError(t, expected.ConstructVersionMap())
+	assert.Equal(t, expected.VersionMap, snap1.VersionMap)
+
+	_, err = cache.NewSnapshotFromContent(map[rsrc.Type][]types.Resource{"random.type": nil})
+	assert.Error(t, err)
+}
+
+func TestNewSnapshotFromContentTTL(t *testing.T) {
+	ttl := 2 * time.Second
+	snap1, err := cache.NewSnapshotFromContentWithTTLs(map[rsrc.Type][]types.ResourceWithTTL{
+		rsrc.EndpointType: {{Resource: testEndpoint}},
+	})
+	require.NoError(t, err)
+	snap2, err := cache.NewSnapshotFromContentWithTTLs(map[rsrc.Type][]types.ResourceWithTTL{
+		rsrc.EndpointType: {{Resource: testEndpoint, TTL: &ttl}},
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, snap1.GetVersion(rsrc.EndpointType), snap2.GetVersion(rsrc.EndpointType))
+}
+
+func TestSetSnapshotFromContentWithoutChanges(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	content := map[rsrc.Type][]types.Resource{rsrc.ClusterType: {testCluster}}
+	snap, err := cache.NewSnapshotFromContent(content)
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snap))
+
+	watch := openClusterWatch(c, nil, snap.GetVersion(rsrc.ClusterType))
+
+	// Identical content produces the same version, so the watch is not triggered.
+	snap, err = cache.NewSnapshotFromContent(content)
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snap))
+	assert.Empty(t, watch)
+
+	snap, err = cache.NewSnapshotFromContent(map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {testCluster, resource.MakeCluster(resource.Ads, "other")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), key, snap))
+	_, names := receiveClusters(t, watch)
+	assert.ElementsMatch(t, []string{clusterName, "other"}, names)
+}
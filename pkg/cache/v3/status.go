@@ -18,7 +18,10 @@ import (
 	"sync"
 	"time"
 
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
@@ -57,6 +60,38 @@ type StatusInfo interface {
 
 	// GetLastDeltaWatchRequestTime returns the timestamp of the last delta discovery watch request.
 	GetLastDeltaWatchRequestTime() time.Time
+
+	// GetTypeStatus returns the responses sent to the node for a type URL,
+	// and whether the node accepted them.
+	GetTypeStatus(typeURL string) TypeStatus
+
+	// GetMissingResources returns the names requested by the watches of the
+	// node for a type URL which are missing from its snapshot, with the time
+	// they went missing. They are only tracked with WithMissingResourcePolicy.
+	GetMissingResources(typeURL string) map[string]time.Time
+}
+
+// TypeStatus is the xDS state of a node for a type URL, as reported by the
+// servers to a ResponseTracker.
+type TypeStatus struct {
+	// SentVersion and SentNonce identify the last response sent to the node.
+	SentVersion string
+	SentNonce   string
+
+	// AckedVersion is the last version accepted by the node.
+	AckedVersion string
+	AckTime      time.Time
+
+	// NackedVersion is the last version rejected by the node, with the reason of the rejection.
+	NackedVersion string
+	NackDetail    *rpcstatus.Status
+	NackTime      time.Time
+}
+
+// IsNacking returns whether the node rejected the last version it received
+// since it last accepted one.
+func (s TypeStatus) IsNacking() bool {
+	return !s.NackTime.IsZero() && !s.NackTime.Before(s.AckTime)
 }
 
 // statusInfo tracks the server state for the remote Envoy node.
@@ -64,11 +99,16 @@ type statusInfo struct {
 	// node is the constant Envoy node metadata.
 	node *core.Node
 
-	// watches are indexed channels for the response watches and the original requests.
-	watches map[int64]ResponseWatch
+	// watches are indexed channels for the response watches and the original requests,
+	// grouped by the requested type URL.
+	watches map[string]map[int64]ResponseWatch
+
+	// deltaWatches are indexed channels for the delta response watches and the original requests,
+	// grouped by the requested type URL.
+	deltaWatches map[string]map[int64]DeltaResponseWatch
 
-	// deltaWatches are indexed channels for the delta response watches and the original requests
-	deltaWatches map[int64]DeltaResponseWatch
+	// undelivered is set while a snapshot is not delivered to all the open watches
+	undelivered bool
 
 	// the timestamp of the last watch request
 	lastWatchRequestTime time.Time
@@ -76,6 +116,20 @@ type statusInfo struct {
 	// the timestamp of the last delta watch request
 	lastDeltaWatchRequestTime time.Time
 
+	// the timestamp of the last response or cancellation closing a watch
+	lastWatchCloseTime time.Time
+
+	// types holds the ACK/NACK state of the node by type URL
+	types map[string]TypeStatus
+
+	// missing holds the resources missing for the open watches by type URL,
+	// with the time they went missing
+	missing map[string]map[string]time.Time
+
+	// missingTimers fail the open watches still missing resources after the
+	// timeout of the missing resource policy, by watch ID
+	missingTimers map[int64]*time.Timer
+
 	// mutex to protect the status fields.
 	// should not acquire mutex of the parent cache after acquiring this mutex.
 	mu sync.RWMutex
@@ -105,9 +159,12 @@ type DeltaResponseWatch struct {
 // newStatusInfo initializes a status info data structure.
 func newStatusInfo(node *core.Node) *statusInfo {
 	out := statusInfo{
-		node:         node,
-		watches:      make(map[int64]ResponseWatch),
-		deltaWatches: make(map[int64]DeltaResponseWatch),
+		node:          node,
+		watches:       make(map[string]map[int64]ResponseWatch),
+		deltaWatches:  make(map[string]map[int64]DeltaResponseWatch),
+		types:         make(map[string]TypeStatus),
+		missing:       make(map[string]map[string]time.Time),
+		missingTimers: make(map[int64]*time.Timer),
 	}
 	return &out
 }
@@ -121,13 +178,21 @@ func (info *statusInfo) GetNode() *core.Node {
 func (info *statusInfo) GetNumWatches() int {
 	info.mu.RLock()
 	defer info.mu.RUnlock()
-	return len(info.watches)
+	n := 0
+	for _, watches := range info.watches {
+		n += len(watches)
+	}
+	return n
 }
 
 func (info *statusInfo) GetNumDeltaWatches() int {
 	info.mu.RLock()
 	defer info.mu.RUnlock()
-	return len(info.deltaWatches)
+	n := 0
+	for _, watches := range info.deltaWatches {
+		n += len(watches)
+	}
+	return n
 }
 
 func (info *statusInfo) GetLastWatchRequestTime() time.Time {
@@ -142,6 +207,110 @@ func (info *statusInfo) GetLastDeltaWatchRequestTime() time.Time {
 	return info.lastDeltaWatchRequestTime
 }
 
+func (info *statusInfo) GetTypeStatus(typeURL string) TypeStatus {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	return info.types[typeURL]
+}
+
+func (info *statusInfo) GetMissingResources(typeURL string) map[string]time.Time {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	out := make(map[string]time.Time, len(info.missing[typeURL]))
+	for name, since := range info.missing[typeURL] {
+		out[name] = since
+	}
+	return out
+}
+
+// refreshMissing recomputes the resources of a type missing for the open
+// watches of the node, keeping the time they went missing. If responded is
+// set, the resources still missing are kept for the watches just responded,
+// which are expected to request them again. The lock must be held.
+func (info *statusInfo) refreshMissing(typeURL string, resources map[string]types.ResourceWithTTL, now time.Time, responded bool) {
+	previous := info.missing[typeURL]
+	current := make(map[string]time.Time)
+	if responded {
+		for name, since := range previous {
+			if len(missingNames([]string{name}, resources)) != 0 {
+				current[name] = since
+			}
+		}
+	}
+	for _, watch := range info.watches[typeURL] {
+		for _, name := range missingNames(watch.Request.ResourceNames, resources) {
+			if since, ok := previous[name]; ok {
+				current[name] = since
+			} else {
+				current[name] = now
+			}
+		}
+	}
+	if len(current) == 0 {
+		delete(info.missing, typeURL)
+	} else {
+		info.missing[typeURL] = current
+	}
+}
+
+// stopMissingTimer stops the timer failing a watch missing resources, as the
+// watch is closed. The lock must be held.
+func (info *statusInfo) stopMissingTimer(id int64) {
+	if timer, ok := info.missingTimers[id]; ok {
+		timer.Stop()
+		delete(info.missingTimers, id)
+	}
+}
+
+// pruneMissing forgets the missing resources of a type no longer requested by
+// an open watch of the node. The lock must be held.
+func (info *statusInfo) pruneMissing(typeURL string) {
+	missing, ok := info.missing[typeURL]
+	if !ok {
+		return
+	}
+	requested := make(map[string]bool)
+	for _, watch := range info.watches[typeURL] {
+		for _, name := range watch.Request.ResourceNames {
+			requested[name] = true
+		}
+	}
+	for name := range missing {
+		if !requested[name] {
+			delete(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		delete(info.missing, typeURL)
+	}
+}
+
+// setResponseSent records the last response sent for a type URL.
+func (info *statusInfo) setResponseSent(typeURL, version, nonce string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	status := info.types[typeURL]
+	status.SentVersion = version
+	status.SentNonce = nonce
+	info.types[typeURL] = status
+}
+
+// setResponseAck records the acceptance or rejection of a response for a type URL.
+func (info *statusInfo) setResponseAck(typeURL, version string, errorDetail *rpcstatus.Status, t time.Time) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	status := info.types[typeURL]
+	if errorDetail == nil {
+		status.AckedVersion = version
+		status.AckTime = t
+	} else {
+		status.NackedVersion = version
+		status.NackDetail = errorDetail
+		status.NackTime = t
+	}
+	info.types[typeURL] = status
+}
+
 // setLastDeltaWatchRequestTime will set the current time of the last delta discovery watch request.
 func (info *statusInfo) setLastDeltaWatchRequestTime(t time.Time) {
 	info.mu.Lock()
@@ -153,5 +322,86 @@ func (info *statusInfo) setLastDeltaWatchRequestTime(t time.Time) {
 func (info *statusInfo) setDeltaResponseWatch(id int64, drw DeltaResponseWatch) {
 	info.mu.Lock()
 	defer info.mu.Unlock()
-	info.deltaWatches[id] = drw
+	typeURL := drw.Request.TypeUrl
+	if info.deltaWatches[typeURL] == nil {
+		info.deltaWatches[typeURL] = make(map[int64]DeltaResponseWatch)
+	}
+	info.deltaWatches[typeURL][id] = drw
+}
+
+// deleteDeltaResponseWatch removes the delta response watch of the given type
+// URL and watch ID, and returns whether it was open.
+func (info *statusInfo) deleteDeltaResponseWatch(typeURL string, id int64) bool {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	_, open := info.deltaWatches[typeURL][id]
+	delete(info.deltaWatches[typeURL], id)
+	if len(info.deltaWatches[typeURL]) == 0 {
+		delete(info.deltaWatches, typeURL)
+	}
+	info.lastWatchCloseTime = time.Now()
+	return open
+}
+
+// setResponseWatch will set the provided response watch for the associated watch ID.
+func (info *statusInfo) setResponseWatch(id int64, rw ResponseWatch) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	typeURL := rw.Request.TypeUrl
+	if info.watches[typeURL] == nil {
+		info.watches[typeURL] = make(map[int64]ResponseWatch)
+	}
+	info.watches[typeURL][id] = rw
+}
+
+// deleteResponseWatch removes the response watch of the given type URL and
+// watch ID, and returns whether it was open.
+func (info *statusInfo) deleteResponseWatch(typeURL string, id int64) bool {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	_, open := info.watches[typeURL][id]
+	delete(info.watches[typeURL], id)
+	if len(info.watches[typeURL]) == 0 {
+		delete(info.watches, typeURL)
+	}
+	info.lastWatchCloseTime = time.Now()
+	info.stopMissingTimer(id)
+	if open {
+		info.pruneMissing(typeURL)
+	}
+	return open
+}
+
+// closeWatches reports the open watches of a node as closed, as the node is cleared.
+func (info *statusInfo) closeWatches(node string, observers *observers) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	for typeURL, watches := range info.watches {
+		for id := range watches {
+			info.stopMissingTimer(id)
+			observers.publish(Event{Kind: WatchClosed, Node: node, TypeURL: typeURL, WatchID: id})
+		}
+	}
+	for typeURL, watches := range info.deltaWatches {
+		for id := range watches {
+			observers.publish(Event{Kind: WatchClosed, Node: node, TypeURL: typeURL, WatchID: id, Delta: true})
+		}
+	}
+}
+
+// idleSince returns the time since which the node has had no open watch, or
+// false if it has open watches.
+func (info *statusInfo) idleSince() (time.Time, bool) {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	if len(info.watches) > 0 || len(info.deltaWatches) > 0 {
+		return time.Time{}, false
+	}
+	since := info.lastWatchCloseTime
+	for _, t := range []time.Time{info.lastWatchRequestTime, info.lastDeltaWatchRequestTime} {
+		if t.After(since) {
+			since = t
+		}
+	}
+	return since, true
 }
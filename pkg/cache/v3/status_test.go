@@ -15,10 +15,19 @@
 package cache
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
 )
 
 func TestIDHash(t *testing.T) {
@@ -55,3 +64,38 @@ func TestNewStatusInfo(t *testing.T) {
 		t.Errorf("GetLastDeltaWatchRequestTime() => got %v, want zero time", got)
 	}
 }
+
+func TestMissingTimersStopped(t *testing.T) {
+	c := newSnapshotCache(false, IDHash{}, nil, WithMissingResourcePolicy(MissingResourcePolicy{Timeout: time.Hour}))
+	snapshot, err := NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.ClusterType: {&cluster.Cluster{Name: "a"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.SetSnapshot(context.Background(), "node", snapshot))
+
+	watch := func() func() {
+		state := stream.NewStreamState(false, map[string]string{})
+		state.SetKnownResourceNamesAsList(resource.ClusterType, []string{"b"})
+		request := &Request{TypeUrl: resource.ClusterType, VersionInfo: "1", ResourceNames: []string{"b"}, Node: &core.Node{Id: "node"}}
+		return c.CreateWatch(request, state, make(chan Response, 1))
+	}
+	timers := func() int {
+		info := c.shard("node").status["node"]
+		info.mu.RLock()
+		defer info.mu.RUnlock()
+		return len(info.missingTimers)
+	}
+
+	// Timers are stopped when their watch is cancelled or responded.
+	cancel := watch()
+	assert.Equal(t, 1, timers())
+	cancel()
+	assert.Equal(t, 0, timers())
+
+	watch()
+	assert.Equal(t, 1, timers())
+	require.NoError(t, c.UpdateResources(context.Background(), "node", resource.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, nil))
+	assert.Equal(t, 0, timers())
+}
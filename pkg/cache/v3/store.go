@@ -0,0 +1,242 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// SnapshotStore is a persistent backing store for the snapshots held by a
+// SnapshotCache. The cache writes every snapshot through to the store and
+// loads all stored snapshots on startup, so that a restarted control plane
+// can answer reconnecting clients with the last known config and versions.
+// SnapshotStore implementations must be thread-safe.
+//
+// Only the resources and versions of snapshots are stored, so snapshots of
+// custom ResourceSnapshot implementations are loaded as plain *Snapshot.
+type SnapshotStore interface {
+	// Store persists the snapshot for a node, replacing any previously stored snapshot.
+	Store(node string, snapshot ResourceSnapshot) error
+
+	// Delete removes the stored snapshot for a node. Deleting a missing node is not an error.
+	Delete(node string) error
+
+	// Load returns all stored snapshots indexed by node ID.
+	Load() (map[string]ResourceSnapshot, error)
+}
+
+// FileSnapshotStore is a SnapshotStore keeping one file per node in a directory.
+// Files are replaced atomically so that a crash never leaves a partially written snapshot behind.
+type FileSnapshotStore struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+var _ SnapshotStore = &FileSnapshotStore{}
+
+const snapshotFileExt = ".json"
+
+// NewFileSnapshotStore creates a store persisting snapshots in the provided directory.
+// The directory is created if it does not exist.
+func NewFileSnapshotStore(dir string) (*FileSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSnapshotStore{dir: dir}, nil
+}
+
+// storedSnapshot is the on-disk representation of a snapshot.
+type storedSnapshot struct {
+	Resources map[string]storedResources `json:"resources"`
+}
+
+type storedResources struct {
+	Version string           `json:"version"`
+	Items   []storedResource `json:"items,omitempty"`
+}
+
+type storedResource struct {
+	TypeURL string         `json:"type_url"`
+	Value   []byte         `json:"value"`
+	TTL     *time.Duration `json:"ttl,omitempty"`
+}
+
+// Store writes the snapshot for a node to its file.
+func (s *FileSnapshotStore) Store(node string, snapshot ResourceSnapshot) error {
+	data, err := encodeSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Removing the temporary file fails once it has been renamed, which is fine.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(node))
+}
+
+// Delete removes the file of a node.
+func (s *FileSnapshotStore) Delete(node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(node)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Load reads the snapshots of all nodes in the directory.
+// Files that cannot be decoded are skipped and reported in the returned error,
+// while the snapshots that could be decoded are still returned.
+func (s *FileSnapshotStore) Load() (map[string]ResourceSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]ResourceSnapshot, len(entries))
+	var failed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, snapshotFileExt) {
+			continue
+		}
+		node, err := url.PathUnescape(strings.TrimSuffix(name, snapshotFileExt))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		snapshot, err := decodeSnapshot(data)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		out[node] = snapshot
+	}
+
+	if len(failed) > 0 {
+		return out, fmt.Errorf("failed to load snapshots: %s", strings.Join(failed, "; "))
+	}
+	return out, nil
+}
+
+// path returns the file of a node. Node IDs are escaped so that they are always valid file names.
+func (s *FileSnapshotStore) path(node string) string {
+	return filepath.Join(s.dir, url.PathEscape(node)+snapshotFileExt)
+}
+
+func encodeSnapshot(snapshot ResourceSnapshot) ([]byte, error) {
+	out := storedSnapshot{Resources: make(map[string]storedResources)}
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			return nil, err
+		}
+		version := snapshot.GetVersion(typeURL)
+		resources := snapshot.GetResourcesAndTTL(typeURL)
+		if version == "" && len(resources) == 0 {
+			continue
+		}
+
+		group := storedResources{Version: version}
+		for _, r := range resources {
+			marshaled, err := MarshalResource(r.Resource)
+			if err != nil {
+				return nil, err
+			}
+			group.Items = append(group.Items, storedResource{
+				TypeURL: resource.APITypePrefix + string(proto.MessageName(r.Resource)),
+				Value:   marshaled,
+				TTL:     r.TTL,
+			})
+		}
+		out.Resources[typeURL] = group
+	}
+	return json.Marshal(out)
+}
+
+func decodeSnapshot(data []byte) (*Snapshot, error) {
+	var in storedSnapshot
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+
+	resources := make(map[resource.Type][]types.ResourceWithTTL, len(in.Resources))
+	for typeURL, group := range in.Resources {
+		// Files written by a newer build may hold types unknown to this one.
+		if GetResponseType(typeURL) == types.UnknownType {
+			return nil, fmt.Errorf("unknown resource type %q", typeURL)
+		}
+		items := make([]types.ResourceWithTTL, 0, len(group.Items))
+		for _, item := range group.Items {
+			r, err := anypb.UnmarshalNew(&anypb.Any{TypeUrl: item.TypeURL, Value: item.Value}, proto.UnmarshalOptions{})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, types.ResourceWithTTL{Resource: r, TTL: item.TTL})
+		}
+		resources[typeURL] = items
+	}
+
+	// The snapshot is built by its constructor, and then given the stored version of each type.
+	out, err := NewSnapshotWithTTLs("", resources)
+	if err != nil {
+		return nil, err
+	}
+	for typeURL, group := range in.Resources {
+		out.Resources[GetResponseType(typeURL)].Version = group.Version
+	}
+	return out, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+)
+
+func assertSnapshotsEqual(t *testing.T, want, got cache.ResourceSnapshot) {
+	t.Helper()
+	for _, typ := range testTypes {
+		assert.Equal(t, want.GetVersion(typ), got.GetVersion(typ), typ)
+
+		wantResources := want.GetResourcesAndTTL(typ)
+		gotResources := got.GetResourcesAndTTL(typ)
+		require.Len(t, gotResources, len(wantResources), typ)
+		for name, r := range wantResources {
+			assert.True(t, proto.Equal(r.Resource, gotResources[name].Resource), "%s %s", typ, name)
+			assert.Equal(t, r.TTL, gotResources[name].TTL, "%s %s", typ, name)
+		}
+	}
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := cache.NewFileSnapshotStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Store("node/a", fixture.snapshot()))
+	require.NoError(t, store.Store("node/b", snapshotWithTTL))
+
+	snapshots, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assertSnapshotsEqual(t, fixture.snapshot(), snapshots["node/a"])
+	assertSnapshotsEqual(t, snapshotWithTTL, snapshots["node/b"])
+
+	require.NoError(t, store.Delete("node/a"))
+	require.NoError(t, store.Delete("missing"))
+
+	snapshots, err = store.Load()
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+	assert.Contains(t, snapshots, "node/b")
+}
+
+func TestFileSnapshotStoreSkipsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := cache.NewFileSnapshotStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Store(key, fixture.snapshot()))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "unknown.json"),
+		[]byte(`{"resources":{"type.googleapis.com/unknown":{"version":"1"}}}`), 0o600))
+
+	snapshots, err := store.Load()
+	assert.ErrorContains(t, err, "unknown.json")
+	assert.Len(t, snapshots, 1)
+	assert.Contains(t, snapshots, key)
+}
+
+func TestSnapshotCacheRestoresFromStore(t *testing.T) {
+	store, err := cache.NewFileSnapshotStore(t.TempDir())
+	require.NoError(t, err)
+
+	c := cache.NewSnapshotCache(true, group{}, logger{t: t}, cache.WithSnapshotStore(store))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, fixture.snapshot()))
+
+	// A new cache backed by the same store behaves as if the snapshot had been set.
+	restarted := cache.NewSnapshotCache(true, group{}, logger{t: t}, cache.WithSnapshotStore(store))
+	snap, err := restarted.GetSnapshot(key)
+	require.NoError(t, err)
+	assertSnapshotsEqual(t, fixture.snapshot(), snap)
+
+	// A reconnecting client already up to date does not get a response.
+	value := make(chan cache.Response, 1)
+	streamState := stream.NewStreamState(false, map[string]string{})
+	restarted.CreateWatch(&discovery.DiscoveryRequest{
+		TypeUrl:     rsrc.ClusterType,
+		Node:        &core.Node{Id: key},
+		VersionInfo: fixture.version,
+	}, streamState, value)
+	assert.Empty(t, value)
+
+	// A new client receives the restored resources.
+	restarted.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, Node: &core.Node{Id: key}}, streamState, value)
+	require.Len(t, value, 1)
+	out := <-value
+	version, err := out.GetVersion()
+	require.NoError(t, err)
+	assert.Equal(t, fixture.version, version)
+	assert.Len(t, out.(*cache.RawResponse).Resources, 1)
+
+	restarted.ClearSnapshot(key)
+	snapshots, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+}
+
+func TestSnapshotCacheStoreFailureRejectsSnapshot(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithSnapshotStore(failingStore{}))
+	require.Error(t, c.SetSnapshot(context.Background(), key, fixture.snapshot()))
+
+	_, err := c.GetSnapshot(key)
+	assert.Error(t, err)
+}
+
+type failingStore struct{}
+
+func (failingStore) Store(string, cache.ResourceSnapshot) error { return os.ErrPermission }
+func (failingStore) Delete(string) error                        { return nil }
+func (failingStore) Load() (map[string]cache.ResourceSnapshot, error) {
+	return nil, nil
+}
+
+func TestSnapshotCacheStoreDoesNotBlockWatches(t *testing.T) {
+	store := blockingStore{stored: make(chan struct{})}
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithSnapshotStore(store))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SetSnapshot(context.Background(), key, fixture.snapshot())
+	}()
+
+	// Watches are opened while the snapshot is written, and responded once it is set.
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, Node: &core.Node{Id: key}}, stream.NewStreamState(false, nil), value)
+	assert.Equal(t, 1, c.GetStatusInfo(key).GetNumWatches())
+	close(store.stored)
+	require.NoError(t, <-done)
+	assert.Len(t, (<-value).(*cache.RawResponse).Resources, 1)
+}
+
+// blockingStore blocks writes until stored is closed.
+type blockingStore struct {
+	stored chan struct{}
+}
+
+func (s blockingStore) Store(string, cache.ResourceSnapshot) error {
+	<-s.stored
+	return nil
+}
+func (blockingStore) Delete(string) error { return nil }
+func (blockingStore) Load() (map[string]cache.ResourceSnapshot, error) {
+	return nil, nil
+}
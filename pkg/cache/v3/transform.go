@@ -0,0 +1,276 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+)
+
+// ResourceTransformer derives the node specific copy of a resource shared by
+// the snapshots of several nodes, e.g. to fill in values taken from the
+// locality or metadata of the node.
+//
+// Transform must not modify the shared resource: it returns either a modified
+// copy, or the resource itself if the node needs no change. The copy must keep
+// the name of the resource. A resource is left out of the responses of the
+// node if Transform returns nil or an error.
+type ResourceTransformer interface {
+	Transform(node *core.Node, typeURL string, res types.Resource) (types.Resource, error)
+}
+
+// ResourceTransformerFunc is a function implementing ResourceTransformer.
+type ResourceTransformerFunc func(node *core.Node, typeURL string, res types.Resource) (types.Resource, error)
+
+// Transform invokes the function.
+func (f ResourceTransformerFunc) Transform(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+	return f(node, typeURL, res)
+}
+
+// WithResourceTransformer transforms the resources of the snapshots for each
+// node they are served to, so that a single template snapshot serves nodes
+// needing slightly different resources.
+//
+// The resources of a type are transformed the first time they are served to a
+// node, and are memoized until the version of the type or the node changes.
+// Transformers only depending on some attributes of the nodes may implement
+// NodeHash, so that memoized resources are kept as long as the hash of the
+// node does not change.
+//
+// The versions served to a node combine the versions of the snapshot with the
+// identity of the transformation of the node, so that a node whose resources
+// are transformed differently after a change, e.g. of its metadata, is sent
+// them again. The versions reported to the cache as a ResponseTracker are
+// mapped back to the versions of the snapshot.
+func WithResourceTransformer(transformer ResourceTransformer) SnapshotCacheOption {
+	return func(cache *snapshotCache) {
+		cache.transformer = transformer
+	}
+}
+
+// nodeSnapshot returns the snapshot served to a node, with its resources
+// transformed if a transformer is set. The shard of the node must be locked.
+func (cache *snapshotCache) nodeSnapshot(shard *nodeShard, nodeID string, node *core.Node, snapshot ResourceSnapshot) ResourceSnapshot {
+	if cache.transformer == nil {
+		return snapshot
+	}
+
+	shard.transformMu.Lock()
+	defer shard.transformMu.Unlock()
+
+	previous, ok := shard.transformed[nodeID]
+	sameNode := ok && cache.sameTransformation(previous.node, node)
+	if sameNode && previous.base == snapshot {
+		return previous
+	}
+
+	out := &transformedSnapshot{
+		base:        snapshot,
+		node:        node,
+		id:          cache.transformationID(node),
+		transformer: cache.transformer,
+		log:         cache.log,
+		resources:   make(map[string]map[string]types.ResourceWithTTL),
+		marshaled:   newMarshalCache(getMarshalCache(snapshot)),
+	}
+	if sameNode {
+		// The transformations of the types whose version did not change are
+		// reused, along with their encoding. The previous view is not kept, so
+		// that the views of a node do not chain across versions.
+		previous.mu.Lock()
+		for typeURL, resources := range previous.resources {
+			if version := snapshot.GetVersion(typeURL); version != "" && version == previous.base.GetVersion(typeURL) {
+				out.resources[typeURL] = resources
+				out.marshaled.inherit(previous.marshaled, typeURL, resources)
+			}
+		}
+		previous.mu.Unlock()
+	}
+	shard.transformed[nodeID] = out
+	return out
+}
+
+// sameTransformation returns whether the resources of two nodes are
+// transformed alike, i.e. whether the nodes are equal, or have the same hash if
+// the transformer implements NodeHash.
+func (cache *snapshotCache) sameTransformation(a, b *core.Node) bool {
+	if a == b {
+		return true
+	}
+	if hash, ok := cache.transformer.(NodeHash); ok {
+		return hash.ID(a) == hash.ID(b)
+	}
+	return proto.Equal(a, b)
+}
+
+// transformedVersionSeparator separates the version of a snapshot from the
+// identity of the transformation in the versions served to a node.
+const transformedVersionSeparator = "~"
+
+// transformationID identifies how the resources of a node are transformed,
+// i.e. the node, or its hash if the transformer implements NodeHash.
+func (cache *snapshotCache) transformationID(node *core.Node) string {
+	var key []byte
+	if hash, ok := cache.transformer.(NodeHash); ok {
+		key = []byte(hash.ID(node))
+	} else {
+		var err error
+		if key, err = (proto.MarshalOptions{Deterministic: true}).Marshal(node); err != nil {
+			cache.log.Errorf("failed to marshal node %q: %v", node.GetId(), err)
+		}
+	}
+	return HashResource(key)[:16]
+}
+
+// snapshotVersion returns the version of the snapshot a version served to a
+// node was derived from.
+func (cache *snapshotCache) snapshotVersion(node *core.Node, version string) string {
+	if cache.transformer == nil {
+		return version
+	}
+	i := strings.LastIndex(version, transformedVersionSeparator)
+	if i < 0 || version[i+len(transformedVersionSeparator):] != cache.transformationID(node) {
+		return version
+	}
+	return version[:i]
+}
+
+// forgetTransformed drops the snapshot served to a node.
+func (shard *nodeShard) forgetTransformed(node string) {
+	shard.transformMu.Lock()
+	defer shard.transformMu.Unlock()
+	delete(shard.transformed, node)
+}
+
+// transformedSnapshot is the view of a snapshot served to a node, whose
+// resources are transformed on first use.
+type transformedSnapshot struct {
+	base        ResourceSnapshot
+	node        *core.Node
+	id          string
+	transformer ResourceTransformer
+	log         log.Logger
+
+	mu          sync.Mutex
+	resources   map[string]map[string]types.ResourceWithTTL
+	versionMaps map[string]map[string]string
+
+	// aliases memoizes the transformed virtual hosts indexed by their aliases.
+	aliases aliasMemo
+
+	// marshaled memoizes the transformed resources, falling back to the
+	// snapshot for the resources left unchanged by the transformer.
+	marshaled *marshalCache
+}
+
+var _ ResourceSnapshot = &transformedSnapshot{}
+
+func (s *transformedSnapshot) GetVersion(typeURL string) string {
+	version := s.base.GetVersion(typeURL)
+	if version == "" {
+		return ""
+	}
+	return version + transformedVersionSeparator + s.id
+}
+
+func (s *transformedSnapshot) GetResourcesAndTTL(typeURL string) map[string]types.ResourceWithTTL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transform(typeURL)
+}
+
+// transform returns the transformed resources of a type. The lock must be held.
+func (s *transformedSnapshot) transform(typeURL string) map[string]types.ResourceWithTTL {
+	if resources, ok := s.resources[typeURL]; ok {
+		return resources
+	}
+
+	shared := s.base.GetResourcesAndTTL(typeURL)
+	resources := make(map[string]types.ResourceWithTTL, len(shared))
+	for name, r := range shared {
+		res, err := s.transformer.Transform(s.node, typeURL, r.Resource)
+		switch {
+		case err != nil:
+			s.log.Errorf("failed to transform %s %q for node %q: %v", typeURL, name, s.node.GetId(), err)
+			continue
+		case res == nil:
+			continue
+		case GetResourceName(res) != name:
+			s.log.Errorf("transformed %s %q for node %q is named %q", typeURL, name, s.node.GetId(), GetResourceName(res))
+			continue
+		}
+		resources[name] = types.ResourceWithTTL{Resource: res, TTL: r.TTL}
+	}
+	s.resources[typeURL] = resources
+	return resources
+}
+
+func (s *transformedSnapshot) GetResources(typeURL string) map[string]types.Resource {
+	resources := s.GetResourcesAndTTL(typeURL)
+	out := make(map[string]types.Resource, len(resources))
+	for name, r := range resources {
+		out[name] = r.Resource
+	}
+	return out
+}
+
+func (s *transformedSnapshot) GetVersionMap(typeURL string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versionMaps[typeURL]
+}
+
+func (s *transformedSnapshot) ConstructVersionMap() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.versionMaps != nil {
+		return nil
+	}
+
+	versionMaps := make(map[string]map[string]string)
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			return err
+		}
+		resources := s.transform(typeURL)
+		versions := make(map[string]string, len(resources))
+		for name, r := range resources {
+			marshaledResource, err := s.marshaled.marshal(typeURL, r.Resource)
+			if err != nil {
+				return err
+			}
+			versions[name] = marshaledResource.version()
+		}
+		versionMaps[typeURL] = versions
+	}
+	s.versionMaps = versionMaps
+	return nil
+}
+
+func (s *transformedSnapshot) getAliasIndex() map[string]string {
+	return s.aliases.get(s)
+}
+
+func (s *transformedSnapshot) getMarshalCache() *marshalCache {
+	return s.marshaled
+}
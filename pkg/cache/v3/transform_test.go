@@ -0,0 +1,130 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestSnapshotCacheResourceTransformer(t *testing.T) {
+	calls := 0
+	transformer := cache.ResourceTransformerFunc(func(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+		calls++
+		c, ok := res.(*cluster.Cluster)
+		if !ok {
+			return res, nil
+		}
+		if c.Name == "invalid" {
+			return nil, errors.New("invalid cluster")
+		}
+		out := proto.Clone(c).(*cluster.Cluster)
+		out.AltStatName = node.GetCluster()
+		return out, nil
+	})
+	c := cache.NewSnapshotCache(false, cache.IDHash{}, logger{t: t}, cache.WithResourceTransformer(transformer))
+
+	shared := &cluster.Cluster{Name: "a"}
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType:  {shared, &cluster.Cluster{Name: "invalid"}},
+		rsrc.ListenerType: {&listener.Listener{Name: "la"}},
+	})
+	require.NoError(t, err)
+	blue, green := &core.Node{Id: "blue", Cluster: "blue"}, &core.Node{Id: "green", Cluster: "green"}
+	require.NoError(t, c.SetSnapshot(context.Background(), blue.Id, snapshot))
+	require.NoError(t, c.SetSnapshot(context.Background(), green.Id, snapshot))
+
+	fetch := func(node *core.Node) []*cluster.Cluster {
+		resp, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, Node: node})
+		require.NoError(t, err)
+		var out []*cluster.Cluster
+		for _, r := range resp.(*cache.RawResponse).Resources {
+			out = append(out, r.Resource.(*cluster.Cluster))
+		}
+		return out
+	}
+
+	// Each node is served its own copy, and resources failing to be transformed are left out.
+	clusters := fetch(blue)
+	require.Len(t, clusters, 1)
+	assert.Equal(t, "blue", clusters[0].AltStatName)
+	clusters = fetch(green)
+	require.Len(t, clusters, 1)
+	assert.Equal(t, "green", clusters[0].AltStatName)
+	assert.Empty(t, shared.AltStatName)
+	assert.Equal(t, 4, calls)
+
+	// Transformations are memoized until the version of their type changes.
+	fetch(blue)
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), blue.Id, rsrc.ListenerType, map[string]types.Resource{
+		"lb": &listener.Listener{Name: "lb"},
+	}, nil))
+	fetch(blue)
+	assert.Equal(t, 4, calls)
+
+	require.NoError(t, c.(cache.ResourceUpdater).UpdateResources(context.Background(), blue.Id, rsrc.ClusterType, map[string]types.Resource{
+		"b": &cluster.Cluster{Name: "b"},
+	}, nil))
+	assert.Len(t, fetch(blue), 2)
+	assert.Equal(t, 7, calls)
+
+	// The cache keeps the shared snapshot.
+	current, err := c.GetSnapshot(green.Id)
+	require.NoError(t, err)
+	assert.Same(t, snapshot, current)
+}
+
+func TestSnapshotCacheResourceTransformerVersion(t *testing.T) {
+	transformer := cache.ResourceTransformerFunc(func(node *core.Node, typeURL string, res types.Resource) (types.Resource, error) {
+		out := proto.Clone(res).(*cluster.Cluster)
+		out.AltStatName = node.GetCluster()
+		return out, nil
+	})
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithResourceTransformer(transformer))
+	require.NoError(t, c.SetSnapshot(context.Background(), key, clusterSnapshot(t, "1")))
+
+	fetch := func(node *core.Node) string {
+		resp, err := c.Fetch(context.Background(), &discovery.DiscoveryRequest{TypeUrl: rsrc.ClusterType, Node: node})
+		require.NoError(t, err)
+		version, err := resp.GetVersion()
+		require.NoError(t, err)
+		return version
+	}
+
+	// A node transformed differently is served a different version.
+	blue := &core.Node{Id: key, Cluster: "blue"}
+	version := fetch(blue)
+	assert.NotEqual(t, "1", version)
+	assert.NotEqual(t, version, fetch(&core.Node{Id: key, Cluster: "green"}))
+
+	// The versions served are reported as the versions of the snapshot.
+	tracker := c.(cache.ResponseTracker)
+	tracker.OnResponseSent(blue, rsrc.ClusterType, version, "1")
+	tracker.OnResponseAck(blue, rsrc.ClusterType, version, "1", nil)
+	assert.Equal(t, "1", c.GetStatusInfo(key).GetTypeStatus(rsrc.ClusterType).AckedVersion)
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// ResourceValidationError is the validation failure of a single resource.
+type ResourceValidationError struct {
+	TypeURL string
+	Name    string
+	Err     error
+}
+
+func (e ResourceValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %v", e.TypeURL, e.Name, e.Err)
+}
+
+func (e ResourceValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors lists every invalid resource of a rejected write, sorted by
+// type URL and name.
+type ValidationErrors []ResourceValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateResource runs the protoc-gen-validate rules of a resource, reporting
+// all violations if possible. Resources without generated validation are valid.
+func ValidateResource(res types.Resource) error {
+	switch v := res.(type) {
+	case interface{ ValidateAll() error }:
+		return v.ValidateAll()
+	case interface{ Validate() error }:
+		return v.Validate()
+	}
+	return nil
+}
+
+// ValidateSnapshot validates every resource of a snapshot and returns
+// ValidationErrors if any of them is invalid.
+func ValidateSnapshot(snapshot ResourceSnapshot) error {
+	var errs ValidationErrors
+	for i := types.ResponseType(0); i < types.UnknownType; i++ {
+		typeURL, err := GetResponseTypeURL(i)
+		if err != nil {
+			continue
+		}
+		errs = append(errs, validateResources(typeURL, snapshot.GetResources(typeURL))...)
+	}
+	return errs.err()
+}
+
+// validateResources validates a set of resources of a type.
+func validateResources(typeURL string, resources map[string]types.Resource) ValidationErrors {
+	var errs ValidationErrors
+	for name, res := range resources {
+		if err := ValidateResource(res); err != nil {
+			errs = append(errs, ResourceValidationError{TypeURL: typeURL, Name: name, Err: err})
+		}
+	}
+	return errs
+}
+
+// err returns the sorted errors, or nil if there is none.
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	sort.Slice(e, func(i, j int) bool {
+		if e[i].TypeURL != e[j].TypeURL {
+			return e[i].TypeURL < e[j].TypeURL
+		}
+		return e[i].Name < e[j].Name
+	})
+	return e
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func invalidRouteConfig(name string) *route.RouteConfiguration {
+	return &route.RouteConfiguration{
+		Name:         name,
+		VirtualHosts: []*route.VirtualHost{{Name: "test"}},
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	assert.NoError(t, cache.ValidateSnapshot(fixture.snapshot()))
+
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {testCluster},
+		rsrc.RouteType:   {invalidRouteConfig("b"), testRoute, invalidRouteConfig("a")},
+	})
+	require.NoError(t, err)
+
+	err = cache.ValidateSnapshot(snapshot)
+	var errs cache.ValidationErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	assert.Equal(t, rsrc.RouteType, errs[0].TypeURL)
+	assert.Equal(t, "a", errs[0].Name)
+	assert.Equal(t, "b", errs[1].Name)
+	assert.Contains(t, err.Error(), `invalid `+rsrc.RouteType+` "a": `)
+}
+
+func TestSnapshotCacheValidation(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t}, cache.WithSnapshotValidation())
+	require.NoError(t, c.SetSnapshot(context.Background(), key, fixture.snapshot()))
+
+	snapshot, err := cache.NewSnapshot("2", map[rsrc.Type][]types.Resource{
+		rsrc.RouteType: {invalidRouteConfig(routeName)},
+	})
+	require.NoError(t, err)
+
+	watch := openClusterWatch(c, nil, fixture.version)
+	assert.Error(t, c.SetSnapshot(context.Background(), key, snapshot))
+
+	// The invalid snapshot is never visible.
+	current, err := c.GetSnapshot(key)
+	require.NoError(t, err)
+	assert.Equal(t, fixture.version, current.GetVersion(rsrc.ClusterType))
+	assert.Empty(t, watch)
+
+	// Validation is opt-in.
+	c = cache.NewSnapshotCache(false, group{}, logger{t: t})
+	assert.NoError(t, c.SetSnapshot(context.Background(), key, snapshot))
+}
+
+func TestGroupSnapshotCacheValidation(t *testing.T) {
+	c := cache.NewGroupSnapshotCache(false, clusterHash{}, cache.IDHash{}, logger{t: t}, cache.WithSnapshotValidation())
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.RouteType: {invalidRouteConfig(routeName)},
+	})
+	require.NoError(t, err)
+
+	assert.Error(t, c.SetGroupSnapshot(context.Background(), "group", snapshot))
+	_, err = c.GetGroupSnapshot("group")
+	assert.Error(t, err)
+
+	assert.Error(t, c.SetNodeOverlay(context.Background(), "a", snapshot))
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package resource
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// XdstpScheme is the scheme of federated xDS resource names.
+const XdstpScheme = "xdstp://"
+
+// XdstpName is a parsed resource name of the form
+// xdstp://authority/resource.type/id?context=params, as used by federated xDS.
+type XdstpName struct {
+	// Authority serving the resource. It may be empty.
+	Authority string
+
+	// ResourceType is the fully qualified protobuf type of the resource,
+	// without the type URL prefix.
+	ResourceType string
+
+	// ID is the path of the resource within the authority. It ends with "*"
+	// for glob collections.
+	ID string
+
+	// ContextParams qualify the resource, e.g. with node attributes.
+	ContextParams map[string]string
+}
+
+// IsXdstpName returns whether a resource name is an xdstp:// name.
+func IsXdstpName(name string) bool {
+	return strings.HasPrefix(name, XdstpScheme)
+}
+
+// ParseXdstpName parses an xdstp:// resource name. Processing directives are not supported.
+func ParseXdstpName(name string) (*XdstpName, error) {
+	if !IsXdstpName(name) {
+		return nil, fmt.Errorf("%q is not an xdstp name", name)
+	}
+	if strings.Contains(name, "#") {
+		return nil, fmt.Errorf("processing directives of %q are not supported", name)
+	}
+
+	rest, query := split(strings.TrimPrefix(name, XdstpScheme), "?")
+	authority, path := split(rest, "/")
+	resourceType, id := split(path, "/")
+	if resourceType == "" {
+		return nil, fmt.Errorf("%q has no resource type", name)
+	}
+	if id == "" {
+		return nil, fmt.Errorf("%q has no resource ID", name)
+	}
+
+	out := &XdstpName{ResourceType: resourceType}
+	var err error
+	if out.Authority, err = url.PathUnescape(authority); err != nil {
+		return nil, fmt.Errorf("invalid authority in %q: %w", name, err)
+	}
+	if out.ID, err = url.PathUnescape(id); err != nil {
+		return nil, fmt.Errorf("invalid ID in %q: %w", name, err)
+	}
+
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid context parameters in %q: %w", name, err)
+		}
+		out.ContextParams = make(map[string]string, len(values))
+		for key, value := range values {
+			if len(value) > 1 {
+				return nil, fmt.Errorf("context parameter %q is repeated in %q", key, name)
+			}
+			out.ContextParams[key] = value[0]
+		}
+	}
+	return out, nil
+}
+
+// split slices s around the first instance of sep.
+func split(s, sep string) (string, string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
+
+// String returns the canonical form of the name, with its context parameters
+// sorted by key, so that equivalent names are equal.
+func (n *XdstpName) String() string {
+	var b strings.Builder
+	b.WriteString(XdstpScheme)
+	b.WriteString(url.PathEscape(n.Authority))
+	b.WriteByte('/')
+	b.WriteString(n.ResourceType)
+	b.WriteByte('/')
+	segments := strings.Split(n.ID, "/")
+	for i, segment := range segments {
+		// The glob segment is kept as is, as requested by clients.
+		if i == len(segments)-1 && segment == "*" {
+			continue
+		}
+		segments[i] = url.PathEscape(segment)
+	}
+	b.WriteString(strings.Join(segments, "/"))
+
+	keys := make([]string, 0, len(n.ContextParams))
+	for key := range n.ContextParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(queryEscape(key))
+		b.WriteByte('=')
+		b.WriteString(queryEscape(n.ContextParams[key]))
+	}
+	return b.String()
+}
+
+// queryEscape percent-encodes a context parameter, encoding spaces as %20.
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// TypeURL returns the type URL of the resource.
+func (n *XdstpName) TypeURL() string {
+	return APITypePrefix + n.ResourceType
+}
+
+// IsGlob returns whether the name designates a glob collection, i.e. all the
+// resources whose ID is directly under the path of the collection.
+func (n *XdstpName) IsGlob() bool {
+	return n.ID == "*" || strings.HasSuffix(n.ID, "/*")
+}
+
+// InCollection returns whether the resource belongs to a glob collection. The
+// resource and the collection must have the same authority, type and context
+// parameters.
+func (n *XdstpName) InCollection(glob *XdstpName) bool {
+	if !glob.IsGlob() || n.IsGlob() || n.Authority != glob.Authority || n.ResourceType != glob.ResourceType {
+		return false
+	}
+	prefix := strings.TrimSuffix(glob.ID, "*")
+	if !strings.HasPrefix(n.ID, prefix) || strings.Contains(n.ID[len(prefix):], "/") {
+		return false
+	}
+	if len(n.ContextParams) != len(glob.ContextParams) {
+		return false
+	}
+	for key, value := range glob.ContextParams {
+		if v, ok := n.ContextParams[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// CanonicalResourceName returns the canonical form of xdstp:// names, and
+// other names unchanged.
+func CanonicalResourceName(name string) string {
+	if !IsXdstpName(name) {
+		return name
+	}
+	parsed, err := ParseXdstpName(name)
+	if err != nil {
+		return name
+	}
+	return parsed.String()
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package resource_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestParseXdstpName(t *testing.T) {
+	name, err := resource.ParseXdstpName("xdstp://example.com/envoy.config.listener.v3.Listener/foo/bar?b=2&a=1%202")
+	require.NoError(t, err)
+	assert.Equal(t, &resource.XdstpName{
+		Authority:     "example.com",
+		ResourceType:  "envoy.config.listener.v3.Listener",
+		ID:            "foo/bar",
+		ContextParams: map[string]string{"a": "1 2", "b": "2"},
+	}, name)
+	assert.Equal(t, resource.ListenerType, name.TypeURL())
+	assert.False(t, name.IsGlob())
+
+	// The canonical form sorts the context parameters.
+	assert.Equal(t, "xdstp://example.com/envoy.config.listener.v3.Listener/foo/bar?a=1%202&b=2", name.String())
+	assert.Equal(t, name.String(), resource.CanonicalResourceName("xdstp://example.com/envoy.config.listener.v3.Listener/foo/bar?a=1+2&b=2"))
+	assert.Equal(t, "listener", resource.CanonicalResourceName("listener"))
+
+	for _, invalid := range []string{
+		"listener",
+		"xdstp://example.com",
+		"xdstp://example.com/envoy.config.listener.v3.Listener",
+		"xdstp://example.com/envoy.config.listener.v3.Listener/foo#entry=bar",
+		"xdstp://example.com/envoy.config.listener.v3.Listener/foo?a=1&a=2",
+	} {
+		_, err := resource.ParseXdstpName(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestXdstpNameRoundTrip(t *testing.T) {
+	// Canonical names are left unchanged by parsing them.
+	for _, name := range []string{
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/foo",
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/*",
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/*?zone=a",
+		"xdstp:///envoy.config.cluster.v3.Cluster/foo/bar%20baz?a=1&b=2",
+	} {
+		parsed, err := resource.ParseXdstpName(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, parsed.String())
+	}
+}
+
+func TestXdstpGlobCollection(t *testing.T) {
+	parse := func(name string) *resource.XdstpName {
+		parsed, err := resource.ParseXdstpName(name)
+		require.NoError(t, err)
+		return parsed
+	}
+
+	glob := parse("xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/*?zone=a")
+	assert.True(t, glob.IsGlob())
+	assert.True(t, parse("xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/bar?zone=a").InCollection(glob))
+
+	for _, other := range []string{
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/bar",
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/bar?zone=b",
+		"xdstp://example.com/envoy.config.cluster.v3.Cluster/foo/bar/baz?zone=a",
+		"xdstp://other.com/envoy.config.cluster.v3.Cluster/foo/bar?zone=a",
+		"xdstp://example.com/envoy.config.listener.v3.Listener/foo/bar?zone=a",
+	} {
+		assert.False(t, parse(other).InCollection(glob), other)
+	}
+}
@@ -40,6 +40,9 @@ type server struct {
 	cache     cache.ConfigWatcher
 	callbacks Callbacks
 
+	// tracker is the cache, if it records the responses and their acknowledgement
+	tracker cache.ResponseTracker
+
 	// total stream count for counting bi-di streams
 	streamCount int64
 	ctx         context.Context
@@ -47,9 +50,11 @@ type server struct {
 
 // NewServer creates a delta xDS specific server which utilizes a ConfigWatcher and delta Callbacks.
 func NewServer(ctx context.Context, config cache.ConfigWatcher, callbacks Callbacks) Server {
+	tracker, _ := config.(cache.ResponseTracker)
 	return &server{
 		cache:     config,
 		callbacks: callbacks,
+		tracker:   tracker,
 		ctx:       ctx,
 	}
 }
@@ -89,7 +94,13 @@ func (s *server) processDelta(str stream.DeltaStream, reqCh <-chan *discovery.De
 			s.callbacks.OnStreamDeltaResponse(streamID, resp.GetDeltaRequest(), response)
 		}
 
-		return response.Nonce, str.Send(response)
+		if err := str.Send(response); err != nil {
+			return response.Nonce, err
+		}
+		if s.tracker != nil {
+			s.tracker.OnResponseSent(node, response.TypeUrl, response.SystemVersionInfo, response.Nonce)
+		}
+		return response.Nonce, nil
 	}
 
 	if s.callbacks != nil {
@@ -106,6 +117,10 @@ func (s *server) processDelta(str stream.DeltaStream, reqCh <-chan *discovery.De
 			if !more {
 				break
 			}
+			// The cache terminates a watch by responding nil.
+			if resp == nil {
+				return status.Errorf(codes.Unavailable, "delta watch terminated")
+			}
 
 			typ := resp.GetDeltaRequest().GetTypeUrl()
 			if resp == deltaErrorResponse {
@@ -119,6 +134,7 @@ func (s *server) processDelta(str stream.DeltaStream, reqCh <-chan *discovery.De
 
 			watch := watches.deltaWatches[typ]
 			watch.nonce = nonce
+			watch.version, _ = resp.GetSystemVersion()
 			// As per XDS protocol, for the non wildcard resources, management server should only respond to the resources
 			// requested by the client. Since we were replacing (instead of updating) the complete state resource version
 			// map after responding to the client, it was overriding/removing the resources subscribed by the client intermittently.
@@ -176,6 +192,12 @@ func (s *server) processDelta(str stream.DeltaStream, reqCh <-chan *discovery.De
 
 			// cancel existing watch to (re-)request a newer version
 			watch, ok := watches.deltaWatches[typeURL]
+
+			// The request acknowledges the last response, or rejects it with an error detail.
+			if ok && s.tracker != nil && req.GetResponseNonce() != "" && watch.nonce == req.GetResponseNonce() {
+				s.tracker.OnResponseAck(node, typeURL, watch.version, watch.nonce, req.GetErrorDetail())
+			}
+
 			if !ok {
 				// Initialize the state of the stream.
 				// Since there was no previous state, we know we're handling the first request of this type
@@ -234,26 +256,24 @@ func (s *server) DeltaStreamHandler(str stream.DeltaStream, typeURL string) erro
 // When we subscribe, we just want to make the cache know we are subscribing to a resource.
 // Even if the stream is wildcard, we keep the list of explicitly subscribed resources as the wildcard subscription can be discarded later on.
 func (s *server) subscribe(resources []string, streamState *stream.StreamState) {
-	sv := streamState.GetSubscribedResourceNames()
 	for _, resource := range resources {
 		if resource == "*" {
 			streamState.SetWildcard(true)
 			continue
 		}
-		sv[resource] = struct{}{}
+		streamState.AddSubscribedResourceName(resource)
 	}
 }
 
 // Unsubscriptions remove resources from the stream's subscribed resource list.
 // If a client explicitly unsubscribes from a wildcard request, the stream is updated and now watches only subscribed resources.
 func (s *server) unsubscribe(resources []string, streamState *stream.StreamState) {
-	sv := streamState.GetSubscribedResourceNames()
 	for _, resource := range resources {
 		if resource == "*" {
 			streamState.SetWildcard(false)
 			continue
 		}
-		if _, ok := sv[resource]; ok && streamState.IsWildcard() {
+		if name, ok := streamState.RemoveSubscribedResourceName(resource); ok && streamState.IsWildcard() {
 			// The XDS protocol states that:
 			// * if a watch is currently wildcard
 			// * a resource is explicitly unsubscribed by name
@@ -262,8 +282,7 @@ func (s *server) unsubscribe(resources []string, streamState *stream.StreamState
 			// To achieve that, we mark the resource as having been returned with an empty version. While creating the response, the cache will either:
 			// * detect the version change, and return the resource (as an update)
 			// * detect the resource deletion, and set it as removed in the response
-			streamState.GetResourceVersions()[resource] = ""
+			streamState.GetResourceVersions()[name] = ""
 		}
-		delete(sv, resource)
 	}
 }
@@ -35,6 +35,7 @@ type watch struct {
 	responses chan cache.DeltaResponse
 	cancel    func()
 	nonce     string
+	version   string
 
 	state stream.StreamState
 }
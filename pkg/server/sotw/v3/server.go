@@ -51,7 +51,8 @@ type Callbacks interface {
 
 // NewServer creates handlers from a config watcher and callbacks.
 func NewServer(ctx context.Context, config cache.ConfigWatcher, callbacks Callbacks) Server {
-	return &server{cache: config, callbacks: callbacks, ctx: ctx}
+	tracker, _ := config.(cache.ResponseTracker)
+	return &server{cache: config, callbacks: callbacks, ctx: ctx, tracker: tracker}
 }
 
 type server struct {
@@ -59,6 +60,9 @@ type server struct {
 	callbacks Callbacks
 	ctx       context.Context
 
+	// tracker is the cache, if it records the responses and their acknowledgement
+	tracker cache.ResponseTracker
+
 	// streamCount for counting bi-di streams
 	streamCount int64
 }
@@ -69,6 +73,7 @@ type server struct {
 // regardless current snapshot version (even if it is not changed yet)
 type lastDiscoveryResponse struct {
 	nonce     string
+	version   string
 	resources map[string]struct{}
 }
 
@@ -114,6 +119,7 @@ func (s *server) process(str stream.Stream, reqCh <-chan *discovery.DiscoveryReq
 
 		lastResponse := lastDiscoveryResponse{
 			nonce:     out.Nonce,
+			version:   out.VersionInfo,
 			resources: make(map[string]struct{}),
 		}
 		for _, r := range resp.GetRequest().ResourceNames {
@@ -124,7 +130,13 @@ func (s *server) process(str stream.Stream, reqCh <-chan *discovery.DiscoveryReq
 		if s.callbacks != nil {
 			s.callbacks.OnStreamResponse(resp.GetContext(), streamID, resp.GetRequest(), out)
 		}
-		return out.Nonce, str.Send(out)
+		if err := str.Send(out); err != nil {
+			return out.Nonce, err
+		}
+		if s.tracker != nil {
+			s.tracker.OnResponseSent(node, out.TypeUrl, out.VersionInfo, out.Nonce)
+		}
+		return out.Nonce, nil
 	}
 
 	if s.callbacks != nil {
@@ -188,6 +200,10 @@ func (s *server) process(str stream.Stream, reqCh <-chan *discovery.DiscoveryReq
 					// Let's record Resource names that a client has received.
 					streamState.SetKnownResourceNames(req.TypeUrl, lastResponse.resources)
 				}
+				// The request acknowledges the last response, or rejects it with an error detail.
+				if s.tracker != nil && nonce != "" && lastResponse.nonce == nonce {
+					s.tracker.OnResponseAck(node, req.TypeUrl, lastResponse.version, nonce, req.GetErrorDetail())
+				}
 			}
 
 			typeURL := req.GetTypeUrl()
@@ -221,7 +237,11 @@ func (s *server) process(str stream.Stream, reqCh <-chan *discovery.DiscoveryReq
 				return status.Errorf(codes.Unavailable, "resource watch %d -> failed", index)
 			}
 
-			res := value.Interface().(cache.Response)
+			// The cache terminates a watch by responding nil.
+			res, _ := value.Interface().(cache.Response)
+			if res == nil {
+				return status.Errorf(codes.Unavailable, "resource watch %d -> terminated", index)
+			}
 			nonce, err := send(res)
 			if err != nil {
 				return err
@@ -4,6 +4,7 @@ import (
 	"google.golang.org/grpc"
 
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 )
 
 // Generic RPC stream.
@@ -28,8 +29,12 @@ type StreamState struct { // nolint:golint,revive
 
 	// Provides the list of resources explicitly requested by the client
 	// This list might be non-empty even when set as wildcard
+	// xdstp:// names are stored in their canonical form
 	subscribedResourceNames map[string]struct{}
 
+	// subscribedGlobs are the xdstp:// glob collections subscribed to, parsed once when subscribed
+	subscribedGlobs map[string]*resource.XdstpName
+
 	// ResourceVersions contains a hash of the resource as the value and the resource name as the key.
 	// This field stores the last state sent to the client.
 	resourceVersions map[string]string
@@ -52,7 +57,40 @@ func (s *StreamState) GetSubscribedResourceNames() map[string]struct{} {
 // It is decorrelated from the wildcard state of the stream
 // Currently used only when using delta-xds
 func (s *StreamState) SetSubscribedResourceNames(subscribedResourceNames map[string]struct{}) {
-	s.subscribedResourceNames = subscribedResourceNames
+	s.subscribedResourceNames = make(map[string]struct{}, len(subscribedResourceNames))
+	s.subscribedGlobs = map[string]*resource.XdstpName{}
+	for name := range subscribedResourceNames {
+		s.AddSubscribedResourceName(name)
+	}
+}
+
+// AddSubscribedResourceName adds a resource to the list of resources explicitly subscribed to
+// xdstp:// names are added in their canonical form, which is returned
+func (s *StreamState) AddSubscribedResourceName(name string) string {
+	var glob *resource.XdstpName
+	if resource.IsXdstpName(name) {
+		if parsed, err := resource.ParseXdstpName(name); err == nil {
+			name = parsed.String()
+			if parsed.IsGlob() {
+				glob = parsed
+			}
+		}
+	}
+	s.subscribedResourceNames[name] = struct{}{}
+	if glob != nil {
+		s.subscribedGlobs[name] = glob
+	}
+	return name
+}
+
+// RemoveSubscribedResourceName removes a resource from the list of resources explicitly subscribed to
+// It returns the canonical form of the name, and whether the resource was subscribed to
+func (s *StreamState) RemoveSubscribedResourceName(name string) (string, bool) {
+	name = resource.CanonicalResourceName(name)
+	_, ok := s.subscribedResourceNames[name]
+	delete(s.subscribedResourceNames, name)
+	delete(s.subscribedGlobs, name)
+	return name, ok
 }
 
 // WatchesResources returns whether at least one of the resource provided is currently watch by the stream
@@ -68,6 +106,26 @@ func (s *StreamState) WatchesResources(resourceNames map[string]struct{}) bool {
 			return true
 		}
 	}
+
+	// xdstp:// resources may also be watched under their canonical name, or
+	// through the glob collections they belong to.
+	for resourceName := range resourceNames {
+		if !resource.IsXdstpName(resourceName) {
+			continue
+		}
+		parsed, err := resource.ParseXdstpName(resourceName)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.subscribedResourceNames[parsed.String()]; ok {
+			return true
+		}
+		for _, glob := range s.subscribedGlobs {
+			if parsed.InCollection(glob) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
@@ -113,6 +171,7 @@ func NewStreamState(wildcard bool, initialResourceVersions map[string]string) St
 	state := StreamState{
 		wildcard:                wildcard,
 		subscribedResourceNames: map[string]struct{}{},
+		subscribedGlobs:         map[string]*resource.XdstpName{},
 		resourceVersions:        initialResourceVersions,
 		first:                   true,
 		knownResourceNames:      map[string]map[string]struct{}{},
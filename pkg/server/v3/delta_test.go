@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 
 	"github.com/stretchr/testify/assert"
@@ -304,6 +305,37 @@ func TestSendDeltaError(t *testing.T) {
 	}
 }
 
+// terminatingConfigWatcher terminates every delta watch by responding nil.
+type terminatingConfigWatcher struct {
+	*mockConfigWatcher
+}
+
+func (config terminatingConfigWatcher) CreateDeltaWatch(req *discovery.DeltaDiscoveryRequest, state stream.StreamState, out chan cache.DeltaResponse) func() {
+	out <- nil
+	return nil
+}
+
+func TestDeltaTerminatedWatch(t *testing.T) {
+	for _, typ := range testTypes {
+		t.Run(typ, func(t *testing.T) {
+			s := server.NewServer(context.Background(), terminatingConfigWatcher{makeMockConfigWatcher()}, server.CallbackFuncs{})
+
+			resp := makeMockDeltaStream(t)
+			resp.recv <- &discovery.DeltaDiscoveryRequest{
+				Node:    node,
+				TypeUrl: typ,
+			}
+
+			// check that the stream ends with an error instead of sending a response
+			err := s.DeltaAggregatedResources(resp)
+			assert.Error(t, err)
+			assert.Empty(t, resp.sent)
+
+			close(resp.recv)
+		})
+	}
+}
+
 func TestDeltaAggregatedHandlers(t *testing.T) {
 	config := makeMockConfigWatcher()
 	config.deltaResources = makeDeltaResources()
@@ -614,3 +646,36 @@ func TestDeltaWildcardSubscriptions(t *testing.T) {
 	})
 
 }
+
+func TestDeltaResponseTracking(t *testing.T) {
+	config := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {cluster},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, config.SetSnapshot(context.Background(), node.Id, snapshot))
+
+	s := server.NewServer(context.Background(), config, server.CallbackFuncs{})
+	resp := makeMockDeltaStream(t)
+	defer close(resp.recv)
+	go func() {
+		assert.NoError(t, s.DeltaAggregatedResources(resp))
+	}()
+
+	typeStatus := func() cache.TypeStatus {
+		if info := config.GetStatusInfo(node.Id); info != nil {
+			return info.GetTypeStatus(rsrc.ClusterType)
+		}
+		return cache.TypeStatus{}
+	}
+
+	resp.recv <- &discovery.DeltaDiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	<-resp.sent
+	assert.Eventually(t, func() bool { return typeStatus().SentNonce == "1" }, time.Second, time.Millisecond)
+
+	resp.recv <- &discovery.DeltaDiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType, ResponseNonce: "1",
+		ErrorDetail: &rpcstatus.Status{Message: "invalid cluster"}}
+	assert.Eventually(t, func() bool { return typeStatus().IsNacking() }, time.Second, time.Millisecond)
+	assert.Equal(t, "1", typeStatus().NackedVersion)
+	assert.Empty(t, typeStatus().AckedVersion)
+}
@@ -23,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 
 	"github.com/stretchr/testify/assert"
@@ -501,6 +502,48 @@ func TestSendError(t *testing.T) {
 	}
 }
 
+func TestTerminatedWatch(t *testing.T) {
+	for _, typ := range testTypes {
+		t.Run(typ, func(t *testing.T) {
+			// The cache terminates the watch by responding nil.
+			config := makeMockConfigWatcher()
+			config.responses = map[string][]cache.Response{typ: {nil}}
+			s := server.NewServer(context.Background(), config, server.CallbackFuncs{})
+
+			resp := makeMockStream(t)
+			resp.recv <- &discovery.DiscoveryRequest{
+				Node:    node,
+				TypeUrl: typ,
+			}
+
+			// check that the stream ends with an error instead of sending a response
+			err := s.StreamAggregatedResources(resp)
+			assert.Error(t, err)
+			assert.Empty(t, resp.sent)
+
+			close(resp.recv)
+		})
+	}
+}
+
+func TestGeneratorFailure(t *testing.T) {
+	// A generator cache terminates the watches whose resources fail to be generated.
+	c := cache.NewGeneratorCache(cache.GeneratorFunc(func(*core.Node, string, []string) ([]types.Resource, []string, error) {
+		return nil, nil, errors.New("generation failed")
+	}), cache.IDHash{}, nil)
+	s := server.NewServer(context.Background(), c, server.CallbackFuncs{})
+
+	resp := makeMockStream(t)
+	resp.recv <- &discovery.DiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	assert.Error(t, s.StreamAggregatedResources(resp))
+	close(resp.recv)
+
+	deltaResp := makeMockDeltaStream(t)
+	deltaResp.recv <- &discovery.DeltaDiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	assert.Error(t, s.DeltaAggregatedResources(deltaResp))
+	close(deltaResp.recv)
+}
+
 func TestStaleNonce(t *testing.T) {
 	for _, typ := range testTypes {
 		t.Run(typ, func(t *testing.T) {
@@ -682,3 +725,51 @@ func TestCallbackError(t *testing.T) {
 		})
 	}
 }
+
+func TestResponseTracking(t *testing.T) {
+	config := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	snapshot, err := cache.NewSnapshot("1", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {cluster},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, config.SetSnapshot(context.Background(), node.Id, snapshot))
+
+	s := server.NewServer(context.Background(), config, server.CallbackFuncs{})
+	resp := makeMockStream(t)
+	defer close(resp.recv)
+	go func() {
+		assert.NoError(t, s.StreamAggregatedResources(resp))
+	}()
+
+	typeStatus := func() cache.TypeStatus {
+		if info := config.GetStatusInfo(node.Id); info != nil {
+			return info.GetTypeStatus(rsrc.ClusterType)
+		}
+		return cache.TypeStatus{}
+	}
+
+	resp.recv <- &discovery.DiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	<-resp.sent
+	assert.Eventually(t, func() bool { return typeStatus().SentNonce == "1" }, time.Second, time.Millisecond)
+	assert.Equal(t, "1", typeStatus().SentVersion)
+
+	resp.recv <- &discovery.DiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType, VersionInfo: "1", ResponseNonce: "1"}
+	assert.Eventually(t, func() bool { return typeStatus().AckedVersion == "1" }, time.Second, time.Millisecond)
+	assert.False(t, typeStatus().IsNacking())
+
+	snapshot, err = cache.NewSnapshot("2", map[rsrc.Type][]types.Resource{
+		rsrc.ClusterType: {cluster},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, config.SetSnapshot(context.Background(), node.Id, snapshot))
+	<-resp.sent
+
+	// The rejected version is the one of the last response, not the request version.
+	resp.recv <- &discovery.DiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType, VersionInfo: "1", ResponseNonce: "2",
+		ErrorDetail: &rpcstatus.Status{Message: "invalid cluster"}}
+	assert.Eventually(t, func() bool { return typeStatus().IsNacking() }, time.Second, time.Millisecond)
+	status := typeStatus()
+	assert.Equal(t, "2", status.NackedVersion)
+	assert.Equal(t, "invalid cluster", status.NackDetail.GetMessage())
+	assert.Equal(t, "1", status.AckedVersion)
+}